@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+
+	"github.com/prometheus/common/log"
+	"github.com/wrouesnel/tail_exporter/config"
+)
+
+// beatsMaxFrameSize bounds the payload of a lumberjack frame.
+const beatsMaxFrameSize = 64 << 20
+
+// Lumberjack v2 frame types
+const (
+	beatsVersion         = '2'
+	beatsFrameWindow     = 'W'
+	beatsFrameJSON       = 'J'
+	beatsFrameData       = 'D'
+	beatsFrameCompressed = 'C'
+	beatsFrameAck        = 'A'
+)
+
+// listenBeats binds the TCP socket of a beats input, which is wrapped in TLS
+// if the input has a certificate, and starts ingesting the events of every
+// connection to it.
+func (c *TailCollector) listenBeats(cfg *config.InputConfig) error {
+	tlsConfig, err := collectorTLSConfig(cfg.TLSCertFile, cfg.TLSKeyFile, cfg.TLSClientCAFile)
+	if err != nil {
+		return err
+	}
+	l, err := net.Listen("tcp", cfg.Address)
+	if err != nil {
+		return err
+	}
+	if tlsConfig != nil {
+		l = tls.NewListener(l, tlsConfig)
+	}
+
+	go c.acceptStream(l, cfg.Name, func(conn net.Conn, r io.Reader) error {
+		input := c.networkInput(cfg, conn.RemoteAddr())
+		if tlsConn, ok := conn.(*tls.Conn); ok {
+			meta, err := tlsClientMetadata(tlsConn)
+			if err != nil {
+				return fmt.Errorf("error setting up connection from %s: %s", conn.RemoteAddr(), err)
+			}
+			input.withMetadata(meta)
+		}
+
+		b := &beatsConn{input: input, w: conn}
+		err := b.readFrames(bufio.NewReader(r))
+		if err != nil && !isTimeout(err) {
+			input.decodeErrors.Inc()
+			return fmt.Errorf("error reading beats frames from %s: %s", conn.RemoteAddr(), err)
+		}
+		return err
+	})
+	return nil
+}
+
+// beatsConn ingests the events sent on a lumberjack v2 connection, as sent
+// by Filebeat and the other Beats. Clients send the number of events in a
+// window before sending them, and wait for the window to be acknowledged
+// with the sequence number of its last event.
+type beatsConn struct {
+	input *LineInput
+	w     io.Writer
+
+	window   uint32
+	received uint32
+}
+
+// readFrames reads frames from r until it ends. Compressed frames hold
+// further frames.
+func (b *beatsConn) readFrames(r *bufio.Reader) error {
+	header := make([]byte, 2)
+	for {
+		if _, err := io.ReadFull(r, header); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if header[0] != beatsVersion {
+			return fmt.Errorf("unsupported protocol version %q", header[0])
+		}
+
+		var err error
+		switch header[1] {
+		case beatsFrameWindow:
+			b.window, err = readUint32(r)
+			b.received = 0
+		case beatsFrameJSON:
+			err = b.readJSONFrame(r)
+		case beatsFrameData:
+			err = b.readDataFrame(r)
+		case beatsFrameCompressed:
+			err = b.readCompressedFrame(r)
+		default:
+			err = fmt.Errorf("unknown frame type %q", header[1])
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// readJSONFrame reads an event encoded as a JSON object.
+func (b *beatsConn) readJSONFrame(r *bufio.Reader) error {
+	seq, err := readUint32(r)
+	if err != nil {
+		return err
+	}
+	payload, err := readPayload(r)
+	if err != nil {
+		return err
+	}
+
+	var event map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	decoder.UseNumber()
+	if err := decoder.Decode(&event); err != nil {
+		b.input.decodeErrors.Inc()
+		log.Debugln("Invalid beats event from", b.input.name, err)
+	} else {
+		b.ingest(event)
+	}
+	return b.done(seq)
+}
+
+// readDataFrame reads an event encoded as key/value pairs.
+func (b *beatsConn) readDataFrame(r *bufio.Reader) error {
+	seq, err := readUint32(r)
+	if err != nil {
+		return err
+	}
+	pairs, err := readUint32(r)
+	if err != nil {
+		return err
+	}
+
+	event := make(map[string]interface{})
+	for i := uint32(0); i < pairs; i++ {
+		key, err := readPayload(r)
+		if err != nil {
+			return err
+		}
+		value, err := readPayload(r)
+		if err != nil {
+			return err
+		}
+		event[string(key)] = string(value)
+	}
+	b.ingest(event)
+	return b.done(seq)
+}
+
+// readCompressedFrame reads the zlib compressed frames of a compressed frame.
+func (b *beatsConn) readCompressedFrame(r *bufio.Reader) error {
+	size, err := readUint32(r)
+	if err != nil {
+		return err
+	}
+	compressed := &io.LimitedReader{R: r, N: int64(size)}
+	zr, err := zlib.NewReader(compressed)
+	if err != nil {
+		return err
+	}
+	defer zr.Close() // nolint: errcheck
+	if err := b.readFrames(bufio.NewReader(zr)); err != nil {
+		return err
+	}
+	// Skip anything after the end of the zlib stream.
+	_, err = io.Copy(ioutil.Discard, compressed)
+	return err
+}
+
+// ingest ingests the message of an event, with the event's other fields as
+// metadata. Events without a message are skipped.
+func (b *beatsConn) ingest(event map[string]interface{}) {
+	msg, ok := scalarString(event["message"])
+	if !ok {
+		return
+	}
+	meta := make(lineMetadata, len(event))
+	recordMetadata(meta, "", event)
+	delete(meta, "message")
+	b.input.IngestMessage(msg, meta)
+}
+
+// done accounts for the event with sequence number seq, acknowledging
+// the window if it was the window's last event.
+func (b *beatsConn) done(seq uint32) error {
+	b.received++
+	if b.received < b.window {
+		return nil
+	}
+	b.received = 0
+
+	ack := []byte{beatsVersion, beatsFrameAck, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(ack[2:], seq)
+	_, err := b.w.Write(ack)
+	return err
+}
+
+func readUint32(r io.Reader) (uint32, error) {
+	var buf [4]byte
+	if _, err := io.ReadFull(r, buf[:]); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(buf[:]), nil
+}
+
+// readPayload reads a length prefixed payload. It is buffered as it is read
+// rather than allocated up front, since the length is only checked against
+// the stream as it is read.
+func readPayload(r io.Reader) ([]byte, error) {
+	size, err := readUint32(r)
+	if err != nil {
+		return nil, err
+	}
+	if size > beatsMaxFrameSize {
+		return nil, errors.New("frame payload too large")
+	}
+	var payload bytes.Buffer
+	payload.Grow(capacity(int(size)))
+	if _, err := io.CopyN(&payload, r, int64(size)); err == io.EOF {
+		return nil, io.ErrUnexpectedEOF
+	} else if err != nil {
+		return nil, err
+	}
+	return payload.Bytes(), nil
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"io"
+	"runtime"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	dto "github.com/prometheus/client_model/go"
+)
+
+const beatsConfig = `
+metric_configs:
+- name: hellos
+  help: hellos by host
+  type: counter
+  regex: '^hello'
+  labels:
+  - name: host
+    value: $__host
+  value: +1
+`
+
+// beatsFrame returns a lumberjack frame of the given type, with fields
+// which are uint32s, or strings prefixed with their length.
+func beatsFrame(frameType byte, fields ...interface{}) []byte {
+	frame := []byte{beatsVersion, frameType}
+	var buf [4]byte
+	for _, field := range fields {
+		switch field := field.(type) {
+		case int:
+			binary.BigEndian.PutUint32(buf[:], uint32(field))
+			frame = append(frame, buf[:]...)
+		case string:
+			binary.BigEndian.PutUint32(buf[:], uint32(len(field)))
+			frame = append(append(frame, buf[:]...), field...)
+		}
+	}
+	return frame
+}
+
+// compressedFrame returns a compressed frame holding frames.
+func compressedFrame(t *testing.T, frames ...[]byte) []byte {
+	var buf bytes.Buffer
+	w := zlib.NewWriter(&buf)
+	if _, err := w.Write(bytes.Join(frames, nil)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return beatsFrame(beatsFrameCompressed, buf.String())
+}
+
+// beatsAcks returns the acks of a frame stream.
+func beatsAcks(acks ...int) []byte {
+	var stream []byte
+	for _, seq := range acks {
+		stream = append(stream, beatsFrame(beatsFrameAck, seq)...)
+	}
+	return stream
+}
+
+func TestBeatsFrames(t *testing.T) {
+	window := func(size int) []byte { return beatsFrame(beatsFrameWindow, size) }
+	event := func(seq int, host string) []byte {
+		return beatsFrame(beatsFrameJSON, seq, `{"message":"hello","host":"`+host+`"}`)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		frames [][]byte
+		acks   []byte
+		hellos map[string]float64
+		errors float64 // decode errors
+		err    bool    // whether reading fails
+	}{
+		{
+			name:   "json",
+			frames: [][]byte{window(2), event(1, "a"), event(2, "b")},
+			acks:   beatsAcks(2),
+			hellos: map[string]float64{"a": 1, "b": 1},
+		},
+		{
+			name: "data",
+			frames: [][]byte{
+				window(2),
+				beatsFrame(beatsFrameData, 1, 2, "message", "hello", "host", "a"),
+				beatsFrame(beatsFrameData, 2, 1, "host", "a"),
+			},
+			acks:   beatsAcks(2),
+			hellos: map[string]float64{"a": 1},
+		},
+		{
+			name:   "windows",
+			frames: [][]byte{window(1), event(1, "a"), window(2), event(2, "a"), event(3, "a"), window(1), event(4, "a")},
+			acks:   beatsAcks(1, 3, 4),
+			hellos: map[string]float64{"a": 4},
+		},
+		{
+			name:   "window never filled",
+			frames: [][]byte{window(2), event(1, "a"), event(2, "a"), window(3), event(3, "a"), event(4, "a")},
+			acks:   beatsAcks(2),
+			hellos: map[string]float64{"a": 4},
+		},
+		{
+			name:   "invalid json",
+			frames: [][]byte{window(2), beatsFrame(beatsFrameJSON, 1, `{"message":`), event(2, "a")},
+			acks:   beatsAcks(2),
+			hellos: map[string]float64{"a": 1},
+			errors: 1,
+		},
+		{
+			name:   "compressed",
+			frames: [][]byte{window(3), compressedFrame(t, event(1, "a"), event(2, "b")), event(3, "a")},
+			acks:   beatsAcks(3),
+			hellos: map[string]float64{"a": 2, "b": 1},
+		},
+		{
+			name: "nested compressed",
+			frames: [][]byte{compressedFrame(t,
+				window(3),
+				event(1, "a"),
+				compressedFrame(t, event(2, "b"), compressedFrame(t, event(3, "c"))),
+			)},
+			acks:   beatsAcks(3),
+			hellos: map[string]float64{"a": 1, "b": 1, "c": 1},
+		},
+		{
+			name:   "unsupported version",
+			frames: [][]byte{{'1', beatsFrameWindow, 0, 0, 0, 1}},
+			err:    true,
+		},
+		{
+			name:   "unknown frame",
+			frames: [][]byte{window(1), beatsFrame('X', 1)},
+			err:    true,
+		},
+		{
+			name:   "truncated frame",
+			frames: [][]byte{window(1), event(1, "a")[:12]},
+			err:    true,
+		},
+		{
+			name:   "truncated header",
+			frames: [][]byte{window(1), {beatsVersion}},
+			err:    true,
+		},
+		{
+			name:   "payload too large",
+			frames: [][]byte{window(1), beatsFrame(beatsFrameJSON, 1, beatsMaxFrameSize+1)},
+			err:    true,
+		},
+		{
+			name:   "corrupt compressed frame",
+			frames: [][]byte{window(1), beatsFrame(beatsFrameCompressed, "not zlib")},
+			err:    true,
+		},
+	} {
+		c := newTestCollector(t, beatsConfig)
+		var acks bytes.Buffer
+		b := &beatsConn{input: c.Input("beats"), w: &acks}
+		err := b.readFrames(bufio.NewReader(bytes.NewReader(bytes.Join(tc.frames, nil))))
+		c.Close()
+
+		if tc.err != (err != nil) {
+			t.Errorf("%s: unexpected error %v", tc.name, err)
+		}
+		if !bytes.Equal(acks.Bytes(), tc.acks) {
+			t.Errorf("%s: expected acks %q, got %q", tc.name, tc.acks, acks.Bytes())
+		}
+		if c.families[0].seriesLen() != len(tc.hellos) {
+			t.Errorf("%s: expected %d series, got %d", tc.name, len(tc.hellos), c.families[0].seriesLen())
+		}
+		for host, hellos := range tc.hellos {
+			series := c.families[0].getSeries([]*dto.LabelPair{
+				{Name: proto.String("host"), Value: proto.String(host)},
+			})
+			if series == nil {
+				t.Errorf("%s: expected a series for %s", tc.name, host)
+			} else if value := series.Get(); value != hellos {
+				t.Errorf("%s: expected %v hellos from %s, got %v", tc.name, hellos, host, value)
+			}
+		}
+		if value := readValue(t, c.inputDecodeErrors.WithLabelValues("beats")); value != tc.errors {
+			t.Errorf("%s: expected %v decode errors, got %v", tc.name, tc.errors, value)
+		}
+	}
+}
+
+func TestBeatsPayloadBounds(t *testing.T) {
+	// A payload claiming to be as large as allowed only costs what the
+	// stream actually holds.
+	stream := []byte{0, 0, 0, 0, '{', '}'}
+	binary.BigEndian.PutUint32(stream, beatsMaxFrameSize)
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	_, err := readPayload(bytes.NewReader(stream))
+	runtime.ReadMemStats(&after)
+	if err != io.ErrUnexpectedEOF {
+		t.Errorf("expected a truncated payload, got %v", err)
+	}
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1<<20 {
+		t.Errorf("expected a truncated payload to allocate little, allocated %d bytes", allocated)
+	}
+
+	if payload, err := readPayload(bytes.NewReader(beatsFrame(beatsFrameJSON, "{}")[2:])); err != nil || string(payload) != "{}" {
+		t.Errorf("expected {}, got %q, %v", payload, err)
+	}
+}
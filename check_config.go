@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/wrouesnel/tail_exporter/config"
+)
+
+// checkConfig strictly validates each named config file, printing every
+// problem found. It returns the process exit code.
+func checkConfig(filenames []string) int {
+	if len(filenames) == 0 {
+		fmt.Fprintln(os.Stderr, "check-config: no config files specified")
+		return 2
+	}
+
+	exitCode := 0
+	for _, filename := range filenames {
+		_, err := config.LoadFileStrict(filename)
+		if err == nil {
+			fmt.Printf("%s: OK\n", filename)
+			continue
+		}
+		exitCode = 1
+
+		if verrs, ok := err.(config.ValidationErrors); ok {
+			for _, verr := range verrs {
+				fmt.Fprintf(os.Stderr, "%s: %s\n", filename, verr)
+			}
+			fmt.Fprintf(os.Stderr, "%s: %d errors\n", filename, len(verrs))
+		} else {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", filename, err)
+		}
+	}
+	return exitCode
+}
@@ -4,20 +4,51 @@ import (
 	"fmt"
 	"gopkg.in/yaml.v2"
 	"io/ioutil"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/prometheus/common/model"
 )
 
-// Load parses the YAML input s into a Config.
+// Load parses the YAML input s into a Config. Rules which can't be loaded
+// are returned as ValidationErrors.
 func Load(s string) (*Config, error) {
-	cfg := &Config{}
+	cfg, err := parse(s)
+	if err != nil {
+		return nil, err
+	}
+
+	v := &validator{src: s}
+	v.checkRules(cfg.MetricConfigs)
+	if len(v.errs) > 0 {
+		sort.Stable(v.errs)
+		return nil, v.errs
+	}
+	cfg.groupMetricFamilies()
+	return cfg, nil
+}
 
-	err := yaml.Unmarshal([]byte(s), cfg)
+// LoadStrict parses the YAML input s into a Config and then validates it,
+// returning every problem found as ValidationErrors.
+func LoadStrict(s string) (*Config, error) {
+	cfg, err := parse(s)
 	if err != nil {
 		return nil, err
 	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	cfg.groupMetricFamilies()
+	return cfg, nil
+}
+
+func parse(s string) (*Config, error) {
+	cfg := &Config{}
+	if err := yaml.Unmarshal([]byte(s), cfg); err != nil {
+		return nil, err
+	}
 	cfg.Original = s
 	return cfg, nil
 }
@@ -35,13 +66,115 @@ func LoadFile(filename string) (*Config, error) {
 	return cfg, nil
 }
 
+// LoadFileStrict parses and validates the given YAML file into a Config.
+func LoadFileStrict(filename string) (*Config, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return LoadStrict(string(content))
+}
+
 type Config struct {
-	MetricConfigs []MetricParser `yaml:"metric_configs,omitempty"`
+	MetricConfigs []MetricParser       `yaml:"metric_configs,omitempty"`
+	RemoteWrite   []*RemoteWriteConfig `yaml:"remote_write,omitempty"`
+	Inputs        []*InputConfig       `yaml:"inputs,omitempty"`
 
 	// Catchall
-	XXX map[string]string `yaml:",inline"`
+	XXX map[string]interface{} `yaml:",inline"`
+
+	// MetricFamilies groups MetricConfigs by metric name, in order of first
+	// appearance.
+	MetricFamilies []*MetricFamily `yaml:"-"`
 
-	Original string
+	Original string `yaml:"-"`
+}
+
+// MetricFamily is the set of MetricParsers which populate the same metric
+// name. Every parser in a family agrees on type, help and label names.
+type MetricFamily struct {
+	Name string
+	Help string
+	Type MetricType
+	// LabelNames are the sorted label names of every series in the family.
+	LabelNames []string
+	// DynamicLabelNames is set if every parser in the family takes label
+	// names from capture groups, so LabelNames can only be known at runtime.
+	DynamicLabelNames bool
+	// Buckets are the upper bounds of the buckets of a histogram.
+	Buckets []float64
+	// Window is the sliding window of a rate.
+	Window model.Duration
+	// Identity are the label names identifying the series of an info metric.
+	Identity []string
+
+	Parsers []*MetricParser
+}
+
+// groupMetricFamilies populates MetricFamilies from MetricConfigs, which must
+// have been checked to be consistent.
+func (this *Config) groupMetricFamilies() {
+	this.MetricFamilies = nil
+	families := make(map[string]*MetricFamily)
+	for idx := range this.MetricConfigs {
+		mp := &this.MetricConfigs[idx]
+		family, found := families[mp.Name]
+		if !found {
+			family = &MetricFamily{
+				Name:              mp.Name,
+				Help:              mp.Help,
+				Type:              mp.Type,
+				DynamicLabelNames: true,
+				Buckets:           mp.Buckets,
+				Window:            mp.Window,
+				Identity:          mp.Identity,
+			}
+			families[mp.Name] = family
+			this.MetricFamilies = append(this.MetricFamilies, family)
+		}
+		if labelNames, dynamic := labelSignature(mp); !dynamic && family.DynamicLabelNames {
+			family.LabelNames = labelNames
+			family.DynamicLabelNames = false
+		}
+		family.Parsers = append(family.Parsers, mp)
+	}
+}
+
+// ReferencesMetadata reports whether any rule or mapping uses the named line
+// metadata, so metadata which is costly to find can be skipped when it isn't
+// needed.
+func (this *Config) ReferencesMetadata(name string) bool {
+	refs := func(def LabelValueDef) bool {
+		return def.FieldType == LabelValueMetadata && def.MetadataName == name
+	}
+	for idx := range this.MetricConfigs {
+		mp := &this.MetricConfigs[idx]
+		for _, labels := range [][]LabelDef{mp.Labels, mp.Exemplar} {
+			for _, label := range labels {
+				if refs(label.Name) || refs(label.Value) {
+					return true
+				}
+			}
+		}
+		if mp.Timestamp != nil && refs(mp.Timestamp.Value) {
+			return true
+		}
+		if corr := mp.Correlation; corr != nil {
+			if refs(corr.Key) || refs(corr.EndKey) || (corr.EndTimestamp != nil && refs(corr.EndTimestamp.Value)) {
+				return true
+			}
+		}
+	}
+	for _, input := range this.Inputs {
+		for _, mapping := range input.Mappings {
+			for _, label := range mapping.Labels {
+				if refs(label.Name) || refs(label.Value) {
+					return true
+				}
+			}
+		}
+	}
+	return false
 }
 
 // Metric type definitions
@@ -51,39 +184,80 @@ const (
 	MetricUntyped MetricType = iota
 	MetricGauge   MetricType = iota
 	MetricCounter MetricType = iota
+	// MetricHistogram is observed by correlation rules, and by inputs which
+	// map metrics.
+	MetricHistogram MetricType = iota
+	// MetricRate is exposed as a gauge of the per second rate of the values
+	// added in a sliding window.
+	MetricRate MetricType = iota
+	// MetricInfo is exposed as a gauge which is always 1. Each set of
+	// identity label values has a single series.
+	MetricInfo MetricType = iota
 )
 
-type ErrorInvalidMetricType struct{}
+// DefaultRateWindow is the sliding window of rates which don't set one.
+const DefaultRateWindow = model.Duration(time.Minute)
+
+type ErrorInvalidMetricType struct {
+	name string
+}
 
 func (this ErrorInvalidMetricType) Error() string {
-	return "Metric type must be 'gauge' or 'counter'"
+	return fmt.Sprintf("Metric type must be 'gauge', 'counter', 'histogram', 'rate', 'info' or 'untyped', not %q", this.name)
+}
+
+// parseMetricType converts a metric type name to a MetricType.
+func parseMetricType(s string) (MetricType, error) {
+	switch s {
+	case "gauge":
+		return MetricGauge, nil
+	case "counter":
+		return MetricCounter, nil
+	case "histogram":
+		return MetricHistogram, nil
+	case "rate":
+		return MetricRate, nil
+	case "info":
+		return MetricInfo, nil
+	case "untyped", "":
+		return MetricUntyped, nil
+	default:
+		return MetricUntyped, ErrorInvalidMetricType{s}
+	}
 }
 
+// UnmarshalYAML implements the yaml.Unmarshaler interface. Unknown type names
+// are treated as untyped; strict validation reports them.
 func (this *MetricType) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	var s string
 	if err := unmarshal(&s); err != nil {
 		return err
 	}
 
-	switch s {
-	case "gauge":
-		*this = MetricGauge
-	case "counter":
-		*this = MetricCounter
-	default:
-		*this = MetricUntyped
-	}
+	*this, _ = parseMetricType(s)
 	return nil
 }
 
 func (this *MetricType) MarshalYAML() (interface{}, error) {
-	switch *this {
+	return this.String(), nil
+}
+
+func (this MetricType) String() string {
+	switch this {
 	case MetricCounter:
-		return "counter", nil
+		return "counter"
 	case MetricGauge:
-		return "gauge", nil
+		return "gauge"
+	case MetricUntyped:
+		return "untyped"
+	case MetricHistogram:
+		return "histogram"
+	case MetricRate:
+		return "rate"
+	case MetricInfo:
+		return "info"
 	default:
-		return "invalid metric", nil
+		return "invalid metric"
 	}
 }
 
@@ -95,6 +269,34 @@ type MetricParser struct {
 	Labels  []LabelDef     `yaml:"labels,omitempty"`
 	Value   ValueDef       `yaml:"value,omitempty"`
 	Timeout model.Duration `yaml:"timeout,omitempty"`
+	// Exemplar labels are attached to counter increments and histogram
+	// observations, so a spike can be traced back to the lines which caused
+	// it.
+	Exemplar []LabelDef `yaml:"exemplar,omitempty"`
+	// Timestamp extracts the time the line was logged.
+	Timestamp *TimestampDef `yaml:"timestamp,omitempty"`
+	// Correlation makes a histogram rule observe the time from the lines it
+	// matches to the lines which end them, rather than a value.
+	Correlation *CorrelationDef `yaml:"correlation,omitempty"`
+	// Buckets are the upper bounds of the buckets of a histogram.
+	Buckets []float64 `yaml:"buckets,omitempty"`
+	// Window is the sliding window a rate is computed over.
+	Window model.Duration `yaml:"window,omitempty"`
+	// Identity are the label names identifying the series of an info
+	// metric. A series with new values for its other labels replaces the
+	// series with the same identity. Without it an info metric has a single
+	// series.
+	Identity []string `yaml:"identity,omitempty"`
+
+	// Catchall
+	XXX map[string]interface{} `yaml:",inline"`
+
+	// typeName is the type as written in the config file, kept so strict
+	// validation can reject unknown types which otherwise load as untyped.
+	typeName string
+	// hasValue is set if the config file gives a value, which info metrics
+	// don't take.
+	hasValue bool
 }
 
 type MetricParserErrorNoHelp struct{}
@@ -109,10 +311,27 @@ func (this *MetricParser) UnmarshalYAML(unmarshal func(interface{}) error) error
 		return err
 	}
 
-	if this.Help == "" {
-		return &MetricParserErrorNoHelp{}
+	if this.Type == MetricHistogram && this.Buckets == nil {
+		this.Buckets = DefaultBuckets
 	}
+	if this.Type == MetricRate && this.Window == 0 {
+		this.Window = DefaultRateWindow
+	}
+
+	var raw struct {
+		Type  string      `yaml:"type"`
+		Value interface{} `yaml:"value"`
+	}
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+	this.typeName = raw.Type
+	this.hasValue = raw.Value != nil
 
+	// Info metrics are always 1.
+	if this.Type == MetricInfo {
+		this.Value = ValueDef{ValueOp: ValueOpEquals, ValueSource: ValueSourceLiteral, Literal: 1}
+	}
 	return nil
 }
 
@@ -120,12 +339,12 @@ type LabelDef struct {
 	Name  LabelValueDef `yaml:"name,omitempty"`
 	Value LabelValueDef `yaml:"value,omitempty"`
 
-	// Optional parameters get loaded into this map.
-	optional map[string]string `yaml:",inline"`
-
 	// Optional parameter: specify a default value for a missing key
-	Default    string
-	HasDefault bool
+	Default    string `yaml:"default,omitempty"`
+	HasDefault bool   `yaml:"-"`
+
+	// Catchall
+	XXX map[string]interface{} `yaml:",inline"`
 }
 
 // UnmarshalYAML implements the yaml.Unmarshaler interface.
@@ -136,18 +355,20 @@ func (this *LabelDef) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	}
 
 	// Populate optional values
-	this.Default, this.HasDefault = this.optional["default"]
+	var optional struct {
+		Default *string `yaml:"default"`
+	}
+	if err := unmarshal(&optional); err != nil {
+		return err
+	}
+	this.HasDefault = optional.Default != nil
 	return nil
 }
 
 // MarshalYAML implements the yaml.Marshaler interface.
 func (this *LabelDef) MarshalYAML() (interface{}, error) {
-	// Set optional values into the map
-	if this.HasDefault {
-		this.optional["default"] = this.Default
-	}
 	type plain LabelDef
-	return yaml.Marshal((*plain)(this))
+	return (*plain)(this), nil
 }
 
 type LabelValueType int
@@ -156,14 +377,22 @@ const (
 	LabelValueLiteral           LabelValueType = iota
 	LabelValueCaptureGroup      LabelValueType = iota
 	LabelValueCaptureGroupNamed LabelValueType = iota
+	LabelValueMetadata          LabelValueType = iota
 )
 
+// MetadataPrefix marks references to metadata the input attached to a line,
+// e.g. $__stream, rather than to capture groups.
+const MetadataPrefix = "__"
+
 // Defines a type which sets ascii label values
 type LabelValueDef struct {
 	FieldType        LabelValueType
 	Literal          string
 	CaptureGroup     int
 	CaptureGroupName string
+	// MetadataName is the name of the line metadata referenced, without
+	// its MetadataPrefix.
+	MetadataName string
 }
 
 // UnmarshalYAML implements the yaml.Unmarshaler interface.
@@ -180,7 +409,10 @@ func (this *LabelValueDef) UnmarshalYAML(unmarshal func(interface{}) error) erro
 		// PCRE module just yet.
 		str := strings.Trim(s, "$")
 		val, err := strconv.ParseInt(str, 10, 32)
-		if err != nil {
+		if strings.HasPrefix(str, MetadataPrefix) {
+			this.FieldType = LabelValueMetadata
+			this.MetadataName = strings.TrimPrefix(str, MetadataPrefix)
+		} else if err != nil {
 			this.FieldType = LabelValueCaptureGroupNamed
 			this.CaptureGroupName = str
 		} else {
@@ -199,11 +431,34 @@ func (this *LabelValueDef) MarshalYAML() (interface{}, error) {
 	switch this.FieldType {
 	case LabelValueCaptureGroup:
 		return fmt.Sprintf("$%d", this.CaptureGroup), nil
+	case LabelValueCaptureGroupNamed:
+		return fmt.Sprintf("$%s", this.CaptureGroupName), nil
+	case LabelValueMetadata:
+		return fmt.Sprintf("$%s%s", MetadataPrefix, this.MetadataName), nil
 	default:
 		return this.Literal, nil
 	}
 }
 
+// Timestamp formats which aren't Go time layouts
+const (
+	TimestampUnix   = "unix"
+	TimestampUnixMs = "unix_ms"
+	TimestampUnixUs = "unix_us"
+)
+
+// TimestampDef extracts the time a line was logged from the line.
+type TimestampDef struct {
+	Value LabelValueDef `yaml:"value"`
+	// Format is a Go time layout, or TimestampUnix, TimestampUnixMs or
+	// TimestampUnixUs for seconds, milliseconds or microseconds since the
+	// epoch.
+	Format string `yaml:"format"`
+
+	// Catchall
+	XXX map[string]interface{} `yaml:",inline"`
+}
+
 // ValueSourceType specifies the sourcex
 type ValueOpType int
 
@@ -222,6 +477,17 @@ const (
 	ValueSourceCaptureGroup
 	// Assign the value frm the given named capture group to the metric
 	ValueSourceNamedCaptureGroup
+	// Assign the time the line was processed to the metric
+	ValueSourceNow
+	// Assign the time the line was logged, from the rule's timestamp, to the
+	// metric
+	ValueSourceTimestamp
+)
+
+// Value keywords which set a metric to a time, in seconds since the epoch.
+const (
+	ValueNow       = "now"
+	ValueTimestamp = "timestamp"
 )
 
 // ValueDef is the definition for numeric values which will be assigned to metrics
@@ -240,6 +506,19 @@ func (this *ValueDef) UnmarshalYAML(unmarshal func(interface{}) error) error {
 		return err
 	}
 
+	switch s {
+	case ValueNow:
+		this.ValueOp, this.ValueSource = ValueOpEquals, ValueSourceNow
+		return nil
+	case ValueTimestamp:
+		this.ValueOp, this.ValueSource = ValueOpEquals, ValueSourceTimestamp
+		return nil
+	}
+
+	if len(s) < 2 {
+		return fmt.Errorf("Value specification must be %s, %s or an operation followed by a literal or capture group: %q", ValueNow, ValueTimestamp, s)
+	}
+
 	// Determine type of operation
 	switch s[0] {
 	case '+':
@@ -279,6 +558,13 @@ func (this *ValueDef) UnmarshalYAML(unmarshal func(interface{}) error) error {
 
 // MarshalYAML implements the yaml.Marshaler interface
 func (this *ValueDef) MarshalYAML() (interface{}, error) {
+	switch this.ValueSource {
+	case ValueSourceNow:
+		return ValueNow, nil
+	case ValueSourceTimestamp:
+		return ValueTimestamp, nil
+	}
+
 	var op, groupSpec, inputField string
 	switch this.ValueOp {
 	case ValueOpAdd:
@@ -0,0 +1,124 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLoadRateValueOp(t *testing.T) {
+	const rule = `
+metric_configs:
+- name: requests_per_second
+  help: requests per second
+  type: rate
+  regex: 'request (\d+)'
+  value: %s
+`
+	for value, valid := range map[string]bool{
+		"+1":        true,
+		"+$1":       true,
+		"-1":        false,
+		"=$1":       false,
+		"now":       false,
+		"timestamp": false,
+	} {
+		_, err := Load(strings.Replace(rule, "%s", value, 1))
+		if valid && err != nil {
+			t.Errorf("%s: unexpected error: %v", value, err)
+		}
+		if !valid && (err == nil || !strings.Contains(err.Error(), "rate values must be added")) {
+			t.Errorf("%s: expected rate values to be rejected, got %v", value, err)
+		}
+	}
+}
+
+func TestLoadExecCommand(t *testing.T) {
+	const input = `
+inputs:
+- kind: exec
+  %s
+`
+	for command, valid := range map[string]bool{
+		"command: [journalctl, -f]": true,
+		"command: [cat]":            true,
+		"command: []":               false,
+		"command: ['']":             false,
+		"name: no-command":          false,
+	} {
+		cfg, err := Load(strings.Replace(input, "%s", command, 1))
+		if valid && err != nil {
+			t.Errorf("%s: unexpected error: %v", command, err)
+		}
+		if !valid && (err == nil || !strings.Contains(err.Error(), "command cannot be empty")) {
+			t.Errorf("%s: expected an empty command to be rejected, got %v", command, err)
+		}
+		if valid && err == nil && cfg.Inputs[0].Name != cfg.Inputs[0].Command[0] {
+			t.Errorf("%s: expected the input to be named after its command, got %q", command, cfg.Inputs[0].Name)
+		}
+	}
+}
+
+func TestLoadStrictErrors(t *testing.T) {
+	const cfg = `metric_configs:
+- name: requests_total
+  regex: 'request'
+  value: +1
+  colour: blue
+- name: requests_per_second
+  help: request rate
+  type: rate
+  regex: 'request'
+  value: =1
+- name: request_seconds
+  help: request duration
+  type: histogram
+  regex: 'request (\d+)'
+  value: =$1
+- name: requests_total
+  help: requests
+  regex: 'req'
+  value: +1
+`
+	expected := []struct {
+		line int
+		path string
+		err  string
+	}{
+		{2, "metric_configs[0].help", "Metric help field cannot be empty."},
+		{5, "metric_configs[0].colour", `unknown field "colour"`},
+		{10, "metric_configs[1].value", "rate values must be added, with +"},
+		{13, "metric_configs[2].type", "histogram rules must have a correlation"},
+		{17, "metric_configs[3].help", `metric "requests_total" has help "requests" but rule 0 declares it with ""`},
+	}
+
+	check := func(name string, err error, strict bool) {
+		errs, ok := err.(ValidationErrors)
+		if !ok {
+			t.Fatalf("%s: expected ValidationErrors, got %v", name, err)
+		}
+		n := 0
+		for _, e := range expected {
+			// Unknown fields are only rejected by strict validation.
+			if !strict && e.line == 5 {
+				continue
+			}
+			if n >= len(errs) {
+				t.Errorf("%s: missing error at line %d: %s", name, e.line, e.err)
+				continue
+			}
+			got := errs[n]
+			if got.Line != e.line || got.Path != e.path || got.Err.Error() != e.err {
+				t.Errorf("%s: expected line %d: %s: %s, got %v", name, e.line, e.path, e.err, got)
+			}
+			n++
+		}
+		if n < len(errs) {
+			t.Errorf("%s: unexpected errors: %v", name, errs[n:])
+		}
+	}
+
+	_, err := LoadStrict(cfg)
+	check("LoadStrict", err, true)
+	_, err = Load(cfg)
+	check("Load", err, false)
+}
@@ -0,0 +1,92 @@
+// Correlation rule configuration
+
+package config
+
+import (
+	"errors"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+// Correlation defaults
+const (
+	DefaultCorrelationTTL        = model.Duration(time.Hour)
+	DefaultCorrelationMaxPending = 10000
+)
+
+// CorrelationDef makes a histogram rule observe the time between a line its
+// regex matches, which starts an event, and a later line which ends the same
+// event. Events are identified by a key taken from both lines.
+type CorrelationDef struct {
+	// Key identifies the event a line matched by the rule's regex starts.
+	Key LabelValueDef `yaml:"key"`
+	// EndRegex matches the lines which end events.
+	EndRegex Regexp `yaml:"end_regex"`
+	// EndKey identifies the event a line matched by EndRegex ends.
+	EndKey LabelValueDef `yaml:"end_key"`
+	// EndTimestamp extracts the time an end line was logged, and is used
+	// with the rule's timestamp. Without them the time lines are processed
+	// is used.
+	EndTimestamp *TimestampDef `yaml:"end_timestamp,omitempty"`
+	// TTL is how long a started event waits for its end line.
+	TTL model.Duration `yaml:"ttl,omitempty"`
+	// MaxPending bounds the number of started events waiting for their end
+	// lines. The oldest event is dropped to start another.
+	MaxPending int `yaml:"max_pending,omitempty"`
+
+	// Catchall
+	XXX map[string]interface{} `yaml:",inline"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (this *CorrelationDef) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain CorrelationDef
+	if err := unmarshal((*plain)(this)); err != nil {
+		return err
+	}
+
+	if this.EndRegex.String() == "" {
+		return errors.New("correlation end_regex cannot be empty")
+	}
+	if this.TTL == 0 {
+		this.TTL = DefaultCorrelationTTL
+	}
+	if this.MaxPending == 0 {
+		this.MaxPending = DefaultCorrelationMaxPending
+	}
+	return nil
+}
+
+func (v *validator) validateCorrelation(mp *MetricParser, path ...interface{}) {
+	if mp.Correlation == nil {
+		return
+	}
+	corr := mp.Correlation
+	corrPath := appendPath(path, "correlation")
+	v.checkOverflow(corr.XXX, corrPath...)
+
+	v.checkLabelValueRef(&mp.Regex, corr.Key, appendPath(corrPath, "key")...)
+	if corr.MaxPending <= 0 {
+		v.report(errors.New("max_pending must be positive"), appendPath(corrPath, "max_pending")...)
+	}
+
+	v.checkOverflow(corr.EndRegex.original.XXX, appendPath(corrPath, "end_regex")...)
+	v.checkLabelValueRef(&corr.EndRegex, corr.EndKey, appendPath(corrPath, "end_key")...)
+
+	ts := corr.EndTimestamp
+	switch {
+	case ts == nil && mp.Timestamp != nil:
+		v.report(errors.New("correlation rules with a timestamp must have an end_timestamp"), appendPath(corrPath, "end_timestamp")...)
+	case ts != nil && mp.Timestamp == nil:
+		v.report(errors.New("correlation rules with an end_timestamp must have a timestamp"), appendPath(path, "timestamp")...)
+	}
+	if ts != nil {
+		tsPath := appendPath(corrPath, "end_timestamp")
+		v.checkOverflow(ts.XXX, tsPath...)
+		v.checkLabelValueRef(&corr.EndRegex, ts.Value, appendPath(tsPath, "value")...)
+		if ts.Format == "" {
+			v.report(errors.New("timestamp format cannot be empty"), appendPath(tsPath, "format")...)
+		}
+	}
+}
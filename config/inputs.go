@@ -0,0 +1,255 @@
+// Input configuration
+
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+// Input kinds
+const (
+	InputKindFile     = "file"
+	InputKindExec     = "exec"
+	InputKindUnix     = "unix"
+	InputKindUnixgram = "unixgram"
+	InputKindGELF     = "gelf"
+	InputKindForward  = "forward"
+	InputKindBeats    = "beats"
+	InputKindStatsd   = "statsd"
+	InputKindGraphite = "graphite"
+)
+
+// AbstractSocketPrefix marks the path of a unix socket in the Linux abstract
+// socket namespace, which has no file.
+const AbstractSocketPrefix = "@"
+
+// Default restart backoff of exec inputs
+const (
+	DefaultExecMinBackoff = model.Duration(time.Second)
+	DefaultExecMaxBackoff = model.Duration(time.Minute)
+)
+
+// DefaultBuckets are the default histogram buckets, in seconds.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// DefaultForwardMessageKey is the record key forward inputs take lines from
+// by default, which is where fluent-bit's tail input puts them.
+const DefaultForwardMessageKey = "log"
+
+// Line formats, which determine how an input's lines are decoded before they
+// are handed to the rules.
+const (
+	// FormatRaw lines are handed to the rules as they are.
+	FormatRaw = "raw"
+	// FormatDocker lines are Docker json-file log entries.
+	FormatDocker = "docker"
+	// FormatCRI lines are Kubernetes CRI log entries.
+	FormatCRI = "cri"
+	// FormatContainer lines are either Docker or CRI log entries.
+	FormatContainer = "container"
+	// FormatJournal lines are systemd journal entries in the journal export
+	// format, as written by journalctl -o export.
+	FormatJournal = "journal"
+)
+
+// IsFormat reports whether format names a line format.
+func IsFormat(format string) bool {
+	switch format {
+	case FormatRaw, FormatDocker, FormatCRI, FormatContainer, FormatJournal:
+		return true
+	}
+	return false
+}
+
+// InputConfig configures a source of lines.
+type InputConfig struct {
+	Kind string `yaml:"kind"`
+	// Path is a glob of files to follow for file inputs, or the path of
+	// the socket of unix and unixgram inputs.
+	Path string `yaml:"path,omitempty"`
+	// Format is the format of the input's lines.
+	Format string `yaml:"format,omitempty"`
+	// Labels are static values every line of the input has as metadata,
+	// which rules can use like $__name.
+	Labels map[string]string `yaml:"labels,omitempty"`
+
+	// Name identifies an exec or socket input in metrics, and defaults to
+	// its command or path, or for network inputs its kind.
+	Name string `yaml:"name,omitempty"`
+	// Address is the TCP and UDP address network inputs listen on.
+	Address string `yaml:"address,omitempty"`
+	// MessageKey is the record key a forward input takes lines from. The
+	// record's other keys are metadata.
+	MessageKey string `yaml:"message_key,omitempty"`
+	// TLSCertFile and TLSKeyFile enable TLS on a beats input. With
+	// TLSClientCAFile clients must present a certificate it signed.
+	TLSCertFile     string `yaml:"tls_cert_file,omitempty"`
+	TLSKeyFile      string `yaml:"tls_key_file,omitempty"`
+	TLSClientCAFile string `yaml:"tls_client_ca_file,omitempty"`
+
+	// Mappings map the metric names a statsd or graphite input receives to
+	// metric names and labels.
+	Mappings []*MetricMapping `yaml:"mappings,omitempty"`
+	// Buckets are the histogram buckets of statsd timers and histograms.
+	Buckets []float64 `yaml:"buckets,omitempty"`
+	// Timeout expires the series of a statsd or graphite input which
+	// haven't been updated for it, if it is set.
+	Timeout model.Duration `yaml:"timeout,omitempty"`
+	// Command is the command and arguments an exec input runs.
+	Command []string `yaml:"command,omitempty"`
+	// Stderr ingests the command's stderr as well as its stdout, rather
+	// than logging it.
+	Stderr bool `yaml:"stderr,omitempty"`
+	// MinBackoff and MaxBackoff bound the exponential backoff between
+	// restarts of a command which exits.
+	MinBackoff model.Duration `yaml:"min_backoff,omitempty"`
+	MaxBackoff model.Duration `yaml:"max_backoff,omitempty"`
+
+	// Mode is the octal permissions of a socket file, e.g. "0660".
+	Mode string `yaml:"mode,omitempty"`
+	// Owner and Group are the user and group, by name or id, a socket file
+	// is changed to.
+	Owner string `yaml:"owner,omitempty"`
+	Group string `yaml:"group,omitempty"`
+
+	// Catchall
+	XXX map[string]interface{} `yaml:",inline"`
+}
+
+func (this *InputConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain InputConfig
+	if err := unmarshal((*plain)(this)); err != nil {
+		return err
+	}
+
+	if this.Format == "" {
+		this.Format = FormatRaw
+	}
+	switch this.Kind {
+	case InputKindUnix, InputKindUnixgram:
+		if this.Name == "" {
+			this.Name = this.Path
+		}
+	case InputKindGELF, InputKindBeats, InputKindGraphite:
+		if this.Name == "" {
+			this.Name = this.Kind
+		}
+	case InputKindStatsd:
+		if this.Name == "" {
+			this.Name = this.Kind
+		}
+		if this.Buckets == nil {
+			this.Buckets = DefaultBuckets
+		}
+	case InputKindForward:
+		if this.Name == "" {
+			this.Name = this.Kind
+		}
+		if this.MessageKey == "" {
+			this.MessageKey = DefaultForwardMessageKey
+		}
+	case InputKindExec:
+		// There is nothing to run without a command.
+		if len(this.Command) == 0 || this.Command[0] == "" {
+			return errors.New("exec input command cannot be empty")
+		}
+		if this.Name == "" {
+			this.Name = this.Command[0]
+		}
+		if this.MinBackoff == 0 {
+			this.MinBackoff = DefaultExecMinBackoff
+		}
+		if this.MaxBackoff == 0 {
+			this.MaxBackoff = DefaultExecMaxBackoff
+		}
+	}
+	return nil
+}
+
+func (v *validator) validateInput(input *InputConfig, path ...interface{}) {
+	v.checkOverflow(input.XXX, path...)
+
+	switch input.Kind {
+	case InputKindFile:
+		if input.Path == "" {
+			v.report(errors.New("file input path cannot be empty"), appendPath(path, "path")...)
+		} else if _, err := filepath.Match(input.Path, ""); err != nil {
+			v.report(fmt.Errorf("invalid path glob: %v", err), appendPath(path, "path")...)
+		}
+	case InputKindUnix, InputKindUnixgram:
+		v.validateSocketInput(input, path...)
+	case InputKindGELF, InputKindForward, InputKindBeats:
+		v.validateAddress(input, path...)
+	case InputKindStatsd, InputKindGraphite:
+		v.validateAddress(input, path...)
+		v.checkBuckets(input.Buckets, appendPath(path, "buckets")...)
+		for idx, mapping := range input.Mappings {
+			v.validateMapping(mapping, appendPath(path, "mappings", idx)...)
+		}
+	case InputKindExec:
+		if len(input.Command) == 0 || input.Command[0] == "" {
+			v.report(errors.New("exec input command cannot be empty"), appendPath(path, "command")...)
+		}
+		if input.MinBackoff <= 0 || input.MaxBackoff < input.MinBackoff {
+			v.report(errors.New("backoff must be positive, with max_backoff at least min_backoff"), path...)
+		}
+	case "":
+		v.report(errors.New("input kind cannot be empty"), path...)
+	default:
+		v.report(fmt.Errorf("unknown input kind %q", input.Kind), appendPath(path, "kind")...)
+	}
+
+	for name := range input.Labels {
+		if name == "" {
+			v.report(errors.New("label name cannot be empty"), appendPath(path, "labels")...)
+		}
+	}
+
+	if !IsFormat(input.Format) {
+		v.report(fmt.Errorf("unknown input format %q", input.Format), appendPath(path, "format")...)
+	}
+}
+
+func (v *validator) validateAddress(input *InputConfig, path ...interface{}) {
+	if input.Address == "" {
+		v.report(errors.New("address cannot be empty"), appendPath(path, "address")...)
+	} else if _, _, err := net.SplitHostPort(input.Address); err != nil {
+		v.report(fmt.Errorf("invalid address: %v", err), appendPath(path, "address")...)
+	}
+}
+
+func (v *validator) validateSocketInput(input *InputConfig, path ...interface{}) {
+	if input.Path == "" || input.Path == AbstractSocketPrefix {
+		v.report(errors.New("socket path cannot be empty"), appendPath(path, "path")...)
+		return
+	}
+	if strings.HasPrefix(input.Path, AbstractSocketPrefix) {
+		if input.Mode != "" || input.Owner != "" || input.Group != "" {
+			v.report(errors.New("abstract sockets have no mode, owner or group"), path...)
+		}
+		return
+	}
+	if input.Mode != "" {
+		if _, err := ParseFileMode(input.Mode); err != nil {
+			v.report(err, appendPath(path, "mode")...)
+		}
+	}
+}
+
+// ParseFileMode parses octal file permissions.
+func ParseFileMode(s string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || mode&^uint64(os.ModePerm) != 0 {
+		return 0, fmt.Errorf("invalid file mode %q", s)
+	}
+	return os.FileMode(mode), nil
+}
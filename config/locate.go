@@ -0,0 +1,115 @@
+// Maps config paths back to lines in the original YAML document
+
+package config
+
+import (
+	"strings"
+)
+
+// sourceLine is a significant (non-blank, non-comment) line of a YAML document.
+type sourceLine struct {
+	num    int
+	indent int
+	text   string
+}
+
+func isYAMLKey(text string, key string) bool {
+	for _, k := range []string{key, "'" + key + "'", "\"" + key + "\""} {
+		if strings.HasPrefix(text, k+":") && (len(text) == len(k)+1 || text[len(k)+1] == ' ') {
+			return true
+		}
+	}
+	return false
+}
+
+func isYAMLSeqItem(text string) bool {
+	return text == "-" || strings.HasPrefix(text, "- ")
+}
+
+// yamlLine makes a best-effort attempt to find the 1-based line of the node at
+// path in the block-style YAML document src. Path elements are either string
+// mapping keys or int sequence indexes. 0 is returned if the node can't be
+// found, e.g. because it is written in flow style.
+func yamlLine(src string, path ...interface{}) int {
+	var block []sourceLine
+	for idx, l := range strings.Split(src, "\n") {
+		text := strings.TrimLeft(l, " ")
+		if text == "" || text[0] == '#' || text == "---" {
+			continue
+		}
+		block = append(block, sourceLine{
+			num:    idx + 1,
+			indent: len(l) - len(text),
+			text:   strings.TrimRight(text, " \t\r"),
+		})
+	}
+
+	line := 0
+	for _, elem := range path {
+		if len(block) == 0 {
+			return 0
+		}
+		indent := block[0].indent
+
+		switch p := elem.(type) {
+		case string:
+			found := -1
+			for idx, l := range block {
+				if l.indent == indent && isYAMLKey(l.text, p) {
+					found = idx
+					break
+				}
+			}
+			if found < 0 {
+				return 0
+			}
+			line = block[found].num
+
+			// Children are more indented, or are sequence items at the
+			// same indentation as the key.
+			end := found + 1
+			for end < len(block) && (block[end].indent > indent ||
+				(block[end].indent == indent && isYAMLSeqItem(block[end].text))) {
+				end++
+			}
+			block = block[found+1 : end]
+		case int:
+			found, n := -1, -1
+			for idx, l := range block {
+				if l.indent == indent && isYAMLSeqItem(l.text) {
+					n++
+					if n == p {
+						found = idx
+						break
+					}
+				}
+			}
+			if found < 0 {
+				return 0
+			}
+			line = block[found].num
+
+			end := found + 1
+			for end < len(block) && block[end].indent > indent {
+				end++
+			}
+
+			// Content following the "- " on the item line is the first
+			// line of the item's block.
+			first := block[found]
+			rest := strings.TrimLeft(first.text[1:], " ")
+			child := make([]sourceLine, 0, end-found)
+			if rest != "" {
+				child = append(child, sourceLine{
+					num:    first.num,
+					indent: first.indent + len(first.text) - len(rest),
+					text:   rest,
+				})
+			}
+			block = append(child, block[found+1:end]...)
+		default:
+			return 0
+		}
+	}
+	return line
+}
@@ -0,0 +1,72 @@
+package config
+
+import (
+	"testing"
+)
+
+const locateDoc = `# leading comment
+global:
+  labels:
+    zone: z1
+
+metric_configs:
+- name: first
+  help: first metric
+  labels:
+  - name: a
+    value: $1
+  -   name: b
+      # comment inside an item
+      value: $2
+- "name": second
+  'help': second metric
+  buckets: [1, 2, 3]
+  correlation: {start: begin, end: finish}
+  identity:
+    - host
+    - port
+---
+inputs:
+-
+  kind: file
+  path: /var/log/app.log
+`
+
+func TestYAMLLine(t *testing.T) {
+	cases := []struct {
+		path []interface{}
+		line int
+	}{
+		{[]interface{}{"global"}, 2},
+		{[]interface{}{"global", "labels", "zone"}, 4},
+		{[]interface{}{"metric_configs"}, 6},
+		{[]interface{}{"metric_configs", 0}, 7},
+		{[]interface{}{"metric_configs", 0, "name"}, 7},
+		{[]interface{}{"metric_configs", 0, "help"}, 8},
+		{[]interface{}{"metric_configs", 0, "labels", 1}, 12},
+		{[]interface{}{"metric_configs", 0, "labels", 1, "name"}, 12},
+		{[]interface{}{"metric_configs", 0, "labels", 1, "value"}, 14},
+		// Quoted keys.
+		{[]interface{}{"metric_configs", 1, "name"}, 15},
+		{[]interface{}{"metric_configs", 1, "help"}, 16},
+		// Sequences more indented than their key.
+		{[]interface{}{"metric_configs", 1, "identity", 1}, 21},
+		// A flow style node is found, but not its children.
+		{[]interface{}{"metric_configs", 1, "buckets"}, 17},
+		{[]interface{}{"metric_configs", 1, "buckets", 0}, 0},
+		{[]interface{}{"metric_configs", 1, "correlation", "start"}, 0},
+		// An item whose content starts on the next line.
+		{[]interface{}{"inputs", 0, "path"}, 26},
+		// Missing nodes.
+		{[]interface{}{"metric_configs", 2}, 0},
+		{[]interface{}{"metric_configs", 0, "type"}, 0},
+		{[]interface{}{"global", "zone"}, 0},
+		{[]interface{}{"metric_configs", 0.5}, 0},
+		{nil, 0},
+	}
+	for _, tc := range cases {
+		if line := yamlLine(locateDoc, tc.path...); line != tc.line {
+			t.Errorf("%v: expected line %d, got %d", tc.path, tc.line, line)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+// Metric name mapping configuration
+
+package config
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/common/model"
+)
+
+// Mapping match types
+const (
+	// MatchTypeGlob matches dotted names component by component, with *
+	// matching a whole component.
+	MatchTypeGlob = "glob"
+	// MatchTypeRegex matches names with a regular expression.
+	MatchTypeRegex = "regex"
+)
+
+// MetricMapping maps the dotted metric names received by statsd and graphite
+// inputs to a metric name and labels. The first mapping which matches a name
+// is used, and names no mapping matches are used as they are, with characters
+// which aren't valid in metric names replaced by underscores.
+type MetricMapping struct {
+	// Match is a glob of dotted name components, or a regular expression if
+	// MatchType is regex.
+	Match     string `yaml:"match"`
+	MatchType string `yaml:"match_type,omitempty"`
+	// Name is the metric name, in which $n or ${n} is replaced by the nth
+	// wildcard or capture group of the match.
+	Name string `yaml:"name,omitempty"`
+	Help string `yaml:"help,omitempty"`
+	// Labels are added to the metric. Their names and values can reference
+	// wildcards and capture groups as $n, and metadata as $__name.
+	Labels []LabelDef `yaml:"labels,omitempty"`
+	// Drop discards metrics the mapping matches.
+	Drop bool `yaml:"drop,omitempty"`
+
+	// Regex is Match compiled.
+	Regex *Regexp `yaml:"-"`
+
+	// Catchall
+	XXX map[string]interface{} `yaml:",inline"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (this *MetricMapping) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain MetricMapping
+	if err := unmarshal((*plain)(this)); err != nil {
+		return err
+	}
+
+	if this.MatchType == "" {
+		this.MatchType = MatchTypeGlob
+	}
+	if this.Name == "" && !this.Drop {
+		return fmt.Errorf("mapping of %q has no metric name", this.Match)
+	}
+
+	var expr string
+	switch this.MatchType {
+	case MatchTypeGlob:
+		expr = globRegex(this.Match)
+	case MatchTypeRegex:
+		expr = this.Match
+	default:
+		return fmt.Errorf("unknown mapping match type %q", this.MatchType)
+	}
+	re, err := NewRegexp(flaggedRegex{Regex: expr})
+	if err != nil {
+		return err
+	}
+	this.Regex = re
+	return nil
+}
+
+// globRegex converts a glob of dotted name components to an anchored regular
+// expression, capturing each wildcard.
+func globRegex(glob string) string {
+	parts := strings.Split(glob, "*")
+	for idx, part := range parts {
+		parts[idx] = regexp.QuoteMeta(part)
+	}
+	return "^" + strings.Join(parts, "([^.]*)") + "$"
+}
+
+func (v *validator) validateMapping(mapping *MetricMapping, path ...interface{}) {
+	v.checkOverflow(mapping.XXX, path...)
+
+	if mapping.Match == "" {
+		v.report(errors.New("mapping match cannot be empty"), appendPath(path, "match")...)
+	}
+	if mapping.Regex == nil {
+		return
+	}
+
+	for _, group := range templateGroups(mapping.Name) {
+		v.checkGroupRef(mapping.Regex, group, "", appendPath(path, "name")...)
+	}
+	// Capture groups are checked when the name is expanded.
+	name := mapping.ExpandName(func(int) string { return "_" })
+	if mapping.Name != "" && !model.IsValidMetricName(model.LabelValue(name)) {
+		v.report(fmt.Errorf("invalid metric name %q", mapping.Name), appendPath(path, "name")...)
+	}
+
+	seen := make(map[string]bool, len(mapping.Labels))
+	for idx, label := range mapping.Labels {
+		labelPath := appendPath(path, "labels", idx)
+		v.checkOverflow(label.XXX, labelPath...)
+
+		if label.Name.FieldType == LabelValueLiteral {
+			name := label.Name.Literal
+			switch {
+			case !model.LabelName(name).IsValid():
+				v.report(fmt.Errorf("invalid label name %q", name), appendPath(labelPath, "name")...)
+			case seen[name]:
+				v.report(fmt.Errorf("duplicate label name %q", name), appendPath(labelPath, "name")...)
+			}
+			seen[name] = true
+		}
+
+		v.checkLabelValueRef(mapping.Regex, label.Name, appendPath(labelPath, "name")...)
+		v.checkLabelValueRef(mapping.Regex, label.Value, appendPath(labelPath, "value")...)
+	}
+}
+
+// templateGroupRegex finds the $n and ${n} references of a name template.
+var templateGroupRegex = regexp.MustCompile(`\$(\d+)|\$\{(\d+)\}`)
+
+// templateGroup returns the capture group a name template reference is to.
+func templateGroup(ref []string) int {
+	group, _ := strconv.Atoi(ref[1] + ref[2])
+	return group
+}
+
+// templateGroups returns the capture groups a name template references.
+func templateGroups(template string) []int {
+	var groups []int
+	for _, ref := range templateGroupRegex.FindAllStringSubmatch(template, -1) {
+		groups = append(groups, templateGroup(ref))
+	}
+	return groups
+}
+
+// ExpandName returns the metric name of a matched name, replacing the
+// capture group references of Name with group(n).
+func (this *MetricMapping) ExpandName(group func(n int) string) string {
+	return templateGroupRegex.ReplaceAllStringFunc(this.Name, func(ref string) string {
+		return group(templateGroup(templateGroupRegex.FindStringSubmatch(ref)))
+	})
+}
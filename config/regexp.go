@@ -5,15 +5,17 @@ package config
 import (
 	"fmt"
 	"github.com/glenn-brown/golang-pkg-pcre/src/pkg/pcre"
-	"gopkg.in/yaml.v2"
 	"strings"
 )
 
 // flaggedRegex fields which fail to parse are parsed again against this to
 // allow using the full PCRE library.
 type flaggedRegex struct {
-	regex string `yaml:"expr"`
-	flags string `yaml:"flags,omitempty"`
+	Regex string `yaml:"expr"`
+	Flags string `yaml:"flags,omitempty"`
+
+	// Catchall
+	XXX map[string]interface{} `yaml:",inline"`
 }
 
 // Regexp encapsulates a regexp.Regexp and makes it YAML marshallable.
@@ -106,12 +108,12 @@ func parseFlags(f string) (int, error) {
 // NewRegexp creates a new anchored Regexp and returns an error if the
 // passed-in regular expression does not compile.
 func NewRegexp(s flaggedRegex) (*Regexp, error) {
-	flags, err := parseFlags(s.flags)
+	flags, err := parseFlags(s.Flags)
 	if err != nil {
 		return nil, err
 	}
 
-	regex, cerr := pcre.Compile(s.regex, flags)
+	regex, cerr := pcre.Compile(s.Regex, flags)
 	if cerr != nil {
 		return nil, RegexpCompileError{cerr}
 	}
@@ -141,7 +143,7 @@ func (re *Regexp) UnmarshalYAML(unmarshal func(interface{}) error) error {
 			// Fail
 			return err
 		}
-		fr.regex = s
+		fr.Regex = s
 	}
 
 	r, err := NewRegexp(fr)
@@ -154,10 +156,59 @@ func (re *Regexp) UnmarshalYAML(unmarshal func(interface{}) error) error {
 
 // MarshalYAML implements the yaml.Marshaler interface.
 func (re *Regexp) MarshalYAML() (interface{}, error) {
-	if re.original.flags != "" {
-		return yaml.Marshal(&re.original)
-	} else if re != nil {
-		return re.original, nil
+	if re == nil {
+		return nil, nil
+	} else if re.original.Flags != "" {
+		return &re.original, nil
+	}
+	return re.original.Regex, nil
+}
+
+// String returns the original expression the Regexp was compiled from.
+func (re *Regexp) String() string {
+	return re.original.Regex
+}
+
+// GroupNames returns the set of named capture groups in the expression.
+// The pcre bindings don't expose the compiled name table, so the pattern
+// is scanned for (?<name>, (?'name' and (?P<name> openings instead.
+func (re *Regexp) GroupNames() map[string]struct{} {
+	names := make(map[string]struct{})
+	pattern := re.original.Regex
+	inClass := false
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; {
+		case c == '\\':
+			i++
+		case inClass:
+			if c == ']' {
+				inClass = false
+			}
+		case c == '[':
+			inClass = true
+			// A ] immediately after the opening bracket is a literal
+			if i+1 < len(pattern) && pattern[i+1] == ']' {
+				i++
+			} else if i+2 < len(pattern) && pattern[i+1] == '^' && pattern[i+2] == ']' {
+				i += 2
+			}
+		case c == '(' && strings.HasPrefix(pattern[i+1:], "?"):
+			rest := pattern[i+2:]
+			var terminator byte
+			switch {
+			case strings.HasPrefix(rest, "P<"):
+				rest, terminator = rest[2:], '>'
+			case strings.HasPrefix(rest, "<") && !strings.HasPrefix(rest, "<=") && !strings.HasPrefix(rest, "<!"):
+				rest, terminator = rest[1:], '>'
+			case strings.HasPrefix(rest, "'"):
+				rest, terminator = rest[1:], '\''
+			default:
+				continue
+			}
+			if end := strings.IndexByte(rest, terminator); end > 0 {
+				names[rest[:end]] = struct{}{}
+			}
+		}
 	}
-	return nil, nil
+	return names
 }
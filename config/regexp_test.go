@@ -0,0 +1,45 @@
+package config
+
+import (
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestGroupNames(t *testing.T) {
+	cases := []struct {
+		regex    string
+		dupNames bool
+		names    []string
+	}{
+		{`(?<first>\S+) (?P<second>\d+) (?'third'.*)`, false, []string{"first", "second", "third"}},
+		{`(\S+) (?:\d+)`, false, nil},
+		// Lookbehinds and other groups aren't named.
+		{`(?<=a)(?<!b)(?=c)(?!d)(?i)x`, false, nil},
+		// Escaped parentheses don't open groups.
+		{`\(?<x>\) \\(?<y>z)`, false, []string{"y"}},
+		// Nor do parentheses in character classes.
+		{`[(?<x>)] [^\]](?<y>a)`, false, []string{"y"}},
+		{`[](?<x>)] [^](?<y>)](?<z>a)`, false, []string{"z"}},
+		{`(?<a>x)|(?<a>y)`, true, []string{"a"}},
+	}
+	for _, tc := range cases {
+		flags := ""
+		if tc.dupNames {
+			flags = "dupnames"
+		}
+		re, err := NewRegexp(flaggedRegex{Regex: tc.regex, Flags: flags})
+		if err != nil {
+			t.Errorf("%s: %v", tc.regex, err)
+			continue
+		}
+		var names []string
+		for name := range re.GroupNames() {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		if strings.Join(names, ",") != strings.Join(tc.names, ",") {
+			t.Errorf("%s: expected groups %v, got %v", tc.regex, tc.names, names)
+		}
+	}
+}
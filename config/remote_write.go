@@ -0,0 +1,94 @@
+// Remote write output configuration
+
+package config
+
+import (
+	"errors"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+// DefaultRemoteWriteConfig is the default configuration of a remote_write
+// endpoint.
+var DefaultRemoteWriteConfig = RemoteWriteConfig{
+	Interval: model.Duration(15 * time.Second),
+	Timeout:  model.Duration(10 * time.Second),
+	Queue:    DefaultQueueConfig,
+}
+
+// DefaultQueueConfig is the default configuration of a remote_write queue.
+var DefaultQueueConfig = QueueConfig{
+	Capacity:   100,
+	MinBackoff: model.Duration(100 * time.Millisecond),
+	MaxBackoff: model.Duration(30 * time.Second),
+}
+
+// RemoteWriteConfig configures periodically pushing every stored series to a
+// Prometheus remote write endpoint.
+type RemoteWriteConfig struct {
+	URL string `yaml:"url"`
+	// Interval is how often all series are sent.
+	Interval model.Duration `yaml:"interval,omitempty"`
+	// Timeout is the timeout of each HTTP request.
+	Timeout model.Duration `yaml:"timeout,omitempty"`
+
+	BasicAuth       *BasicAuth `yaml:"basic_auth,omitempty"`
+	BearerToken     string     `yaml:"bearer_token,omitempty"`
+	BearerTokenFile string     `yaml:"bearer_token_file,omitempty"`
+
+	// ExternalLabels are added to every series sent, unless the series
+	// already has a label of the same name.
+	ExternalLabels map[string]string `yaml:"external_labels,omitempty"`
+
+	Queue QueueConfig `yaml:"queue,omitempty"`
+
+	// Catchall
+	XXX map[string]interface{} `yaml:",inline"`
+}
+
+func (this *RemoteWriteConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	*this = DefaultRemoteWriteConfig
+	type plain RemoteWriteConfig
+	if err := unmarshal((*plain)(this)); err != nil {
+		return err
+	}
+
+	if this.URL == "" {
+		return errors.New("remote_write url cannot be empty")
+	}
+	return nil
+}
+
+// BasicAuth configures HTTP basic authentication.
+type BasicAuth struct {
+	Username     string `yaml:"username"`
+	Password     string `yaml:"password,omitempty"`
+	PasswordFile string `yaml:"password_file,omitempty"`
+
+	// Catchall
+	XXX map[string]interface{} `yaml:",inline"`
+}
+
+// QueueConfig configures the queue of write requests waiting to be sent.
+type QueueConfig struct {
+	// Capacity is the number of write requests held. When the queue is
+	// full the oldest request is dropped.
+	Capacity int `yaml:"capacity,omitempty"`
+	// Directory, if set, persists queued requests to disk so they survive a
+	// restart.
+	Directory string `yaml:"directory,omitempty"`
+	// MinBackoff and MaxBackoff bound the exponential backoff between
+	// retries of a failed request.
+	MinBackoff model.Duration `yaml:"min_backoff,omitempty"`
+	MaxBackoff model.Duration `yaml:"max_backoff,omitempty"`
+
+	// Catchall
+	XXX map[string]interface{} `yaml:",inline"`
+}
+
+func (this *QueueConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	*this = DefaultQueueConfig
+	type plain QueueConfig
+	return unmarshal((*plain)(this))
+}
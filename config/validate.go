@@ -0,0 +1,430 @@
+// Strict validation of loaded configs
+
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/common/model"
+)
+
+// ValidationError is a single problem found by strict validation of a config,
+// located by its line in the original YAML document where possible.
+type ValidationError struct {
+	Line int
+	Path string
+	Err  error
+}
+
+func (this ValidationError) Error() string {
+	if this.Line > 0 {
+		return fmt.Sprintf("line %d: %s: %v", this.Line, this.Path, this.Err)
+	}
+	return fmt.Sprintf("%s: %v", this.Path, this.Err)
+}
+
+// ValidationErrors is every problem found by strict validation of a config.
+type ValidationErrors []ValidationError
+
+func (this ValidationErrors) Error() string {
+	msgs := make([]string, 0, len(this))
+	for _, err := range this {
+		msgs = append(msgs, err.Error())
+	}
+	return strings.Join(msgs, "\n")
+}
+
+func (this ValidationErrors) Len() int           { return len(this) }
+func (this ValidationErrors) Less(i, j int) bool { return this[i].Line < this[j].Line }
+func (this ValidationErrors) Swap(i, j int)      { this[i], this[j] = this[j], this[i] }
+
+// validator accumulates errors while walking a loaded config.
+type validator struct {
+	src  string
+	errs ValidationErrors
+}
+
+// formatPath renders a config path as e.g. metric_configs[0].labels[1].name
+func formatPath(path []interface{}) string {
+	var b bytes.Buffer
+	for _, elem := range path {
+		switch p := elem.(type) {
+		case int:
+			fmt.Fprintf(&b, "[%d]", p)
+		default:
+			if b.Len() > 0 {
+				b.WriteByte('.')
+			}
+			fmt.Fprintf(&b, "%v", p)
+		}
+	}
+	return b.String()
+}
+
+// report records err against path. If the path itself can't be found in the
+// source (e.g. a missing key) the line of its nearest parent is used.
+func (v *validator) report(err error, path ...interface{}) {
+	line := 0
+	for n := len(path); n > 0 && line == 0; n-- {
+		line = yamlLine(v.src, path[:n]...)
+	}
+	v.errs = append(v.errs, ValidationError{
+		Line: line,
+		Path: formatPath(path),
+		Err:  err,
+	})
+}
+
+func appendPath(path []interface{}, elems ...interface{}) []interface{} {
+	r := make([]interface{}, 0, len(path)+len(elems))
+	r = append(r, path...)
+	return append(r, elems...)
+}
+
+// checkOverflow reports keys which were swallowed by a catchall map.
+func (v *validator) checkOverflow(m map[string]interface{}, path ...interface{}) {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		v.report(fmt.Errorf("unknown field %q", k), appendPath(path, k)...)
+	}
+}
+
+// checkGroupRef reports references to capture groups which the regex does
+// not define. name is used if non-empty, otherwise group.
+func (v *validator) checkGroupRef(re *Regexp, group int, name string, path ...interface{}) {
+	if name != "" {
+		if _, found := re.GroupNames()[name]; !found {
+			v.report(fmt.Errorf("regex has no capture group named %q", name), path...)
+		}
+		return
+	}
+	if groups := re.Groups(); group < 0 || group > groups {
+		v.report(fmt.Errorf("regex has %d capture groups but group %d is referenced", groups, group), path...)
+	}
+}
+
+func (v *validator) checkLabelValueRef(re *Regexp, def LabelValueDef, path ...interface{}) {
+	switch def.FieldType {
+	case LabelValueCaptureGroup:
+		v.checkGroupRef(re, def.CaptureGroup, "", path...)
+	case LabelValueCaptureGroupNamed:
+		if def.CaptureGroupName == "" {
+			v.report(errors.New("capture group reference is missing a group"), path...)
+			return
+		}
+		v.checkGroupRef(re, 0, def.CaptureGroupName, path...)
+	case LabelValueMetadata:
+		// Metadata depends on the input a line came from, so can only be
+		// checked to be named.
+		if def.MetadataName == "" {
+			v.report(errors.New("metadata reference is missing a name"), path...)
+		}
+	}
+}
+
+func (v *validator) validateMetricParser(mp *MetricParser, path ...interface{}) {
+	v.checkOverflow(mp.XXX, path...)
+
+	if mp.Name == "" {
+		v.report(errors.New("metric name cannot be empty"), path...)
+	} else if !model.IsValidMetricName(model.LabelValue(mp.Name)) {
+		v.report(fmt.Errorf("invalid metric name %q", mp.Name), appendPath(path, "name")...)
+	}
+
+	if _, err := parseMetricType(mp.typeName); err != nil {
+		v.report(err, appendPath(path, "type")...)
+	}
+
+	regexPath := appendPath(path, "regex")
+	if mp.Regex.String() == "" {
+		// Nothing below can be checked without a compiled regex.
+		v.report(errors.New("regex cannot be empty"), regexPath...)
+		return
+	}
+	v.checkOverflow(mp.Regex.original.XXX, regexPath...)
+
+	seen := make(map[string]bool, len(mp.Labels))
+	for idx, label := range mp.Labels {
+		labelPath := appendPath(path, "labels", idx)
+		v.checkOverflow(label.XXX, labelPath...)
+
+		if label.Name.FieldType == LabelValueLiteral {
+			name := label.Name.Literal
+			switch {
+			case !model.LabelName(name).IsValid():
+				v.report(fmt.Errorf("invalid label name %q", name), appendPath(labelPath, "name")...)
+			case strings.HasPrefix(name, model.ReservedLabelPrefix):
+				v.report(fmt.Errorf("label name %q is reserved", name), appendPath(labelPath, "name")...)
+			case seen[name]:
+				v.report(fmt.Errorf("duplicate label name %q", name), appendPath(labelPath, "name")...)
+			}
+			seen[name] = true
+		}
+
+		v.checkLabelValueRef(&mp.Regex, label.Name, appendPath(labelPath, "name")...)
+		v.checkLabelValueRef(&mp.Regex, label.Value, appendPath(labelPath, "value")...)
+	}
+
+	if len(mp.Exemplar) > 0 && mp.Type != MetricCounter && mp.Type != MetricHistogram {
+		v.report(fmt.Errorf("exemplars are only exposed for counters and histograms, not %s", mp.Type), appendPath(path, "exemplar")...)
+	}
+	seen = make(map[string]bool, len(mp.Exemplar))
+	for idx, label := range mp.Exemplar {
+		labelPath := appendPath(path, "exemplar", idx)
+		v.checkOverflow(label.XXX, labelPath...)
+
+		if label.Name.FieldType == LabelValueLiteral {
+			name := label.Name.Literal
+			switch {
+			case !model.LabelName(name).IsValid():
+				v.report(fmt.Errorf("invalid exemplar label name %q", name), appendPath(labelPath, "name")...)
+			case seen[name]:
+				v.report(fmt.Errorf("duplicate exemplar label name %q", name), appendPath(labelPath, "name")...)
+			}
+			seen[name] = true
+		}
+
+		v.checkLabelValueRef(&mp.Regex, label.Name, appendPath(labelPath, "name")...)
+		v.checkLabelValueRef(&mp.Regex, label.Value, appendPath(labelPath, "value")...)
+	}
+
+	if ts := mp.Timestamp; ts != nil {
+		tsPath := appendPath(path, "timestamp")
+		v.checkOverflow(ts.XXX, tsPath...)
+		v.checkLabelValueRef(&mp.Regex, ts.Value, appendPath(tsPath, "value")...)
+		if ts.Format == "" {
+			v.report(errors.New("timestamp format cannot be empty"), appendPath(tsPath, "format")...)
+		}
+	}
+
+	switch mp.Value.ValueSource {
+	case ValueSourceCaptureGroup:
+		v.checkGroupRef(&mp.Regex, mp.Value.CaptureGroup, "", appendPath(path, "value")...)
+	case ValueSourceNamedCaptureGroup:
+		v.checkGroupRef(&mp.Regex, 0, mp.Value.CaptureGroupName, appendPath(path, "value")...)
+	}
+
+	v.validateCorrelation(mp, path...)
+	if mp.Buckets != nil && mp.Type != MetricHistogram {
+		v.report(fmt.Errorf("buckets are only used by histograms, not %s", mp.Type), appendPath(path, "buckets")...)
+	}
+	v.checkBuckets(mp.Buckets, appendPath(path, "buckets")...)
+
+	if mp.Window != 0 && mp.Type != MetricRate {
+		v.report(fmt.Errorf("window is only used by rates, not %s", mp.Type), appendPath(path, "window")...)
+	}
+	if mp.Value.ValueSource == ValueSourceTimestamp && mp.Timestamp == nil {
+		v.report(errors.New("timestamp values need the rule to have a timestamp"), appendPath(path, "value")...)
+	}
+
+	if mp.Type == MetricInfo && mp.hasValue {
+		v.report(errors.New("info metrics are always 1, and take no value"), appendPath(path, "value")...)
+	}
+	if len(mp.Identity) > 0 && mp.Type != MetricInfo {
+		v.report(fmt.Errorf("identity is only used by info metrics, not %s", mp.Type), appendPath(path, "identity")...)
+	} else if names, dynamic := labelSignature(mp); !dynamic {
+		for idx, name := range mp.Identity {
+			if pos := sort.SearchStrings(names, name); pos == len(names) || names[pos] != name {
+				v.report(fmt.Errorf("identity label %q isn't a label of the metric", name), appendPath(path, "identity", idx)...)
+			}
+		}
+	}
+}
+
+// checkBuckets reports histogram buckets which aren't in increasing order.
+func (v *validator) checkBuckets(buckets []float64, path ...interface{}) {
+	for idx := 1; idx < len(buckets); idx++ {
+		if buckets[idx] <= buckets[idx-1] {
+			v.report(errors.New("buckets must be in increasing order"), path...)
+			return
+		}
+	}
+}
+
+func (v *validator) validateRemoteWrite(rw *RemoteWriteConfig, path ...interface{}) {
+	v.checkOverflow(rw.XXX, path...)
+
+	if u, err := url.Parse(rw.URL); err != nil {
+		v.report(err, appendPath(path, "url")...)
+	} else if u.Scheme != "http" && u.Scheme != "https" {
+		v.report(fmt.Errorf("unsupported url scheme %q", u.Scheme), appendPath(path, "url")...)
+	}
+	if rw.Interval <= 0 {
+		v.report(errors.New("interval must be positive"), appendPath(path, "interval")...)
+	}
+	if rw.Timeout <= 0 {
+		v.report(errors.New("timeout must be positive"), appendPath(path, "timeout")...)
+	}
+
+	if rw.BasicAuth != nil {
+		authPath := appendPath(path, "basic_auth")
+		v.checkOverflow(rw.BasicAuth.XXX, authPath...)
+		if rw.BasicAuth.Password != "" && rw.BasicAuth.PasswordFile != "" {
+			v.report(errors.New("at most one of password and password_file can be set"), authPath...)
+		}
+		if rw.BearerToken != "" || rw.BearerTokenFile != "" {
+			v.report(errors.New("at most one of basic_auth and bearer_token can be set"), authPath...)
+		}
+	}
+	if rw.BearerToken != "" && rw.BearerTokenFile != "" {
+		v.report(errors.New("at most one of bearer_token and bearer_token_file can be set"), path...)
+	}
+
+	names := make([]string, 0, len(rw.ExternalLabels))
+	for name := range rw.ExternalLabels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !model.LabelName(name).IsValid() || strings.HasPrefix(name, model.ReservedLabelPrefix) {
+			v.report(fmt.Errorf("invalid external label name %q", name), appendPath(path, "external_labels", name)...)
+		}
+	}
+
+	queuePath := appendPath(path, "queue")
+	v.checkOverflow(rw.Queue.XXX, queuePath...)
+	if rw.Queue.Capacity <= 0 {
+		v.report(errors.New("capacity must be positive"), appendPath(queuePath, "capacity")...)
+	}
+	if rw.Queue.MinBackoff <= 0 || rw.Queue.MaxBackoff < rw.Queue.MinBackoff {
+		v.report(errors.New("backoff must be positive, with max_backoff at least min_backoff"), queuePath...)
+	}
+}
+
+// labelSignature returns the sorted literal label names a MetricParser
+// produces, and whether any label names come from capture groups.
+func labelSignature(mp *MetricParser) (names []string, dynamic bool) {
+	for _, label := range mp.Labels {
+		if label.Name.FieldType != LabelValueLiteral {
+			dynamic = true
+			continue
+		}
+		names = append(names, label.Name.Literal)
+	}
+	sort.Strings(names)
+	return names, dynamic
+}
+
+// checkRules reports the problems which stop rules being loaded at all, even
+// without strict validation: rules which can't be stored, and rules which are
+// inconsistent with others sharing their metric name.
+func (v *validator) checkRules(mps []MetricParser) {
+	for idx := range mps {
+		mp := &mps[idx]
+		path := []interface{}{"metric_configs", idx}
+
+		if mp.Help == "" {
+			v.report(&MetricParserErrorNoHelp{}, appendPath(path, "help")...)
+		}
+		// Histograms are only observed by correlating lines.
+		switch {
+		case mp.Type == MetricHistogram && mp.Correlation == nil:
+			v.report(errors.New("histogram rules must have a correlation"), appendPath(path, "type")...)
+		case mp.Type != MetricHistogram && mp.Correlation != nil:
+			v.report(fmt.Errorf("correlation rules must be histograms, not %s", mp.Type), appendPath(path, "correlation")...)
+		}
+		if mp.Type == MetricRate && mp.Value.ValueOp != ValueOpAdd {
+			v.report(errors.New("rate values must be added, with +"), appendPath(path, "value")...)
+		}
+	}
+	v.checkConsistency(mps)
+}
+
+// checkConsistency reports rules which share a metric name with an earlier
+// rule but disagree with it on type, help, buckets, window, identity or label
+// names.
+func (v *validator) checkConsistency(mps []MetricParser) {
+	first := make(map[string]int)
+	// firstStatic is the first rule for a name with only literal label names.
+	firstStatic := make(map[string]int)
+	for idx := range mps {
+		mp := &mps[idx]
+		if mp.Name == "" {
+			continue
+		}
+		names, dynamic := labelSignature(mp)
+		firstIdx, found := first[mp.Name]
+		if !found {
+			first[mp.Name] = idx
+			if !dynamic {
+				firstStatic[mp.Name] = idx
+			}
+			continue
+		}
+		prev := &mps[firstIdx]
+		path := []interface{}{"metric_configs", idx}
+
+		if mp.Type != prev.Type {
+			v.report(fmt.Errorf("metric %q has type %s but rule %d declares it as %s",
+				mp.Name, mp.Type, firstIdx, prev.Type), appendPath(path, "type")...)
+		}
+		if mp.Help != prev.Help {
+			v.report(fmt.Errorf("metric %q has help %q but rule %d declares it with %q",
+				mp.Name, mp.Help, firstIdx, prev.Help), appendPath(path, "help")...)
+		}
+		if fmt.Sprint(mp.Buckets) != fmt.Sprint(prev.Buckets) {
+			v.report(fmt.Errorf("metric %q has buckets %v but rule %d declares it with %v",
+				mp.Name, mp.Buckets, firstIdx, prev.Buckets), appendPath(path, "buckets")...)
+		}
+		if strings.Join(mp.Identity, ",") != strings.Join(prev.Identity, ",") {
+			v.report(fmt.Errorf("metric %q has identity %v but rule %d declares it with %v",
+				mp.Name, mp.Identity, firstIdx, prev.Identity), appendPath(path, "identity")...)
+		}
+		if mp.Window != prev.Window {
+			v.report(fmt.Errorf("metric %q has window %s but rule %d declares it with %s",
+				mp.Name, mp.Window, firstIdx, prev.Window), appendPath(path, "window")...)
+		}
+
+		// Names taken from capture groups are only known at runtime, so
+		// such rules can only be checked by label count.
+		staticIdx, hasStatic := firstStatic[mp.Name]
+		switch {
+		case len(mp.Labels) != len(prev.Labels):
+			v.report(fmt.Errorf("metric %q has %d labels but rule %d declares it with %d",
+				mp.Name, len(mp.Labels), firstIdx, len(prev.Labels)), appendPath(path, "labels")...)
+		case dynamic:
+		case !hasStatic:
+			firstStatic[mp.Name] = idx
+		default:
+			prevNames, _ := labelSignature(&mps[staticIdx])
+			if strings.Join(names, ",") != strings.Join(prevNames, ",") {
+				v.report(fmt.Errorf("metric %q has labels %v but rule %d declares it with %v",
+					mp.Name, names, staticIdx, prevNames), appendPath(path, "labels")...)
+			}
+		}
+	}
+}
+
+// Validate strictly checks a loaded config, returning ValidationErrors
+// describing every problem found or nil if there are none, including those
+// which stop Load.
+func (this *Config) Validate() error {
+	v := &validator{src: this.Original}
+
+	v.checkOverflow(this.XXX)
+	v.checkRules(this.MetricConfigs)
+	for idx := range this.MetricConfigs {
+		v.validateMetricParser(&this.MetricConfigs[idx], "metric_configs", idx)
+	}
+	for idx, rw := range this.RemoteWrite {
+		v.validateRemoteWrite(rw, "remote_write", idx)
+	}
+	for idx, input := range this.Inputs {
+		v.validateInput(input, "inputs", idx)
+	}
+
+	if len(v.errs) > 0 {
+		sort.Stable(v.errs)
+		return v.errs
+	}
+	return nil
+}
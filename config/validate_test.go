@@ -0,0 +1,55 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckConsistency(t *testing.T) {
+	const rules = `
+metric_configs:
+- name: requests
+  help: requests
+  regex: '^(\S+) (\S+)'
+  labels:
+  - name: method
+    value: $1
+  value: +1
+- name: requests
+  help: requests
+  regex: '^(\S+) (\S+)'
+%s
+`
+	cases := []struct {
+		name string
+		rule string
+		err  string
+	}{
+		{"consistent", "  labels:\n  - name: method\n    value: $2\n  value: +1", ""},
+		{"type", "  type: gauge\n  labels:\n  - name: method\n    value: $1\n  value: =1",
+			`metric "requests" has type gauge but rule 0 declares it as untyped`},
+		{"label names", "  labels:\n  - name: path\n    value: $2\n  value: +1",
+			`metric "requests" has labels [path] but rule 0 declares it with [method]`},
+		{"label count", "  value: +1",
+			`metric "requests" has 0 labels but rule 0 declares it with 1`},
+		// Names from capture groups are only known at runtime.
+		{"dynamic label names", "  labels:\n  - name: $1\n    value: $2\n  value: +1", ""},
+		{"dynamic label count", "  labels:\n  - name: $1\n    value: $2\n  - name: b\n    value: $2\n  value: +1",
+			`metric "requests" has 2 labels but rule 0 declares it with 1`},
+	}
+	for _, tc := range cases {
+		cfg, err := Load(strings.Replace(rules, "%s", tc.rule, 1))
+		if tc.err == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", tc.name, err)
+			} else if len(cfg.MetricFamilies) != 1 || len(cfg.MetricFamilies[0].Parsers) != 2 {
+				t.Errorf("%s: expected both rules in one family, got %v", tc.name, cfg.MetricFamilies)
+			}
+			continue
+		}
+		errs, ok := err.(ValidationErrors)
+		if !ok || len(errs) != 1 || errs[0].Err.Error() != tc.err {
+			t.Errorf("%s: expected %q, got %v", tc.name, tc.err, err)
+		}
+	}
+}
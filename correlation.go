@@ -0,0 +1,211 @@
+package main
+
+import (
+	"container/list"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+	"github.com/wrouesnel/tail_exporter/config"
+)
+
+// correlationExpiryInterval is how often correlation rules expire the events
+// they started which have outlived their TTL.
+const correlationExpiryInterval = time.Second
+
+// orphanReason enumerates why a started event can be dropped before its end
+// line is seen. It is used as a label value.
+type orphanReason int
+
+const (
+	orphanExpired orphanReason = iota
+	orphanEvicted
+	orphanReplaced
+	numOrphanReasons
+)
+
+var orphanReasonNames = [numOrphanReasons]string{
+	orphanExpired:  "expired",
+	orphanEvicted:  "evicted",
+	orphanReplaced: "replaced",
+}
+
+func (r orphanReason) String() string {
+	return orphanReasonNames[r]
+}
+
+// startedEvent is an event a correlation rule is waiting to see the end of.
+type startedEvent struct {
+	key string
+	// labels of the series the event's duration is observed in, from the
+	// line which started it.
+	labels prometheus.Labels
+	// started is when the event started, logged or processed.
+	started time.Time
+	// exemplar is built from the line which started the event, and is
+	// attached to the observation of its duration.
+	exemplar *exemplar
+	// expires is when the event is dropped if it hasn't ended.
+	expires time.Time
+}
+
+// correlation holds the events a correlation rule has started. It is only
+// used by the rule's line processor, so needs no locking.
+type correlation struct {
+	cfg *config.CorrelationDef
+	// pending are the started events by key. order holds the same events
+	// with the oldest first.
+	pending map[string]*list.Element
+	order   *list.List
+
+	orphanedStarts [numOrphanReasons]prometheus.Counter
+	unmatchedEnds  prometheus.Counter
+	pendingStarts  prometheus.Gauge
+}
+
+func (c *TailCollector) newCorrelation(cfg *config.CorrelationDef, labels prometheus.Labels) *correlation {
+	corr := &correlation{
+		cfg:           cfg,
+		pending:       make(map[string]*list.Element),
+		order:         list.New(),
+		unmatchedEnds: c.correlationUnmatchedEnds.With(labels),
+		pendingStarts: c.correlationPendingStarts.With(labels),
+	}
+	for reason := orphanReason(0); reason < numOrphanReasons; reason++ {
+		corr.orphanedStarts[reason] = c.correlationOrphanedStarts.WithLabelValues(labels["metric"], labels["rule"], reason.String())
+	}
+	return corr
+}
+
+// start records a started event, replacing any waiting event with the same
+// key. The oldest event is dropped if too many are waiting.
+func (corr *correlation) start(ev *startedEvent) {
+	if el, found := corr.pending[ev.key]; found {
+		corr.remove(el)
+		corr.orphanedStarts[orphanReplaced].Inc()
+	}
+	if corr.order.Len() > 0 && corr.order.Len() >= corr.cfg.MaxPending {
+		corr.remove(corr.order.Front())
+		corr.orphanedStarts[orphanEvicted].Inc()
+	}
+	corr.pending[ev.key] = corr.order.PushBack(ev)
+	corr.pendingStarts.Set(float64(corr.order.Len()))
+}
+
+// end removes and returns the started event with key, or nil if there is
+// none.
+func (corr *correlation) end(key string) *startedEvent {
+	el, found := corr.pending[key]
+	if !found {
+		corr.unmatchedEnds.Inc()
+		return nil
+	}
+	corr.remove(el)
+	corr.pendingStarts.Set(float64(corr.order.Len()))
+	return el.Value.(*startedEvent)
+}
+
+// expire drops the started events which have outlived their TTL at now.
+func (corr *correlation) expire(now time.Time) {
+	for el := corr.order.Front(); el != nil; el = corr.order.Front() {
+		if now.Before(el.Value.(*startedEvent).expires) {
+			break
+		}
+		corr.remove(el)
+		corr.orphanedStarts[orphanExpired].Inc()
+	}
+	corr.pendingStarts.Set(float64(corr.order.Len()))
+}
+
+func (corr *correlation) remove(el *list.Element) {
+	delete(corr.pending, el.Value.(*startedEvent).key)
+	corr.order.Remove(el)
+}
+
+// processCorrelation applies a correlation rule to a line, which either
+// starts an event or ends one. Lines matching both regexes start events.
+func (c *TailCollector) processCorrelation(l logLine, r *rule) {
+	cfg, corr := r.cfg, r.correlation
+	line, meta := l.text, l.meta
+
+	start := time.Now()
+	m := cfg.Regex.MatcherString(line, 0)
+	isStart := m.Matches()
+	if !isStart {
+		m = corr.cfg.EndRegex.MatcherString(line, 0)
+	}
+	r.regexDuration.Observe(time.Since(start).Seconds())
+	if !isStart && !m.Matches() {
+		return
+	}
+	r.matchedLines.Inc()
+
+	keyDef, tsDef := cfg.Correlation.Key, cfg.Timestamp
+	if !isStart {
+		keyDef, tsDef = cfg.Correlation.EndKey, cfg.Correlation.EndTimestamp
+	}
+	key, kerr := ParseLabelKey(keyDef, m, meta)
+	if kerr != nil {
+		log.With("line", line).Warnln("Dropping line due to unparseable correlation key:", kerr)
+		r.reject(rejectUnparseableLabels)
+		return
+	}
+	now := time.Now()
+	at := now
+	if tsDef != nil {
+		var terr error
+		if at, terr = ParseTimestampFromMatch(tsDef, m, meta); terr != nil {
+			log.With("line", line).Warnln("Dropping line due to unparseable timestamp:", terr)
+			r.reject(rejectUnparseableTimestamp)
+			return
+		}
+	}
+
+	if isStart {
+		labels, lerr := ParseLabelPairsFromMatch(cfg.Labels, m, meta)
+		if lerr != nil {
+			log.With("line", line).Warnln("Dropping line due to unparseable labels:", lerr)
+			r.reject(rejectUnparseableLabels)
+			return
+		}
+		corr.start(&startedEvent{
+			key:      key,
+			labels:   labels,
+			started:  at,
+			expires:  now.Add(time.Duration(corr.cfg.TTL)),
+			exemplar: r.exemplar(m, meta, 0),
+		})
+		return
+	}
+
+	ev := corr.end(key)
+	if ev == nil {
+		log.With("line", line).Debugln("Dropping end line with no started event:", key)
+		return
+	}
+	elapsed := at.Sub(ev.started)
+	if elapsed < 0 {
+		log.With("line", line).Warnln("Dropping end line logged before its event started:", key)
+		r.reject(rejectNegativeDuration)
+		return
+	}
+
+	metric, err := r.family.labelledSeries(ev.labels, time.Duration(cfg.Timeout))
+	if err != nil {
+		log.With("line", line).Warnln("Dropping line due to labels inconsistent with metric:", err)
+		r.reject(rejectInconsistentLabels)
+		return
+	}
+	if err := metric.Observe(elapsed.Seconds(), 1); err != nil {
+		log.With("line", line).Errorln("Dropping line due to series lookup error:", err)
+		r.reject(rejectInconsistentLabels)
+		return
+	}
+	if ex := ev.exemplar; ex != nil {
+		ex.value, ex.timestamp = elapsed.Seconds(), now
+		metric.SetExemplar(ex)
+	}
+	if tsDef != nil {
+		metric.SetLoggedAt(at)
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	dto "github.com/prometheus/client_model/go"
+)
+
+const correlationConfig = `
+metric_configs:
+- name: job_duration_seconds
+  help: time taken by each job
+  type: histogram
+  regex: '^(\S+) START id=(\S+) name=(\S+)'
+  timestamp:
+    value: $1
+    format: 2006-01-02T15:04:05Z07:00
+  labels:
+  - name: job
+    value: $3
+  buckets: [1, 10, 60]
+  correlation:
+    key: $2
+    end_regex: '^(\S+) END id=(\S+)'
+    end_key: $2
+    end_timestamp:
+      value: $1
+      format: 2006-01-02T15:04:05Z07:00
+    ttl: 1m
+    max_pending: 2
+`
+
+func TestCorrelation(t *testing.T) {
+	c := newTestCollector(t, correlationConfig)
+	defer c.Close()
+	r := c.newRule(0, &c.cfg.MetricConfigs[0], c.families[0])
+	for _, line := range []string{
+		// An event's duration is observed when it ends.
+		"2017-07-14T02:40:00Z START id=1 name=build",
+		"2017-07-14T02:40:05Z END id=1",
+		// An end line without a started event is unmatched.
+		"2017-07-14T02:40:05Z END id=2",
+		// Starting a waiting event again replaces it.
+		"2017-07-14T02:40:00Z START id=3 name=build",
+		"2017-07-14T02:40:30Z START id=3 name=build",
+		"2017-07-14T02:41:00Z END id=3",
+		// An event can't end before it started.
+		"2017-07-14T02:40:10Z START id=4 name=test",
+		"2017-07-14T02:40:05Z END id=4",
+		// Starting a third event evicts the oldest, whose end is then
+		// unmatched.
+		"2017-07-14T02:40:00Z START id=5 name=test",
+		"2017-07-14T02:40:00Z START id=6 name=test",
+		"2017-07-14T02:40:00Z START id=7 name=test",
+		"2017-07-14T02:40:02Z END id=5",
+		"no match",
+	} {
+		c.processLine(logLine{text: line}, r)
+	}
+
+	for _, tc := range []struct {
+		job   string
+		count uint64
+		sum   float64
+		le10  uint64 // observations in the 10s bucket
+	}{
+		{"build", 2, 35, 1},
+		{"test", 0, 0, 0},
+	} {
+		series := r.family.getSeries([]*dto.LabelPair{{Name: proto.String("job"), Value: proto.String(tc.job)}})
+		if series == nil {
+			if tc.count > 0 {
+				t.Errorf("%s: expected a series", tc.job)
+			}
+			continue
+		}
+		out := &dto.Metric{}
+		if err := series.Write(out); err != nil {
+			t.Fatal(err)
+		}
+		h := out.GetHistogram()
+		if h.GetSampleCount() != tc.count || h.GetSampleSum() != tc.sum {
+			t.Errorf("%s: expected %d observations summing to %v, got %d summing to %v",
+				tc.job, tc.count, tc.sum, h.GetSampleCount(), h.GetSampleSum())
+		}
+		for _, b := range h.GetBucket() {
+			if b.GetUpperBound() == 10 && b.GetCumulativeCount() != tc.le10 {
+				t.Errorf("%s: expected %d observations up to 10s, got %d", tc.job, tc.le10, b.GetCumulativeCount())
+			}
+		}
+	}
+
+	orphaned := func(reason orphanReason) float64 {
+		return readValue(t, c.correlationOrphanedStarts.WithLabelValues("job_duration_seconds", "0", reason.String()))
+	}
+	pending := c.correlationPendingStarts.WithLabelValues("job_duration_seconds", "0")
+	for _, tc := range []struct {
+		name     string
+		value    float64
+		expected float64
+	}{
+		{"replaced", orphaned(orphanReplaced), 1},
+		{"evicted", orphaned(orphanEvicted), 1},
+		{"expired", orphaned(orphanExpired), 0},
+		{"unmatched", readValue(t, c.correlationUnmatchedEnds.WithLabelValues("job_duration_seconds", "0")), 2},
+		{"pending", readValue(t, pending), 2},
+		{"matched", readValue(t, c.matchedLines.WithLabelValues("job_duration_seconds", "0")), 12},
+		{"negative", readValue(t, c.rejectedLines.WithLabelValues("job_duration_seconds", "0", "negative_duration")), 1},
+	} {
+		if tc.value != tc.expected {
+			t.Errorf("expected %v %s, got %v", tc.expected, tc.name, tc.value)
+		}
+	}
+
+	// Events expire a TTL after they were processed, whenever they were
+	// logged.
+	now := time.Now()
+	r.correlation.expire(now)
+	if value := orphaned(orphanExpired); value != 0 {
+		t.Errorf("expected no events to expire before their TTL, got %v", value)
+	}
+	r.correlation.expire(now.Add(2 * time.Minute))
+	if value := orphaned(orphanExpired); value != 2 {
+		t.Errorf("expected 2 expired events, got %v", value)
+	}
+	if value := readValue(t, pending); value != 0 {
+		t.Errorf("expected no pending events, got %v", value)
+	}
+	c.processLine(logLine{text: "2017-07-14T02:41:00Z END id=6"}, r)
+	if value := readValue(t, c.correlationUnmatchedEnds.WithLabelValues("job_duration_seconds", "0")); value != 3 {
+		t.Errorf("expected the end of an expired event to be unmatched, got %v", value)
+	}
+}
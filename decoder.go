@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/wrouesnel/tail_exporter/config"
+)
+
+// maxPartialSize bounds how much of a line split into partial log entries is
+// buffered. A longer line is handed on in pieces of this size.
+const maxPartialSize = 1 << 20
+
+// lineDecoder unwraps the envelope a line was logged in. Decode returns the
+// logged message and its metadata, or complete false if line held only part
+// of a message which later lines will finish.
+type lineDecoder interface {
+	Decode(line string) (msg string, meta lineMetadata, complete bool, err error)
+}
+
+// newLineDecoder returns the decoder of the named format, which adds meta to
+// the metadata of every line it decodes. Raw lines need no decoder, so it
+// returns nil for them.
+func newLineDecoder(format string, meta lineMetadata) lineDecoder {
+	switch format {
+	case config.FormatDocker:
+		return newDockerDecoder(meta)
+	case config.FormatCRI:
+		return newCRIDecoder(meta)
+	case config.FormatContainer:
+		return &containerDecoder{
+			docker: newDockerDecoder(meta),
+			cri:    newCRIDecoder(meta),
+		}
+	case config.FormatJournal:
+		return newJournalDecoder(meta)
+	default:
+		return nil
+	}
+}
+
+// partialLines reassembles messages which were logged split across entries,
+// separately for each stream.
+type partialLines map[string][]byte
+
+// add appends part to the message being assembled for stream, and returns
+// the message if it is complete or has grown too long to buffer.
+func (p partialLines) add(stream string, part string, complete bool) (string, bool) {
+	buf := append(p[stream], part...)
+	if !complete && len(buf) < maxPartialSize {
+		p[stream] = buf
+		return "", false
+	}
+	delete(p, stream)
+	return string(buf), true
+}
+
+// entryMetadata returns the metadata of a log entry.
+func entryMetadata(meta lineMetadata, stream string, time string) lineMetadata {
+	entryMeta := make(lineMetadata, len(meta)+2)
+	for name, value := range meta {
+		entryMeta[name] = value
+	}
+	entryMeta["stream"] = stream
+	entryMeta["time"] = time
+	return entryMeta
+}
+
+// recordMetadata adds the fields of a structured record to meta. Nested
+// fields are named by their dotted path, and arrays of values are joined
+// with commas.
+func recordMetadata(meta lineMetadata, prefix string, value interface{}) {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		for name, field := range value {
+			if prefix != "" {
+				name = prefix + "." + name
+			}
+			recordMetadata(meta, name, field)
+		}
+	case []interface{}:
+		values := make([]string, 0, len(value))
+		for _, elem := range value {
+			if s, ok := scalarString(elem); ok {
+				values = append(values, s)
+			}
+		}
+		meta[prefix] = strings.Join(values, ",")
+	default:
+		if s, ok := scalarString(value); ok {
+			meta[prefix] = s
+		}
+	}
+}
+
+// scalarString formats a decoded JSON or msgpack value which isn't a map or
+// array. Nulls and other values have no string.
+func scalarString(value interface{}) (string, bool) {
+	switch value := value.(type) {
+	case string:
+		return value, true
+	case []byte:
+		return string(value), true
+	case json.Number:
+		return value.String(), true
+	case int64:
+		return strconv.FormatInt(value, 10), true
+	case uint64:
+		return strconv.FormatUint(value, 10), true
+	case float64:
+		return strconv.FormatFloat(value, 'g', -1, 64), true
+	case bool:
+		return strconv.FormatBool(value), true
+	}
+	return "", false
+}
+
+// dockerDecoder decodes the entries of Docker's json-file log driver. Docker
+// splits long lines into entries without a trailing newline.
+type dockerDecoder struct {
+	meta    lineMetadata
+	partial partialLines
+}
+
+func newDockerDecoder(meta lineMetadata) *dockerDecoder {
+	return &dockerDecoder{meta: meta, partial: make(partialLines)}
+}
+
+func (d *dockerDecoder) Decode(line string) (string, lineMetadata, bool, error) {
+	var entry struct {
+		Log    string `json:"log"`
+		Stream string `json:"stream"`
+		Time   string `json:"time"`
+	}
+	if err := json.Unmarshal([]byte(line), &entry); err != nil {
+		return "", nil, false, fmt.Errorf("invalid docker log entry: %v", err)
+	}
+
+	part := strings.TrimSuffix(entry.Log, "\n")
+	msg, complete := d.partial.add(entry.Stream, part, len(part) < len(entry.Log))
+	if !complete {
+		return "", nil, false, nil
+	}
+	return msg, entryMetadata(d.meta, entry.Stream, entry.Time), true, nil
+}
+
+// criDecoder decodes the entries of the Kubernetes CRI log format:
+//
+//	<time> <stream> <tags> <message>
+//
+// where the first tag is P for a partial line, and F for the full line or its
+// final part.
+type criDecoder struct {
+	meta    lineMetadata
+	partial partialLines
+}
+
+func newCRIDecoder(meta lineMetadata) *criDecoder {
+	return &criDecoder{meta: meta, partial: make(partialLines)}
+}
+
+func (d *criDecoder) Decode(line string) (string, lineMetadata, bool, error) {
+	fields := strings.SplitN(line, " ", 4)
+	if len(fields) < 3 {
+		return "", nil, false, errors.New("invalid CRI log entry: too few fields")
+	}
+	time, stream, tags := fields[0], fields[1], fields[2]
+	var part string
+	if len(fields) == 4 {
+		part = fields[3]
+	}
+
+	var complete bool
+	switch strings.SplitN(tags, ":", 2)[0] {
+	case "P":
+		complete = false
+	case "F":
+		complete = true
+	default:
+		return "", nil, false, fmt.Errorf("invalid CRI log entry: unknown tags %q", tags)
+	}
+
+	msg, complete := d.partial.add(stream, part, complete)
+	if !complete {
+		return "", nil, false, nil
+	}
+	return msg, entryMetadata(d.meta, stream, time), true, nil
+}
+
+// containerDecoder decodes container logs which may be in either Docker or
+// CRI format, as a node's logs are while its runtime is being migrated.
+type containerDecoder struct {
+	docker *dockerDecoder
+	cri    *criDecoder
+}
+
+func (d *containerDecoder) Decode(line string) (string, lineMetadata, bool, error) {
+	if strings.HasPrefix(line, "{") {
+		return d.docker.Decode(line)
+	}
+	return d.cri.Decode(line)
+}
+
+// containerLogMetadata derives metadata about the container which logged to
+// a file from the standard Kubernetes log file layouts:
+//
+//	/var/log/containers/<pod>_<namespace>_<container>-<container id>.log
+//	/var/log/pods/<namespace>_<pod>_<pod uid>/<container>/<restart>.log
+//
+// It returns nil for paths which aren't in either layout.
+func containerLogMetadata(path string) lineMetadata {
+	dir, base := filepath.Split(filepath.Clean(path))
+	dir = filepath.Clean(dir)
+	if !strings.HasSuffix(base, ".log") {
+		return nil
+	}
+	base = strings.TrimSuffix(base, ".log")
+
+	switch {
+	case filepath.Base(dir) == "containers":
+		fields := strings.Split(base, "_")
+		if len(fields) != 3 {
+			return nil
+		}
+		idx := strings.LastIndex(fields[2], "-")
+		if idx < 0 {
+			return nil
+		}
+		return lineMetadata{
+			"pod":          fields[0],
+			"namespace":    fields[1],
+			"container":    fields[2][:idx],
+			"container_id": fields[2][idx+1:],
+		}
+	case filepath.Base(filepath.Dir(filepath.Dir(dir))) == "pods":
+		fields := strings.Split(filepath.Base(filepath.Dir(dir)), "_")
+		if len(fields) != 3 {
+			return nil
+		}
+		return lineMetadata{
+			"namespace": fields[0],
+			"pod":       fields[1],
+			"pod_uid":   fields[2],
+			"container": filepath.Base(dir),
+		}
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+
+	"github.com/prometheus/common/log"
+)
+
+// compression identifies the format of a compressed file by its leading
+// magic bytes.
+type compression struct {
+	name  string
+	magic []byte
+	// command decompresses stdin to stdout for formats with no vendored
+	// decoder.
+	command []string
+}
+
+var compressions = []compression{
+	{name: "gzip", magic: []byte{0x1f, 0x8b}},
+	{name: "bzip2", magic: []byte("BZh")},
+	{name: "zstd", magic: []byte{0x28, 0xb5, 0x2f, 0xfd}, command: []string{"zstd", "-d", "-c", "-q"}},
+	{name: "xz", magic: []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}, command: []string{"xz", "-d", "-c", "-q"}},
+}
+
+// maxMagicLen is the length of the longest magic.
+const maxMagicLen = 6
+
+func detectCompression(r *bufio.Reader) *compression {
+	// Short files can't be compressed, so a failed peek is not an error.
+	magic, _ := r.Peek(maxMagicLen)
+	for idx := range compressions {
+		if bytes.HasPrefix(magic, compressions[idx].magic) {
+			return &compressions[idx]
+		}
+	}
+	return nil
+}
+
+// isCompressed reports if the named file is in a compressed format.
+func isCompressed(filename string) (bool, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close() // nolint: errcheck
+	return detectCompression(bufio.NewReader(f)) != nil, nil
+}
+
+// logFile is a log file opened for reading, which closes its underlying
+// file and decompressor together.
+type logFile struct {
+	io.Reader
+	closers []func() error
+}
+
+func (f *logFile) Close() error {
+	var firstErr error
+	for idx := len(f.closers) - 1; idx >= 0; idx-- {
+		if err := f.closers[idx](); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// checkDecompressors warns about each compressed format which can't be read
+// because the command decompressing it isn't installed.
+func checkDecompressors() {
+	for _, comp := range compressions {
+		if comp.command == nil {
+			continue
+		}
+		if _, err := exec.LookPath(comp.command[0]); err != nil {
+			log.Warnf("%s compressed files can't be read without the %s command: %v", comp.name, comp.command[0], err)
+		}
+	}
+}
+
+// commandReader reads the output of a command decompressing a file.
+type commandReader struct {
+	io.ReadCloser
+	cmd *exec.Cmd
+	eof bool
+}
+
+func (r *commandReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if err == io.EOF {
+		r.eof = true
+	}
+	return n, err
+}
+
+// Close waits for the command to exit. A command whose output wasn't read to
+// its end would block writing it, so is killed first and its exit status
+// ignored.
+func (r *commandReader) Close() error {
+	if r.eof {
+		return r.cmd.Wait()
+	}
+	logErr(r.ReadCloser.Close())
+	if err := r.cmd.Process.Kill(); err != nil {
+		log.Debugln("Error killing decompressor:", err)
+	}
+	_ = r.cmd.Wait()
+	return nil
+}
+
+// openLogFile opens filename for reading, transparently decompressing gzip,
+// bzip2, zstd and xz files such as rotated logs. No zstd or xz decoders are
+// vendored, so those files are piped through a zstd or xz process started
+// from the PATH for each file.
+func openLogFile(filename string) (io.ReadCloser, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(f)
+	lf := &logFile{Reader: r, closers: []func() error{f.Close}}
+
+	comp := detectCompression(r)
+	switch {
+	case comp == nil:
+	case comp.name == "gzip":
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			logErr(lf.Close())
+			return nil, err
+		}
+		lf.Reader = gz
+		lf.closers = append(lf.closers, gz.Close)
+	case comp.name == "bzip2":
+		lf.Reader = bzip2.NewReader(r)
+	default:
+		cmd := exec.Command(comp.command[0], comp.command[1:]...)
+		cmd.Stdin = r
+		cmd.Stderr = os.Stderr
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			logErr(lf.Close())
+			return nil, err
+		}
+		if err := cmd.Start(); err != nil {
+			logErr(lf.Close())
+			return nil, fmt.Errorf("%s compressed input requires the %s command: %v", comp.name, comp.command[0], err)
+		}
+		cr := &commandReader{ReadCloser: stdout, cmd: cmd}
+		lf.Reader = cr
+		lf.closers = append(lf.closers, cr.Close)
+	}
+	return lf, nil
+}
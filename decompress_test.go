@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestOpenLogFileCommands(t *testing.T) {
+	dir, err := ioutil.TempDir("", "decompress_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir) // nolint: errcheck
+
+	// Much more output than a pipe buffers, so a command whose output
+	// isn't read blocks.
+	content := bytes.Repeat([]byte("a line of a compressed log file\n"), 100000)
+	for _, comp := range compressions {
+		if comp.command == nil {
+			continue
+		}
+		if _, err := exec.LookPath(comp.command[0]); err != nil {
+			t.Logf("Skipping %s: %v", comp.name, err)
+			continue
+		}
+
+		filename := filepath.Join(dir, "app.log."+comp.name)
+		cmd := exec.Command(comp.command[0], "-c", "-q")
+		cmd.Stdin = bytes.NewReader(content)
+		compressed, err := cmd.Output()
+		if err != nil {
+			t.Fatalf("%s: %v", comp.name, err)
+		}
+		if err := ioutil.WriteFile(filename, compressed, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		r, err := openLogFile(filename)
+		if err != nil {
+			t.Fatalf("%s: %v", comp.name, err)
+		}
+		decompressed, err := ioutil.ReadAll(r)
+		if err != nil || !bytes.Equal(decompressed, content) {
+			t.Errorf("%s: file was not decompressed: %v", comp.name, err)
+		}
+		if err := r.Close(); err != nil {
+			t.Errorf("%s: error closing fully read file: %v", comp.name, err)
+		}
+
+		r, err = openLogFile(filename)
+		if err != nil {
+			t.Fatalf("%s: %v", comp.name, err)
+		}
+		if _, err := io.ReadFull(r, make([]byte, 10)); err != nil {
+			t.Fatalf("%s: %v", comp.name, err)
+		}
+		closed := make(chan error)
+		go func() { closed <- r.Close() }()
+		select {
+		case err := <-closed:
+			if err != nil {
+				t.Errorf("%s: error closing partly read file: %v", comp.name, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: closing a partly read file blocked", comp.name)
+		}
+	}
+}
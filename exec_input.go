@@ -0,0 +1,173 @@
+package main
+
+import (
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+	"github.com/wrouesnel/tail_exporter/config"
+)
+
+// execInput runs a command and ingests its output, restarting it with
+// exponential backoff whenever it exits.
+type execInput struct {
+	c   *TailCollector
+	cfg *config.InputConfig
+
+	restarts prometheus.Counter
+	running  prometheus.Gauge
+
+	mtx  sync.Mutex
+	cmd  *exec.Cmd     // the running command, if any
+	stop chan struct{} // closed by Stop
+	done chan struct{} // closed when Run returns
+}
+
+func (c *TailCollector) newExecInput(cfg *config.InputConfig) *execInput {
+	return &execInput{
+		c:        c,
+		cfg:      cfg,
+		restarts: c.execRestarts.WithLabelValues(cfg.Name),
+		running:  c.execRunning.WithLabelValues(cfg.Name),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// Run runs the command until Stop is called.
+func (e *execInput) Run() {
+	defer close(e.done)
+	logger := log.With("input", e.cfg.Name)
+
+	backoff := time.Duration(e.cfg.MinBackoff)
+	for {
+		started := time.Now()
+		if err := e.runOnce(); err != nil {
+			logger.Errorln("Error running command:", err)
+		}
+		if e.isStopping() {
+			return
+		}
+
+		// A command which ran for a while is restarted promptly.
+		if time.Since(started) > time.Duration(e.cfg.MaxBackoff) {
+			backoff = time.Duration(e.cfg.MinBackoff)
+		}
+		logger.Warnln("Command exited, restarting in", backoff)
+		select {
+		case <-time.After(backoff):
+		case <-e.stop:
+			return
+		}
+		e.restarts.Inc()
+		backoff *= 2
+		if backoff > time.Duration(e.cfg.MaxBackoff) {
+			backoff = time.Duration(e.cfg.MaxBackoff)
+		}
+	}
+}
+
+func (e *execInput) isStopping() bool {
+	select {
+	case <-e.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// runOnce runs the command, ingesting its output until it exits.
+func (e *execInput) runOnce() error {
+	cmd := exec.Command(e.cfg.Command[0], e.cfg.Command[1:]...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	var stderr io.Reader
+	if e.cfg.Stderr {
+		if stderr, err = cmd.StderrPipe(); err != nil {
+			return err
+		}
+	} else {
+		cmd.Stderr = os.Stderr
+	}
+
+	e.mtx.Lock()
+	if e.isStopping() {
+		e.mtx.Unlock()
+		return nil
+	}
+	if err := cmd.Start(); err != nil {
+		e.mtx.Unlock()
+		return err
+	}
+	e.cmd = cmd
+	e.mtx.Unlock()
+	e.running.Set(1)
+
+	// Output must be read to its end before waiting for the command.
+	var wg sync.WaitGroup
+	if stderr != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			logErr(e.streamInput("stderr").processReader(stderr))
+		}()
+	}
+	logErr(e.streamInput("stdout").processReader(stdout))
+	wg.Wait()
+
+	err = cmd.Wait()
+	e.mtx.Lock()
+	e.cmd = nil
+	e.mtx.Unlock()
+	e.running.Set(0)
+	// The exit code is only exported once there is one.
+	if cmd.ProcessState != nil {
+		status := cmd.ProcessState.Sys().(syscall.WaitStatus)
+		e.c.execExitCode.WithLabelValues(e.cfg.Name).Set(float64(status.ExitStatus()))
+	}
+	if _, ok := err.(*exec.ExitError); ok {
+		// The exit code is the metric's business.
+		return nil
+	}
+	return err
+}
+
+// streamInput returns the input of one of the command's output streams.
+func (e *execInput) streamInput(stream string) *LineInput {
+	return e.c.Input(e.cfg.Name).
+		withMetadata(e.cfg.Labels).
+		withMetadata(lineMetadata{"stream": stream}).
+		withFormat(e.cfg.Format)
+}
+
+// Stop forwards sig to the running command and waits for it to exit, killing
+// it if it is still running after timeout. It must only be called once.
+func (e *execInput) Stop(sig os.Signal, timeout time.Duration) {
+	e.mtx.Lock()
+	close(e.stop)
+	if e.cmd != nil {
+		logErr(e.cmd.Process.Signal(sig))
+	}
+	e.mtx.Unlock()
+
+	select {
+	case <-e.done:
+		return
+	case <-time.After(timeout):
+	}
+
+	e.mtx.Lock()
+	if e.cmd != nil {
+		log.With("input", e.cfg.Name).Warnln("Command did not exit, killing it")
+		logErr(e.cmd.Process.Kill())
+	}
+	e.mtx.Unlock()
+	<-e.done
+}
@@ -0,0 +1,482 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/hpcloud/tail"
+	"github.com/prometheus/common/log"
+	"github.com/wrouesnel/tail_exporter/config"
+)
+
+// newFileFollower returns a follower of the named file, whose lines are in
+// the given format and have the given metadata. positions may be nil.
+func (c *TailCollector) newFileFollower(filename string, format string, meta lineMetadata, positions *positions) *fileFollower {
+	return &fileFollower{
+		path:         filename,
+		input:        c.FileInput(filename, format, meta),
+		positions:    positions,
+		pollInterval: *tailPollInterval,
+	}
+}
+
+// watchFile ingests lines from the followed file for as long as the exporter
+// runs, or until it is removed if ff.untilRemoved is set. Named pipes are
+// tailed, compressed files are read once, and regular files are followed
+// across rotations. It returns true if it stopped because the file was
+// removed.
+func (c *TailCollector) watchFile(ff *fileFollower) bool {
+	st, err := os.Stat(ff.path)
+	if err == nil && st.Mode()&os.ModeNamedPipe == os.ModeNamedPipe {
+		t, err := tail.TailFile(ff.path, tail.Config{
+			Pipe:   true,
+			Follow: true,
+		})
+		if err != nil {
+			log.Errorln("Error tailing file:", ff.path, err)
+			return false
+		}
+		if ff.stop != nil {
+			go func() {
+				<-ff.stop
+				logErr(t.Stop())
+			}()
+		}
+		for line := range t.Lines {
+			ff.input.IngestLine(line.Text)
+		}
+		return false
+	}
+
+	if compressed, _ := isCompressed(ff.path); compressed {
+		if err := ff.readCompressed(); err != nil {
+			log.Errorln("Error reading compressed file:", ff.path, err)
+		}
+		return false
+	}
+
+	return ff.run(ff.resume())
+}
+
+// watchInput follows every file matching the path glob of a file input,
+// checking for new matches every tail.refresh-interval. Files which appear
+// after the exporter started are read from their beginning, and files which
+// are removed stop being followed once they have been read to their end.
+// Closing stop, if it isn't nil, stops following the files, and returns once
+// they have been.
+func (c *TailCollector) watchInput(input *config.InputConfig, positions *positions, stop <-chan struct{}) {
+	type result struct {
+		filename string
+		removed  bool
+	}
+	// watched holds whether each matching file is still being followed.
+	watched := make(map[string]bool)
+	done := make(chan result)
+	running := 0
+
+	ticker := time.NewTicker(*tailRefresh)
+	defer ticker.Stop()
+	for startup := true; ; startup = false {
+		matches, err := filepath.Glob(input.Path)
+		if err != nil {
+			log.Errorln("Error matching input path:", input.Path, err)
+		}
+		matched := make(map[string]bool, len(matches))
+		for _, filename := range matches {
+			matched[filename] = true
+			if _, found := watched[filename]; found {
+				continue
+			}
+			watched[filename] = true
+
+			ff := c.newFileFollower(filename, input.Format, input.Labels, positions)
+			ff.fromStart = !startup
+			ff.untilRemoved = true
+			ff.stop = stop
+			running++
+			go func(ff *fileFollower) {
+				done <- result{ff.path, c.watchFile(ff)}
+			}(ff)
+		}
+		// Forget finished files which no longer match, so a new file of
+		// the same name is followed.
+		for filename, following := range watched {
+			if !following && !matched[filename] {
+				delete(watched, filename)
+				if positions != nil {
+					positions.remove(filename)
+				}
+			}
+		}
+
+	wait:
+		for {
+			select {
+			case r := <-done:
+				running--
+				if r.removed {
+					delete(watched, r.filename)
+				} else {
+					watched[r.filename] = false
+				}
+			case <-ticker.C:
+				break wait
+			case <-stop:
+				for ; running > 0; running-- {
+					<-done
+				}
+				return
+			}
+		}
+	}
+}
+
+// fileFollower follows a regular file like tail -F. It tracks the offset of
+// the last complete line ingested so its position can be saved exactly, and
+// reads a rotated file to EOF before reopening its path.
+type fileFollower struct {
+	path         string
+	input        *LineInput
+	positions    *positions
+	pollInterval time.Duration
+	// fromStart follows a file without a saved position from its start
+	// rather than its end.
+	fromStart bool
+	// untilRemoved stops following the file when it is removed.
+	untilRemoved bool
+	// stop, if it isn't nil, is closed to stop following the file.
+	stop <-chan struct{}
+
+	f *os.File
+	// inode of f, or 0 if it isn't known
+	inode uint64
+	// offset is the end of the last complete line ingested from f
+	offset int64
+	// fingerprint of the first fingerprintLen bytes of f
+	fingerprint    string
+	fingerprintLen int
+}
+
+// resume returns the offset to start following the file from, or -1 to
+// start at its end. If the saved position is in a segment which was rotated
+// away while the exporter wasn't running, the rest of that segment is
+// ingested first. A file without a saved position whose content was already
+// ingested under another name, such as a segment renamed by a rotation,
+// resumes where that left off.
+func (ff *fileFollower) resume() int64 {
+	start := int64(-1)
+	if ff.fromStart {
+		start = 0
+	}
+	if ff.positions == nil {
+		return start
+	}
+	pos, found := ff.positions.get(ff.path)
+	if !found {
+		if pos, found = ff.consumed(); found {
+			log.Debugln("Resuming", ff.path, "where it was read to under another name")
+			return pos.Offset
+		}
+		return start
+	}
+
+	if f, err := os.Open(ff.path); err == nil {
+		fp, ferr := fingerprint(f, pos.FingerprintSize)
+		st, serr := f.Stat()
+		logErr(f.Close())
+		if ferr == nil && serr == nil && fp == pos.Fingerprint && st.Size() >= pos.Offset {
+			return pos.Offset
+		}
+	}
+
+	if !ff.drainRotated(pos) {
+		log.Warnln("Could not find the rotated segment of", ff.path, "so lines may have been lost")
+	}
+	return 0
+}
+
+// consumed finds the position the file's content was already ingested to
+// under another name.
+func (ff *fileFollower) consumed() (filePosition, bool) {
+	f, err := os.Open(ff.path)
+	if err != nil {
+		return filePosition{}, false
+	}
+	defer f.Close() // nolint: errcheck
+	st, err := f.Stat()
+	if err != nil {
+		return filePosition{}, false
+	}
+	head, err := readHead(f)
+	if err != nil {
+		return filePosition{}, false
+	}
+	pos, found := ff.positions.consumed(head, fileInode(st), false)
+	if !found || pos.Offset > st.Size() {
+		return filePosition{}, false
+	}
+	return pos, true
+}
+
+// readCompressed ingests a compressed file, which is a finished rotation so
+// can't grow, and records it in the positions file. Content already ingested,
+// before the file was compressed or by a previous run, is skipped. Like the
+// existing content of live files, compressed files an input's glob matches at
+// startup are skipped, while those named on the command line are read.
+func (ff *fileFollower) readCompressed() error {
+	st, err := os.Stat(ff.path)
+	if err != nil {
+		return err
+	}
+	r, err := openLogFile(ff.path)
+	if err != nil {
+		return err
+	}
+	br := bufio.NewReader(r)
+	head, err := br.Peek(fingerprintSize)
+	if err != nil && err != io.EOF {
+		logErr(r.Close())
+		return err
+	}
+	err = nil
+
+	skip, skipAll := int64(0), ff.untilRemoved && !ff.fromStart
+	if ff.positions != nil {
+		if pos, found := ff.positions.consumed(head, fileInode(st), true); found {
+			skip, skipAll = pos.Offset, pos.Compressed
+		}
+	}
+	if !skipAll {
+		if _, err = io.CopyN(ioutil.Discard, br, skip); err == nil {
+			err = ff.input.processReader(br)
+		} else if err == io.EOF {
+			err = nil
+		}
+	}
+	if cerr := r.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	if ff.positions != nil && len(head) > 0 {
+		fp, _ := fingerprint(bytes.NewReader(head), len(head))
+		ff.positions.set(ff.path, filePosition{
+			FingerprintSize: len(head),
+			Fingerprint:     fp,
+			Inode:           fileInode(st),
+			Compressed:      true,
+		})
+	}
+	return nil
+}
+
+// drainRotated finds the rotated segment pos refers to, which may have been
+// compressed, and ingests it from pos to its end. It returns false if no
+// segment was found.
+func (ff *fileFollower) drainRotated(pos filePosition) bool {
+	var candidates []string
+	for _, pattern := range []string{ff.path + ".*", ff.path + "-*"} {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			continue
+		}
+		candidates = append(candidates, matches...)
+	}
+	// The most recently rotated segment is the most likely.
+	modTimes := make(map[string]time.Time, len(candidates))
+	for _, candidate := range candidates {
+		if st, err := os.Stat(candidate); err == nil {
+			modTimes[candidate] = st.ModTime()
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return modTimes[candidates[i]].After(modTimes[candidates[j]])
+	})
+
+	for _, candidate := range candidates {
+		r, err := openLogFile(candidate)
+		if err != nil {
+			continue
+		}
+		// The fingerprint covers the start of the ingested lines, so
+		// after reading it only the rest of them need skipping.
+		fp, err := fingerprint(r, pos.FingerprintSize)
+		if err == nil && fp == pos.Fingerprint {
+			if _, err = io.CopyN(ioutil.Discard, r, pos.Offset-int64(pos.FingerprintSize)); err == nil {
+				log.Infoln("Ingesting the rest of rotated segment", candidate)
+				err = ff.input.processReader(r)
+			}
+			logErr(err)
+			logErr(r.Close())
+			return err == nil
+		}
+		logErr(r.Close())
+	}
+	return false
+}
+
+// open opens the followed path at offset, or at its end if offset is
+// negative.
+func (ff *fileFollower) open(offset int64) error {
+	f, err := os.Open(ff.path)
+	if err != nil {
+		return err
+	}
+	whence := io.SeekStart
+	if offset < 0 {
+		offset, whence = 0, io.SeekEnd
+	}
+	if ff.offset, err = f.Seek(offset, whence); err != nil {
+		logErr(f.Close())
+		return err
+	}
+	if st, err := f.Stat(); err == nil {
+		ff.inode = fileInode(st)
+	}
+	ff.f = f
+	ff.fingerprint, ff.fingerprintLen = "", -1
+	return nil
+}
+
+// updatePosition records the offset reached in the positions file.
+func (ff *fileFollower) updatePosition() {
+	if pos, ok := ff.position(); ok {
+		ff.positions.set(ff.path, pos)
+	}
+}
+
+// position returns the position reached in f, or false if it isn't saved.
+func (ff *fileFollower) position() (filePosition, bool) {
+	if ff.positions == nil {
+		return filePosition{}, false
+	}
+
+	// The fingerprint only covers ingested lines, so grows with them
+	// until it is full size.
+	if n := int(ff.offset); ff.fingerprintLen < fingerprintSize && n > ff.fingerprintLen {
+		if n > fingerprintSize {
+			n = fingerprintSize
+		}
+		fp, err := fingerprint(io.NewSectionReader(ff.f, 0, int64(n)), n)
+		if err != nil {
+			log.Errorln("Error fingerprinting", ff.path, err)
+			return filePosition{}, false
+		}
+		ff.fingerprint, ff.fingerprintLen = fp, n
+	}
+
+	return filePosition{
+		Offset:          ff.offset,
+		FingerprintSize: ff.fingerprintLen,
+		Fingerprint:     ff.fingerprint,
+		Inode:           ff.inode,
+	}, true
+}
+
+// wait waits for the poll interval, returning false if the follower was
+// stopped instead.
+func (ff *fileFollower) wait() bool {
+	select {
+	case <-ff.stop:
+		return false
+	case <-time.After(ff.pollInterval):
+		return true
+	}
+}
+
+// run follows the file from offset, until it is removed if ff.untilRemoved
+// is set, or it is stopped, and otherwise forever. It returns true if the
+// file was removed.
+func (ff *fileFollower) run(offset int64) bool {
+	for {
+		err := ff.open(offset)
+		if err == nil {
+			break
+		}
+		if ff.untilRemoved && os.IsNotExist(err) {
+			return true
+		}
+		log.Debugln("Waiting for file to follow:", err)
+		if !ff.wait() {
+			return false
+		}
+	}
+	ff.updatePosition()
+
+	reader := bufio.NewReader(ff.f)
+	var partial []byte
+	for {
+		chunk, err := reader.ReadBytes('\n')
+		if err == nil {
+			partial = append(partial, chunk[:len(chunk)-1]...)
+			ff.offset += int64(len(partial) + 1)
+			ff.input.IngestLine(string(partial))
+			partial = partial[:0]
+			ff.updatePosition()
+			continue
+		}
+		partial = append(partial, chunk...)
+		if err != io.EOF {
+			log.Errorln("Error reading", ff.path, err)
+		}
+
+		// At EOF, check whether the file has been rotated or truncated.
+		current, statErr := ff.f.Stat()
+		st, pathErr := os.Stat(ff.path)
+		switch {
+		case ff.untilRemoved && os.IsNotExist(pathErr):
+			// Removed, and read to its end.
+			if len(partial) > 0 {
+				ff.input.IngestLine(string(partial))
+			}
+			logErr(ff.f.Close())
+			if ff.positions != nil {
+				ff.positions.remove(ff.path)
+			}
+			return true
+		case statErr == nil && pathErr == nil && !os.SameFile(current, st):
+			// Rotated, and the old file has been read to its end. Its
+			// position is retired so it isn't read again if it is
+			// found under its new name.
+			if len(partial) > 0 {
+				ff.input.IngestLine(string(partial))
+				ff.offset += int64(len(partial))
+				partial = partial[:0]
+			}
+			if pos, ok := ff.position(); ok {
+				ff.positions.retire(pos)
+			}
+			logErr(ff.f.Close())
+			for err := ff.open(0); err != nil; err = ff.open(0) {
+				log.Errorln("Error reopening rotated file", ff.path, err)
+				if !ff.wait() {
+					return false
+				}
+			}
+			reader.Reset(ff.f)
+			ff.updatePosition()
+			continue
+		case statErr == nil && current.Size() < ff.offset+int64(len(partial)):
+			// Truncated in place.
+			if _, err := ff.f.Seek(0, io.SeekStart); err != nil {
+				log.Errorln("Error rewinding truncated file", ff.path, err)
+			}
+			ff.offset, ff.fingerprint, ff.fingerprintLen = 0, "", -1
+			partial = partial[:0]
+			reader.Reset(ff.f)
+			ff.updatePosition()
+		}
+		if !ff.wait() {
+			logErr(ff.f.Close())
+			return false
+		}
+	}
+}
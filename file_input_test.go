@@ -0,0 +1,211 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/wrouesnel/tail_exporter/config"
+)
+
+const fileInputConfig = `
+metric_configs:
+- name: lines
+  help: lines ingested
+  type: counter
+  regex: '^line'
+  value: +1
+`
+
+// lineCounter follows the files matching a glob in a temporary directory,
+// counting the lines ingested from them.
+type lineCounter struct {
+	t       *testing.T
+	dir     string
+	c       *TailCollector
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+func newLineCounter(t *testing.T, dir string) *lineCounter {
+	return &lineCounter{
+		t:       t,
+		dir:     dir,
+		c:       newTestCollector(t, fileInputConfig),
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+}
+
+// watch follows the files matching glob, and waits for the named files to
+// be recorded in positions by the first scan.
+func (lc *lineCounter) watch(glob string, positions *positions, names ...string) {
+	go func() {
+		lc.c.watchInput(&config.InputConfig{
+			Kind: config.InputKindFile,
+			Path: filepath.Join(lc.dir, glob),
+		}, positions, lc.stop)
+		close(lc.stopped)
+	}()
+	for _, name := range names {
+		lc.poll(func() bool {
+			_, found := positions.get(lc.path(name))
+			return found
+		}, "%s was not opened", name)
+	}
+}
+
+// close stops following files, and checks no more lines than expected were
+// ingested.
+func (lc *lineCounter) close(count float64) {
+	close(lc.stop)
+	<-lc.stopped
+	if got := lc.count(); got != count {
+		lc.t.Errorf("expected %v lines once stopped, got %v", count, got)
+	}
+}
+
+// poll waits for cond to be true, failing the test if it takes too long.
+func (lc *lineCounter) poll(cond func() bool, format string, args ...interface{}) {
+	poll(lc.t, cond, format, args...)
+}
+
+func (lc *lineCounter) path(name string) string {
+	return filepath.Join(lc.dir, name)
+}
+
+func (lc *lineCounter) appendLines(name string, from, to int) {
+	f, err := os.OpenFile(lc.path(name), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		lc.t.Fatal(err)
+	}
+	// Lines are long enough for a few to fill a fingerprint.
+	for i := from; i < to; i++ {
+		fmt.Fprintf(f, "line %d %0200d\n", i, 0)
+	}
+	if err := f.Close(); err != nil {
+		lc.t.Fatal(err)
+	}
+}
+
+func (lc *lineCounter) compress(name, compressed string) {
+	content, err := ioutil.ReadFile(lc.path(name))
+	if err != nil {
+		lc.t.Fatal(err)
+	}
+	f, err := os.Create(lc.path(compressed))
+	if err != nil {
+		lc.t.Fatal(err)
+	}
+	gz := gzip.NewWriter(f)
+	if _, err := gz.Write(content); err != nil {
+		lc.t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		lc.t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		lc.t.Fatal(err)
+	}
+}
+
+func (lc *lineCounter) count() float64 {
+	if metric := lc.c.families[0].getSeries(nil); metric != nil {
+		return metric.Get()
+	}
+	return 0
+}
+
+// expect waits for count lines to have been ingested, failing if more are.
+func (lc *lineCounter) expect(count float64) {
+	lc.poll(func() bool {
+		return lc.count() >= count
+	}, "expected %v lines, got %v", count, lc.count())
+	if got := lc.count(); got != count {
+		lc.t.Fatalf("expected %v lines, got %v", count, got)
+	}
+}
+
+func TestRotatedFilesNotReread(t *testing.T) {
+	prevRefresh, prevPollInterval := *tailRefresh, *tailPollInterval
+	defer func() {
+		*tailRefresh, *tailPollInterval = prevRefresh, prevPollInterval
+	}()
+	*tailRefresh, *tailPollInterval = 20*time.Millisecond, 5*time.Millisecond
+
+	dir, err := ioutil.TempDir("", "file_input_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir) // nolint: errcheck
+	lc := newLineCounter(t, dir)
+	positions, err := loadPositions(lc.path("positions.yml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Existing content, including compressed segments, is skipped at
+	// startup.
+	lc.appendLines("app.log", 0, 5)
+	lc.compress("app.log", "app.log.5.gz")
+	lc.watch("app.log*", positions, "app.log", "app.log.5.gz")
+	lc.appendLines("app.log", 5, 10)
+	lc.expect(5)
+
+	// The segment renamed by a rotation is the file already followed.
+	if err := os.Rename(lc.path("app.log"), lc.path("app.log.1")); err != nil {
+		t.Fatal(err)
+	}
+	lc.appendLines("app.log", 10, 12)
+	lc.expect(7)
+	lc.appendLines("app.log.1", 12, 13)
+	lc.expect(8)
+
+	// Once compressed, the segment is recognised by its fingerprint.
+	lc.compress("app.log.1", "app.log.2.gz")
+	if err := os.Remove(lc.path("app.log.1")); err != nil {
+		t.Fatal(err)
+	}
+	lc.poll(func() bool {
+		_, found := positions.get(lc.path("app.log.2.gz"))
+		return found
+	}, "app.log.2.gz was not recorded")
+	lc.expect(8)
+
+	// A new compressed file is read.
+	lc.appendLines("other.log", 100, 103)
+	lc.compress("other.log", "app.log.3.gz")
+	lc.expect(11)
+	if err := positions.save(); err != nil {
+		t.Fatal(err)
+	}
+	lc.close(11)
+
+	// After a restart, a compressed file read before is skipped even when
+	// it appears under a new name, and one which wasn't is read.
+	restarted, err := loadPositions(lc.path("positions.yml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(lc.path("rotated"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	lc2 := newLineCounter(t, dir)
+	lc2.appendLines("rotated/marker.log", 0, 1)
+	lc2.watch("rotated/*", restarted, "rotated/marker.log")
+	if err := os.Rename(lc.path("app.log.2.gz"), lc.path("rotated/app.log.4.gz")); err != nil {
+		t.Fatal(err)
+	}
+	lc2.appendLines("unseen.log", 200, 202)
+	lc2.compress("unseen.log", "rotated/unseen.log.1.gz")
+	lc2.poll(func() bool {
+		_, found := restarted.get(lc.path("rotated/app.log.4.gz"))
+		return found
+	}, "rotated/app.log.4.gz was not recorded")
+	lc2.expect(2)
+	lc2.close(2)
+}
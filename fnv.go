@@ -0,0 +1,55 @@
+package main
+
+import (
+	"github.com/prometheus/common/model"
+)
+
+// Inline and byte-free variant of hash/fnv's fnv64a.
+
+const (
+	offset64 = 14695981039346656037
+	prime64  = 1099511628211
+)
+
+// hashNew initializes a new fnv64a hash value.
+func hashNew() uint64 {
+	return offset64
+}
+
+// hashAdd adds a string to a fnv64a hash value, returning the updated hash.
+func hashAdd(h uint64, s string) uint64 {
+	for i := 0; i < len(s); i++ {
+		h ^= uint64(s[i])
+		h *= prime64
+	}
+	return h
+}
+
+// hashAddByte adds a byte to a fnv64a hash value, returning the updated hash.
+func hashAddByte(h uint64, b byte) uint64 {
+	h ^= uint64(b)
+	h *= prime64
+	return h
+}
+
+// hashLabelPair hashes a single label name and value. The hashes of the
+// pairs of a series are summed, so the fnv64a hash is put through the
+// murmur3 finalizer first: similar pairs have fnv64a hashes which differ by
+// similar amounts, so their plain sums collide easily.
+func hashLabelPair(name, value string) uint64 {
+	h := hashNew()
+	h = hashAdd(h, name)
+	h = hashAddByte(h, model.SeparatorByte)
+	return hashMix(hashAdd(h, value))
+}
+
+// hashMix is the murmur3 64-bit finalizer, which makes every bit of h affect
+// every bit of the result.
+func hashMix(h uint64) uint64 {
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/log"
+	"github.com/wrouesnel/tail_exporter/config"
+)
+
+// listenForward binds the TCP socket of a Fluent Forward input, and starts
+// ingesting the records of every connection to it. Messages in Message,
+// Forward and PackedForward modes are accepted, and acknowledged if their
+// options ask for it.
+func (c *TailCollector) listenForward(cfg *config.InputConfig) error {
+	l, err := net.Listen("tcp", cfg.Address)
+	if err != nil {
+		return err
+	}
+
+	go c.acceptStream(l, cfg.Name, func(conn net.Conn, r io.Reader) error {
+		input := c.networkInput(cfg, conn.RemoteAddr())
+
+		decoder := newMsgpackDecoder(r)
+		for {
+			msg, err := decoder.Decode()
+			if err == io.EOF {
+				return nil
+			} else if isTimeout(err) {
+				return err
+			} else if err != nil {
+				// The stream can't be resynchronised after a bad value.
+				input.decodeErrors.Inc()
+				return fmt.Errorf("error decoding forward message from %s: %s", conn.RemoteAddr(), err)
+			}
+			if chunk := ingestForward(input, cfg.MessageKey, msg); chunk != "" {
+				if _, err := conn.Write(forwardAck(chunk)); err != nil {
+					return err
+				}
+			}
+		}
+	})
+	return nil
+}
+
+// ingestForward ingests the records of a forward message from input, taking
+// their lines from messageKey. It returns the chunk ID to acknowledge the
+// message with, if the message asked for one. Messages which can't be
+// ingested are still acknowledged, since resending them won't help.
+func ingestForward(input *LineInput, messageKey string, msg interface{}) string {
+	fields, ok := msg.([]interface{})
+	if !ok || len(fields) < 2 {
+		input.decodeErrors.Inc()
+		log.Debugln("Invalid forward message from", input.name, "is not an array of a tag and entries")
+		return ""
+	}
+
+	var options map[string]interface{}
+	var entries []interface{}
+	var err error
+	switch payload := fields[1].(type) {
+	case []interface{}:
+		// Forward mode: [tag, [[time, record], ...], options]
+		options = forwardOptions(fields, 2)
+		entries = payload
+	case string, []byte:
+		// PackedForward mode: [tag, msgpack stream of entries, options]
+		options = forwardOptions(fields, 2)
+		entries, err = packedEntries(payload, options)
+	default:
+		// Message mode: [tag, time, record, options]
+		options = forwardOptions(fields, 3)
+		if len(fields) < 3 {
+			err = errors.New("message has no record")
+		} else {
+			entries = []interface{}{fields[1:3]}
+		}
+	}
+	chunk, _ := options["chunk"].(string)
+
+	tag, ok := fields[0].(string)
+	if !ok {
+		err = errors.New("tag is not a string")
+	}
+	if err != nil {
+		input.decodeErrors.Inc()
+		log.Debugln("Invalid forward message from", input.name, err)
+		return chunk
+	}
+
+	for _, entry := range entries {
+		if err := ingestForwardEntry(input, messageKey, tag, entry); err != nil {
+			input.decodeErrors.Inc()
+			log.Debugln("Invalid forward entry from", input.name, err)
+		}
+	}
+	return chunk
+}
+
+// ingestForwardEntry ingests an entry of a forward message, which is an array
+// of its time and record. The record's other keys, the message tag and the
+// entry time are the line's metadata. Records without messageKey are skipped.
+func ingestForwardEntry(input *LineInput, messageKey string, tag string, entry interface{}) error {
+	fields, ok := entry.([]interface{})
+	if !ok || len(fields) < 2 {
+		return errors.New("entry is not an array of a time and record")
+	}
+	record, ok := fields[1].(map[string]interface{})
+	if !ok {
+		return errors.New("record is not a map")
+	}
+	line, ok := scalarString(record[messageKey])
+	if !ok {
+		return nil
+	}
+
+	meta := make(lineMetadata, len(record)+2)
+	recordMetadata(meta, "", record)
+	delete(meta, messageKey)
+	meta["tag"] = tag
+	if t, ok := forwardTime(fields[0]); ok {
+		meta["time"] = t.UTC().Format(time.RFC3339Nano)
+	}
+	input.IngestMessage(line, meta)
+	return nil
+}
+
+// forwardOptions returns the options of a forward message, which are its
+// field at idx if it has one.
+func forwardOptions(fields []interface{}, idx int) map[string]interface{} {
+	if len(fields) <= idx {
+		return nil
+	}
+	options, _ := fields[idx].(map[string]interface{})
+	return options
+}
+
+// packedEntries decodes the entries packed into a PackedForward message,
+// which may be gzip compressed.
+func packedEntries(payload interface{}, options map[string]interface{}) ([]interface{}, error) {
+	data, _ := scalarString(payload)
+	var r io.Reader = strings.NewReader(data)
+	switch options["compressed"] {
+	case nil, "text":
+	case "gzip":
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close() // nolint: errcheck
+		r = io.LimitReader(gz, msgpackMaxLength)
+	default:
+		return nil, fmt.Errorf("unsupported compression %v", options["compressed"])
+	}
+
+	var entries []interface{}
+	decoder := newMsgpackDecoder(r)
+	for {
+		entry, err := decoder.Decode()
+		if err == io.EOF {
+			return entries, nil
+		} else if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+}
+
+// forwardTime returns the time of a forward entry, which is either integer
+// seconds or an EventTime extension of seconds and nanoseconds.
+func forwardTime(v interface{}) (time.Time, bool) {
+	switch v := v.(type) {
+	case int64:
+		return time.Unix(v, 0), true
+	case uint64:
+		return time.Unix(int64(v), 0), true
+	case float64:
+		sec := math.Floor(v)
+		return time.Unix(int64(sec), int64((v-sec)*1e9)), true
+	case msgpackExt:
+		if v.Type == 0 && len(v.Data) == 8 {
+			return time.Unix(int64(binary.BigEndian.Uint32(v.Data)), int64(binary.BigEndian.Uint32(v.Data[4:]))), true
+		}
+	}
+	return time.Time{}, false
+}
+
+// forwardAck returns the response acknowledging the forward message with the
+// given chunk ID, which is the msgpack map {"ack": chunk}.
+func forwardAck(chunk string) []byte {
+	return appendMsgpackString([]byte{0x81, 0xa3, 'a', 'c', 'k'}, chunk)
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	dto "github.com/prometheus/client_model/go"
+)
+
+const forwardConfig = `
+inputs:
+- kind: forward
+  address: '%s'
+metric_configs:
+- name: hellos
+  help: hellos by tag, host and time
+  type: counter
+  regex: '^hello'
+  labels:
+  - name: tag
+    value: $__tag
+  - name: host
+    value: $__host
+  - name: time
+    value: $__time
+  value: +1
+`
+
+// packEntries returns entries packed as a PackedForward message's stream,
+// gzip compressed if compress is set.
+func packEntries(t *testing.T, compress bool, entries ...[]interface{}) string {
+	var buf bytes.Buffer
+	for _, entry := range entries {
+		buf.Write(packMsgpack(entry)) // nolint: errcheck
+	}
+	if !compress {
+		return buf.String()
+	}
+
+	var compressed bytes.Buffer
+	w := gzip.NewWriter(&compressed)
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return compressed.String()
+}
+
+// hellos returns the number of hellos counted for tag, host and time.
+func hellos(t *testing.T, c *TailCollector, tag, host, time string) float64 {
+	series := c.families[0].getSeries([]*dto.LabelPair{
+		{Name: proto.String("tag"), Value: proto.String(tag)},
+		{Name: proto.String("host"), Value: proto.String(host)},
+		{Name: proto.String("time"), Value: proto.String(time)},
+	})
+	if series == nil {
+		return 0
+	}
+	return series.Get()
+}
+
+func TestIngestForward(t *testing.T) {
+	eventTime := msgpackExt{Type: 0, Data: make([]byte, 8)}
+	binary.BigEndian.PutUint32(eventTime.Data, 1500000000)
+	binary.BigEndian.PutUint32(eventTime.Data[4:], 500)
+	record := map[string]interface{}{"log": "hello", "host": "web1"}
+
+	for _, tc := range []struct {
+		name    string
+		msg     interface{}
+		chunk   string // the message is acknowledged with
+		time    string // of its entries
+		entries float64
+		errors  float64
+	}{
+		{
+			name: "message",
+			msg:  []interface{}{"app", 1500000000, record},
+			time: "2017-07-14T02:40:00Z", entries: 1,
+		},
+		{
+			name: "message with event time and chunk",
+			msg:  []interface{}{"app", eventTime, record, map[string]interface{}{"chunk": "c1"}},
+			time: "2017-07-14T02:40:00.0000005Z", chunk: "c1", entries: 1,
+		},
+		{
+			name: "forward",
+			msg: []interface{}{"app", []interface{}{
+				[]interface{}{1500000000, record},
+				[]interface{}{1500000000, map[string]interface{}{"host": "web1"}},
+				[]interface{}{1500000000, record},
+			}, map[string]interface{}{"chunk": "c2"}},
+			time: "2017-07-14T02:40:00Z", chunk: "c2", entries: 2,
+		},
+		{
+			name: "packed forward",
+			msg: []interface{}{"app", packEntries(t, false,
+				[]interface{}{1500000000, record},
+				[]interface{}{1500000000, record},
+			)},
+			time: "2017-07-14T02:40:00Z", entries: 2,
+		},
+		{
+			name: "compressed packed forward",
+			msg: []interface{}{"app", []byte(packEntries(t, true,
+				[]interface{}{eventTime, record},
+				[]interface{}{eventTime, record},
+				[]interface{}{eventTime, record},
+			)), map[string]interface{}{"compressed": "gzip", "chunk": "c3"}},
+			time: "2017-07-14T02:40:00.0000005Z", chunk: "c3", entries: 3,
+		},
+		{
+			name:  "unsupported compression",
+			msg:   []interface{}{"app", "entries", map[string]interface{}{"compressed": "lz4", "chunk": "c4"}},
+			chunk: "c4", errors: 1,
+		},
+		{
+			name:  "truncated packed entries",
+			msg:   []interface{}{"app", packEntries(t, false, []interface{}{1500000000, record})[:10], map[string]interface{}{"chunk": "c5"}},
+			chunk: "c5", errors: 1,
+		},
+		{
+			name:   "invalid entries",
+			msg:    []interface{}{"app", []interface{}{"entry", []interface{}{1500000000, "record"}, []interface{}{1500000000, record}}},
+			time:   "2017-07-14T02:40:00Z",
+			errors: 2, entries: 1,
+		},
+		{name: "no record", msg: []interface{}{"app", 1500000000}, errors: 1},
+		{name: "tag not a string", msg: []interface{}{1, 1500000000, record}, errors: 1},
+		{name: "not an array", msg: map[string]interface{}{"app": record}, errors: 1},
+	} {
+		c := newTestCollector(t, fmt.Sprintf(forwardConfig, "127.0.0.1:0"))
+		input := c.networkInput(c.cfg.Inputs[0], &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 24224})
+
+		msg, err := newMsgpackDecoder(bytes.NewReader(packMsgpack(tc.msg))).Decode()
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if chunk := ingestForward(input, c.cfg.Inputs[0].MessageKey, msg); chunk != tc.chunk {
+			t.Errorf("%s: expected chunk %q, got %q", tc.name, tc.chunk, chunk)
+		}
+		c.Close()
+
+		if value := hellos(t, c, "app", "web1", tc.time); value != tc.entries {
+			t.Errorf("%s: expected %v entries, got %v", tc.name, tc.entries, value)
+		}
+		if value := readValue(t, c.inputDecodeErrors.WithLabelValues("forward")); value != tc.errors {
+			t.Errorf("%s: expected %v decode errors, got %v", tc.name, tc.errors, value)
+		}
+	}
+}
+
+func TestForwardAck(t *testing.T) {
+	ack, err := newMsgpackDecoder(bytes.NewReader(forwardAck("chunk-id"))).Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := map[string]interface{}{"ack": "chunk-id"}; !reflect.DeepEqual(ack, expected) {
+		t.Errorf("expected %v, got %v", expected, ack)
+	}
+}
+
+func TestForwardInput(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := l.Addr().String()
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	c := newTestCollector(t, fmt.Sprintf(forwardConfig, address))
+	if err := c.listenForward(c.cfg.Inputs[0]); err != nil {
+		t.Fatal(err)
+	}
+	record := map[string]interface{}{"log": "hello", "host": "web1"}
+
+	// Messages asking for an ack are acknowledged as they are ingested.
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close() // nolint: errcheck
+	if err := conn.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	acks := newMsgpackDecoder(conn)
+	for _, chunk := range []string{"c1", "c2"} {
+		msg := packMsgpack([]interface{}{"app", 1500000000, record, map[string]interface{}{"chunk": chunk}})
+		if _, err := conn.Write(msg); err != nil {
+			t.Fatal(err)
+		}
+		ack, err := acks.Decode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := map[string]interface{}{"ack": chunk}; !reflect.DeepEqual(ack, expected) {
+			t.Errorf("expected %v, got %v", expected, ack)
+		}
+	}
+
+	// The stream can't be resynchronised after a value which is too long
+	// or truncated, so the connection is closed.
+	for _, data := range [][]byte{
+		{0xdb, 0xff, 0xff, 0xff, 0xff},
+		packMsgpack([]interface{}{"app", 1500000000, record})[:12],
+	} {
+		conn, err := net.Dial("tcp", address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close() // nolint: errcheck
+		if _, err := conn.Write(data); err != nil {
+			t.Fatal(err)
+		}
+		if tcp, ok := conn.(*net.TCPConn); ok {
+			logErr(tcp.CloseWrite())
+		}
+		expectClosed(t, conn, "a connection sending an invalid value")
+	}
+
+	decodeErrors := c.inputDecodeErrors.WithLabelValues("forward")
+	poll(t, func() bool { return readValue(t, decodeErrors) >= 2 }, "expected 2 decode errors")
+	c.Close()
+
+	if value := hellos(t, c, "app", "web1", "2017-07-14T02:40:00Z"); value != 2 {
+		t.Errorf("expected 2 entries, got %v", value)
+	}
+	if value := readValue(t, decodeErrors); value != 2 {
+		t.Errorf("expected 2 decode errors, got %v", value)
+	}
+}
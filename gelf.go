@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/prometheus/common/log"
+	"github.com/wrouesnel/tail_exporter/config"
+)
+
+// GELF limits. Chunked messages must be complete within gelfChunkTimeout of
+// their first chunk arriving.
+const (
+	gelfChunkHeaderSize = 12
+	gelfMaxChunks       = 128
+	gelfMaxPending      = 4096
+	gelfChunkTimeout    = 5 * time.Second
+	gelfMaxMessageSize  = 1 << 20
+)
+
+// gelfChunkMagic starts every chunk of a chunked GELF message.
+var gelfChunkMagic = []byte{0x1e, 0x0f}
+
+// gelfPartial is a chunked GELF message being reassembled.
+type gelfPartial struct {
+	chunks   [][]byte
+	received int
+	expires  time.Time
+}
+
+// gelfChunks reassembles chunked GELF messages.
+type gelfChunks struct {
+	mtx     sync.Mutex
+	pending map[uint64]*gelfPartial
+}
+
+func newGELFChunks() *gelfChunks {
+	return &gelfChunks{pending: make(map[uint64]*gelfPartial)}
+}
+
+// add adds a chunk, which is a datagram starting with gelfChunkMagic, and
+// returns the message it completes, or nil if its message is incomplete.
+func (g *gelfChunks) add(chunk []byte) ([]byte, error) {
+	if len(chunk) < gelfChunkHeaderSize {
+		return nil, errors.New("truncated GELF chunk header")
+	}
+	id := binary.BigEndian.Uint64(chunk[2:10])
+	seq, count := int(chunk[10]), int(chunk[11])
+	if count == 0 || count > gelfMaxChunks || seq >= count {
+		return nil, fmt.Errorf("invalid GELF chunk %d of %d", seq, count)
+	}
+
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	partial, found := g.pending[id]
+	if !found {
+		if len(g.pending) >= gelfMaxPending {
+			return nil, errors.New("too many incomplete GELF messages")
+		}
+		partial = &gelfPartial{
+			chunks:  make([][]byte, count),
+			expires: time.Now().Add(gelfChunkTimeout),
+		}
+		g.pending[id] = partial
+	}
+	if len(partial.chunks) != count {
+		delete(g.pending, id)
+		return nil, errors.New("GELF chunks disagree on their count")
+	}
+	if partial.chunks[seq] != nil {
+		return nil, nil
+	}
+	// The datagram's buffer is reused, so the chunk must be copied.
+	partial.chunks[seq] = append([]byte(nil), chunk[gelfChunkHeaderSize:]...)
+	partial.received++
+	if partial.received < count {
+		return nil, nil
+	}
+
+	delete(g.pending, id)
+	return bytes.Join(partial.chunks, nil), nil
+}
+
+// expire drops incomplete messages whose time is up, returning how many.
+func (g *gelfChunks) expire(now time.Time) int {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	expired := 0
+	for id, partial := range g.pending {
+		if now.After(partial.expires) {
+			delete(g.pending, id)
+			expired++
+		}
+	}
+	return expired
+}
+
+// gelfDecompress returns the JSON of a GELF datagram, which may be zlib or
+// gzip compressed.
+func gelfDecompress(payload []byte) ([]byte, error) {
+	var r io.ReadCloser
+	var err error
+	switch {
+	case len(payload) >= 2 && payload[0] == 0x1f && payload[1] == 0x8b:
+		r, err = gzip.NewReader(bytes.NewReader(payload))
+	case len(payload) >= 2 && payload[0]&0x0f == 8 && (uint16(payload[0])<<8|uint16(payload[1]))%31 == 0:
+		r, err = zlib.NewReader(bytes.NewReader(payload))
+	default:
+		return payload, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close() // nolint: errcheck
+
+	data, err := ioutil.ReadAll(io.LimitReader(r, gelfMaxMessageSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > gelfMaxMessageSize {
+		return nil, errors.New("GELF message too large")
+	}
+	return data, nil
+}
+
+// parseGELF returns the short_message of a GELF message, and its other
+// fields as metadata.
+func parseGELF(data []byte) (string, lineMetadata, error) {
+	var fields map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&fields); err != nil {
+		return "", nil, fmt.Errorf("invalid GELF message: %v", err)
+	}
+	msg, ok := fields["short_message"].(string)
+	if !ok {
+		return "", nil, errors.New("invalid GELF message: no short_message")
+	}
+
+	meta := make(lineMetadata, len(fields))
+	for name, value := range fields {
+		if s, ok := scalarString(value); ok {
+			meta[name] = s
+		}
+	}
+	delete(meta, "short_message")
+	return msg, meta, nil
+}
+
+// ingestGELF ingests the GELF message in data from input.
+func ingestGELF(input *LineInput, data []byte) {
+	msg, meta, err := parseGELF(data)
+	if err != nil {
+		input.decodeErrors.Inc()
+		log.Debugln("Error decoding GELF message from", input.name, err)
+		return
+	}
+	input.IngestMessage(msg, meta)
+}
+
+// scanNulls is a bufio.SplitFunc splitting null terminated messages.
+func scanNulls(data []byte, atEOF bool) (int, []byte, error) {
+	if idx := bytes.IndexByte(data, 0); idx >= 0 {
+		return idx + 1, data[:idx], nil
+	}
+	if atEOF && len(data) > 0 {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+// listenGELF binds the TCP and UDP sockets of a GELF input, and starts
+// ingesting messages from them. UDP datagrams may be chunked and compressed,
+// while TCP messages are uncompressed and null terminated.
+func (c *TailCollector) listenGELF(cfg *config.InputConfig) error {
+	l, err := net.Listen("tcp", cfg.Address)
+	if err != nil {
+		return err
+	}
+	conn, err := net.ListenPacket("udp", cfg.Address)
+	if err != nil {
+		logErr(l.Close())
+		return err
+	}
+
+	go c.acceptStream(l, cfg.Name, func(conn net.Conn, r io.Reader) error {
+		input := c.networkInput(cfg, conn.RemoteAddr())
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(make([]byte, 0, 64*1024), gelfMaxMessageSize)
+		scanner.Split(scanNulls)
+		for scanner.Scan() {
+			if msg := bytes.TrimSpace(scanner.Bytes()); len(msg) > 0 {
+				ingestGELF(input, msg)
+			}
+		}
+		return scanner.Err()
+	})
+
+	chunks := newGELFChunks()
+	go func() {
+		decodeErrors := c.inputDecodeErrors.WithLabelValues(cfg.Name)
+		for now := range time.Tick(time.Second) {
+			if expired := chunks.expire(now); expired > 0 {
+				log.Debugln("Dropped", expired, "incomplete GELF messages on", cfg.Name)
+				decodeErrors.Add(float64(expired))
+			}
+		}
+	}()
+	go readPackets(conn, *collectorUDPWorkers, func(addr net.Addr, packet []byte) {
+		input := c.networkInput(cfg, addr)
+		if bytes.HasPrefix(packet, gelfChunkMagic) {
+			msg, err := chunks.add(packet)
+			if err != nil {
+				input.decodeErrors.Inc()
+				log.Debugln("Error reassembling GELF message from", addr, err)
+				return
+			}
+			if msg == nil {
+				return
+			}
+			packet = msg
+		}
+		data, err := gelfDecompress(packet)
+		if err != nil {
+			input.decodeErrors.Inc()
+			log.Debugln("Error decompressing GELF message from", addr, err)
+			return
+		}
+		ingestGELF(input, data)
+	})
+	return nil
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// gelfChunk returns chunk seq of count of the GELF message id.
+func gelfChunk(id uint64, seq, count int, data string) []byte {
+	chunk := append([]byte(nil), gelfChunkMagic...)
+	chunk = append(chunk, make([]byte, 8)...)
+	binary.BigEndian.PutUint64(chunk[2:], id)
+	return append(append(chunk, byte(seq), byte(count)), data...)
+}
+
+// compressGELF returns data gzip or zlib compressed.
+func compressGELF(t *testing.T, compression string, data string) []byte {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	if compression == "gzip" {
+		w = gzip.NewWriter(&buf)
+	} else {
+		w = zlib.NewWriter(&buf)
+	}
+	if _, err := w.Write([]byte(data)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestGELFChunks(t *testing.T) {
+	g := newGELFChunks()
+	expectPending := func(what string, pending int) {
+		if len(g.pending) != pending {
+			t.Errorf("%s: expected %d incomplete messages, got %d", what, pending, len(g.pending))
+		}
+	}
+
+	// Chunks are reassembled in sequence order whatever order they arrive
+	// in, and repeated chunks are ignored.
+	for i, chunk := range [][]byte{
+		gelfChunk(1, 2, 3, "baz"),
+		gelfChunk(1, 0, 3, "foo"),
+		gelfChunk(1, 0, 3, "xxx"),
+		gelfChunk(1, 2, 3, "xxx"),
+	} {
+		if msg, err := g.add(chunk); msg != nil || err != nil {
+			t.Fatalf("chunk %d: expected an incomplete message, got %q, %v", i, msg, err)
+		}
+	}
+	expectPending("out of order", 1)
+	msg, err := g.add(gelfChunk(1, 1, 3, "bar"))
+	if err != nil || string(msg) != "foobarbaz" {
+		t.Errorf("expected foobarbaz, got %q, %v", msg, err)
+	}
+	expectPending("complete", 0)
+
+	// The chunk's buffer can be reused once it is added.
+	chunk := gelfChunk(2, 0, 2, "foo")
+	if _, err := g.add(chunk); err != nil {
+		t.Fatal(err)
+	}
+	copy(chunk[gelfChunkHeaderSize:], "xxx")
+	if msg, err := g.add(gelfChunk(2, 1, 2, "bar")); err != nil || string(msg) != "foobar" {
+		t.Errorf("expected foobar from a reused buffer, got %q, %v", msg, err)
+	}
+
+	// Messages which aren't complete in time are dropped, so their late
+	// chunks start over.
+	start := time.Now()
+	if _, err := g.add(gelfChunk(3, 0, 2, "foo")); err != nil {
+		t.Fatal(err)
+	}
+	if expired := g.expire(start); expired != 0 {
+		t.Errorf("expected nothing to expire yet, got %d", expired)
+	}
+	if expired := g.expire(start.Add(gelfChunkTimeout + time.Second)); expired != 1 {
+		t.Errorf("expected 1 message to expire, got %d", expired)
+	}
+	if msg, err := g.add(gelfChunk(3, 1, 2, "bar")); msg != nil || err != nil {
+		t.Errorf("expected a late chunk to start a new message, got %q, %v", msg, err)
+	}
+	expectPending("late chunk", 1)
+	g.expire(start.Add(gelfChunkTimeout + time.Minute))
+
+	for _, tc := range []struct {
+		name  string
+		chunk []byte
+	}{
+		{"truncated", gelfChunk(4, 0, 2, "")[:gelfChunkHeaderSize-1]},
+		{"no chunks", gelfChunk(4, 0, 0, "foo")},
+		{"past the count", gelfChunk(4, 2, 2, "foo")},
+		{"too many chunks", gelfChunk(4, 0, gelfMaxChunks+1, "foo")},
+	} {
+		if _, err := g.add(tc.chunk); err == nil {
+			t.Errorf("%s: expected an error", tc.name)
+		}
+	}
+	expectPending("invalid", 0)
+
+	// Chunks disagreeing on their count drop the message.
+	if _, err := g.add(gelfChunk(5, 0, 2, "foo")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := g.add(gelfChunk(5, 1, 3, "bar")); err == nil {
+		t.Error("expected an error for a chunk with another count")
+	}
+	expectPending("disagreeing", 0)
+
+	for id := uint64(0); id < gelfMaxPending; id++ {
+		if _, err := g.add(gelfChunk(id, 0, 2, "foo")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := g.add(gelfChunk(gelfMaxPending, 0, 2, "foo")); err == nil {
+		t.Error("expected an error with too many incomplete messages")
+	}
+	if msg, err := g.add(gelfChunk(0, 1, 2, "bar")); err != nil || string(msg) != "foobar" {
+		t.Errorf("expected pending messages to still complete, got %q, %v", msg, err)
+	}
+}
+
+func TestGELFDecompress(t *testing.T) {
+	const msg = `{"short_message":"hello"}`
+	for _, tc := range []struct {
+		name    string
+		payload []byte
+		valid   bool
+	}{
+		{"uncompressed", []byte(msg), true},
+		{"gzip", compressGELF(t, "gzip", msg), true},
+		{"zlib", compressGELF(t, "zlib", msg), true},
+		{"truncated gzip", compressGELF(t, "gzip", msg)[:12], false},
+		{"too large", compressGELF(t, "gzip", strings.Repeat(" ", gelfMaxMessageSize+1)), false},
+	} {
+		data, err := gelfDecompress(tc.payload)
+		if !tc.valid {
+			if err == nil {
+				t.Errorf("%s: expected an error", tc.name)
+			}
+			continue
+		}
+		if err != nil || string(data) != msg {
+			t.Errorf("%s: expected %s, got %q, %v", tc.name, msg, data, err)
+		}
+	}
+}
+
+func TestScanNulls(t *testing.T) {
+	scanner := bufio.NewScanner(strings.NewReader("first\x00second\x00\x00last"))
+	scanner.Split(scanNulls)
+	var msgs []string
+	for scanner.Scan() {
+		msgs = append(msgs, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"first", "second", "", "last"}; !reflect.DeepEqual(msgs, expected) {
+		t.Errorf("expected %q, got %q", expected, msgs)
+	}
+}
+
+func TestGELFInput(t *testing.T) {
+	// Find a port for both the TCP and UDP listeners.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := l.Addr().String()
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	c := newTestCollector(t, fmt.Sprintf(`
+inputs:
+- kind: gelf
+  address: '%s'
+metric_configs:
+- name: hellos
+  help: hellos by host
+  type: counter
+  regex: '^hello'
+  labels:
+  - name: host
+    value: $__host
+  value: +1
+`, address))
+	if err := c.listenGELF(c.cfg.Inputs[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	// TCP messages are null terminated, apart from one ended by the
+	// connection closing.
+	sendLines(t, "tcp", address, `{"short_message":"hello","host":"tcp"}`+"\x00\x00"+
+		`{"short_message":"hello","host":"tcp"}`+"\x00"+
+		`{"short_message":"hello","host":"tcp"}`)
+
+	udp, err := net.Dial("udp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close() // nolint: errcheck
+	zlibbed := compressGELF(t, "zlib", `{"short_message":"hello","host":"udp"}`)
+	gzipped := compressGELF(t, "gzip", `{"short_message":"hello","host":"udp"}`)
+	half := len(gzipped) / 2
+	for _, packet := range [][]byte{
+		zlibbed,
+		gelfChunk(7, 1, 2, string(gzipped[half:])),
+		gelfChunk(7, 0, 2, string(gzipped[:half])),
+		[]byte(`{"host":"udp"}`),
+	} {
+		if _, err := udp.Write(packet); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	evaluated := c.evaluatedLines.WithLabelValues("hellos", "0")
+	decodeErrors := c.inputDecodeErrors.WithLabelValues("gelf")
+	poll(t, func() bool { return readValue(t, evaluated) >= 5 && readValue(t, decodeErrors) >= 1 },
+		"expected 5 messages and a decode error")
+	c.Close()
+
+	for host, hellos := range map[string]float64{"tcp": 3, "udp": 2} {
+		series := c.families[0].getSeries([]*dto.LabelPair{
+			{Name: proto.String("host"), Value: proto.String(host)},
+		})
+		if series == nil {
+			t.Errorf("%s: expected a series", host)
+		} else if value := series.Get(); value != hellos {
+			t.Errorf("%s: expected %v hellos, got %v", host, hellos, value)
+		}
+	}
+	if value := readValue(t, decodeErrors); value != 1 {
+		t.Errorf("expected 1 decode error, got %v", value)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+	"github.com/wrouesnel/tail_exporter/config"
+)
+
+// listenGraphite binds the TCP and UDP sockets of a graphite input, and
+// starts storing the samples sent to them. Samples are newline delimited on
+// both.
+func (c *TailCollector) listenGraphite(cfg *config.InputConfig) error {
+	l, err := net.Listen("tcp", cfg.Address)
+	if err != nil {
+		return err
+	}
+	conn, err := net.ListenPacket("udp", cfg.Address)
+	if err != nil {
+		logErr(l.Close())
+		return err
+	}
+	m := &mapper{c: c, cfg: cfg}
+
+	go c.acceptStream(l, cfg.Name, func(conn net.Conn, r io.Reader) error {
+		input := c.networkInput(cfg, conn.RemoteAddr())
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			m.ingestGraphite(input, scanner.Text())
+		}
+		return scanner.Err()
+	})
+	go readPackets(conn, *collectorUDPWorkers, func(addr net.Addr, packet []byte) {
+		input := c.networkInput(cfg, addr)
+		for _, line := range strings.Split(string(packet), "\n") {
+			m.ingestGraphite(input, line)
+		}
+	})
+	return nil
+}
+
+// ingestGraphite stores the sample of a graphite line received by input.
+func (m *mapper) ingestGraphite(input *LineInput, line string) {
+	line = strings.TrimSpace(line)
+	if line == "" || !input.admit(line) {
+		return
+	}
+	s, err := parseGraphite(line)
+	if err != nil {
+		input.decodeErrors.Inc()
+		log.Debugln("Invalid graphite line from", input.name, err)
+		return
+	}
+	m.store(input, s)
+}
+
+// parseGraphite parses a graphite plaintext line of the form
+// path value timestamp, where the path may carry tags as
+// path;name=value;... Samples are stored as gauges, and a timestamp of -1
+// means the sample has none.
+func parseGraphite(line string) (*mappedSample, error) {
+	fields := strings.Fields(line)
+	if len(fields) != 3 {
+		return nil, fmt.Errorf("line is not a path, value and timestamp: %q", line)
+	}
+
+	value, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid value %q", fields[1])
+	}
+	ts, err := strconv.ParseFloat(fields[2], 64)
+	if err != nil || (ts < 0 && ts != -1) {
+		return nil, fmt.Errorf("invalid timestamp %q", fields[2])
+	}
+
+	tags := strings.Split(fields[0], ";")
+	if tags[0] == "" {
+		return nil, fmt.Errorf("line has no metric path: %q", line)
+	}
+	s := &mappedSample{
+		name:  tags[0],
+		tags:  make(prometheus.Labels, len(tags)-1),
+		typ:   config.MetricGauge,
+		op:    sampleSet,
+		value: value,
+	}
+	for _, tag := range tags[1:] {
+		idx := strings.IndexByte(tag, '=')
+		if idx <= 0 {
+			return nil, fmt.Errorf("invalid tag %q", tag)
+		}
+		s.tags[escapeName(tag[:idx])] = tag[idx+1:]
+	}
+	if ts != -1 {
+		sec := math.Floor(ts)
+		s.timestamp = time.Unix(int64(sec), int64((ts-sec)*1e9))
+	}
+	return s, nil
+}
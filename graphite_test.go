@@ -0,0 +1,150 @@
+package main
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/wrouesnel/tail_exporter/config"
+)
+
+func TestParseGraphite(t *testing.T) {
+	gauge := func(name string, value float64, tags prometheus.Labels, timestamp time.Time) *mappedSample {
+		return &mappedSample{name: name, tags: tags, typ: config.MetricGauge, op: sampleSet, value: value, timestamp: timestamp}
+	}
+
+	for _, tc := range []struct {
+		line     string
+		expected *mappedSample // or nil if the line is invalid
+	}{
+		{"servers.web1.load 1.5 1500000000", gauge("servers.web1.load", 1.5, prometheus.Labels{}, time.Unix(1500000000, 0))},
+		{"servers.web1.load  1.5\t1500000000.25", gauge("servers.web1.load", 1.5, prometheus.Labels{}, time.Unix(1500000000, 250000000))},
+		{"servers.web1.load -2 -1", gauge("servers.web1.load", -2, prometheus.Labels{}, time.Time{})},
+		{"load;host=web1;dc=eu-west 3 -1", gauge("load", 3, prometheus.Labels{"host": "web1", "dc": "eu-west"}, time.Time{})},
+		{"load;data.center=a=b 3 -1", gauge("load", 3, prometheus.Labels{"data_center": "a=b"}, time.Time{})},
+		{"servers.web1.load 1.5 -2", nil},
+		{"servers.web1.load 1.5 now", nil},
+		{"servers.web1.load high 1500000000", nil},
+		{"servers.web1.load 1.5", nil},
+		{"servers.web1.load 1.5 1500000000 extra", nil},
+		{";host=web1 1.5 -1", nil},
+		{"load;host 1.5 -1", nil},
+		{"load;=web1 1.5 -1", nil},
+	} {
+		s, err := parseGraphite(tc.line)
+		if tc.expected == nil {
+			if err == nil {
+				t.Errorf("%q: expected an error, got %+v", tc.line, s)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", tc.line, err)
+		} else if !reflect.DeepEqual(s, tc.expected) {
+			t.Errorf("%q: expected %+v, got %+v", tc.line, tc.expected, s)
+		}
+	}
+}
+
+func TestGraphiteMappings(t *testing.T) {
+	c := newTestCollector(t, `
+inputs:
+- kind: graphite
+  address: :2003
+  mappings:
+  - match: "servers.*.cpu.*"
+    name: server_cpu_usage
+    help: CPU usage by server
+    labels:
+    - name: server
+      value: $1
+    - name: cpu
+      value: $2
+    - name: source
+      value: $__source_ip
+  - match: "servers.*.debug.*"
+    drop: true
+  - match: '^apps\.(\w+)\.(requests|errors)$'
+    match_type: regex
+    name: app_${2}
+    labels:
+    - name: app
+      value: $1
+`)
+	inputCfg := c.cfg.Inputs[0]
+	m := &mapper{c: c, cfg: inputCfg}
+	input := c.networkInput(inputCfg, &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 41000})
+
+	for _, line := range []string{
+		"servers.web1.cpu.0 25 -1",
+		"servers.web1.cpu.0 50 -1",
+		"servers.web2.cpu.1 75 1500000000",
+		"servers.web1.debug.gc 1 -1",
+		"apps.shop.requests 10 -1",
+		"apps.shop.errors 2 -1",
+		// Tags are labels too, unless a mapping gives the label a value,
+		// and must be consistent with the metric's first sample.
+		"servers.web3.cpu.0;server=other 5 -1",
+		"servers.web4.cpu.0;core=big 5 -1",
+		"web-3.disk.used;mount=/ 42 -1",
+		"invalid line",
+	} {
+		m.ingestGraphite(input, line)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		labels map[string]string
+		value  float64
+	}{
+		{"server_cpu_usage", map[string]string{"server": "web1", "cpu": "0", "source": "10.0.0.1"}, 50},
+		{"server_cpu_usage", map[string]string{"server": "web2", "cpu": "1", "source": "10.0.0.1"}, 75},
+		{"server_cpu_usage", map[string]string{"server": "web3", "cpu": "0", "source": "10.0.0.1"}, 5},
+		{"app_requests", map[string]string{"app": "shop"}, 10},
+		{"app_errors", map[string]string{"app": "shop"}, 2},
+		{"web_3_disk_used", map[string]string{"mount": "/"}, 42},
+	} {
+		family := c.getFamily(tc.name)
+		if family == nil {
+			t.Errorf("expected the %s family to be created", tc.name)
+			continue
+		}
+		var labels []*dto.LabelPair
+		for name, value := range tc.labels {
+			labels = append(labels, &dto.LabelPair{Name: proto.String(name), Value: proto.String(value)})
+		}
+		series := family.getSeries(labels)
+		if series == nil {
+			t.Errorf("%s: expected a series labelled %v", tc.name, tc.labels)
+		} else if value := series.Get(); value != tc.value {
+			t.Errorf("%s %v: expected %v, got %v", tc.name, tc.labels, tc.value, value)
+		}
+	}
+
+	if family := c.getFamily("server_cpu_usage"); family != nil {
+		if n := family.seriesLen(); n != 3 {
+			t.Errorf("expected 3 server_cpu_usage series, got %d", n)
+		}
+		series := family.getSeries([]*dto.LabelPair{
+			{Name: proto.String("cpu"), Value: proto.String("1")},
+			{Name: proto.String("server"), Value: proto.String("web2")},
+			{Name: proto.String("source"), Value: proto.String("10.0.0.1")},
+		})
+		if series != nil && !series.LoggedAt().Equal(time.Unix(1500000000, 0)) {
+			t.Errorf("expected the sample's timestamp, got %v", series.LoggedAt())
+		}
+	}
+	if family := c.getFamily("servers_web1_debug_gc"); family != nil {
+		t.Error("expected a dropped metric not to be stored")
+	}
+	if value := readValue(t, c.inputDecodeErrors.WithLabelValues("graphite")); value != 1 {
+		t.Errorf("expected 1 invalid line, got %v", value)
+	}
+	if value := readValue(t, c.rejectedSamples.WithLabelValues("graphite", "inconsistent_labels")); value != 1 {
+		t.Errorf("expected 1 inconsistent sample, got %v", value)
+	}
+}
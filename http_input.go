@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/common/log"
+)
+
+// httpLabelHeader carries metadata for the lines of an ingest request, as
+// name=value pairs which may be comma separated or repeated.
+const httpLabelHeader = "X-Tail-Exporter-Label"
+
+// errBodyTooLarge is returned for ingest requests over the size limit.
+var errBodyTooLarge = errors.New("request body too large")
+
+// ingestBatch is the lines of an ingest request, waiting to be ingested.
+type ingestBatch struct {
+	input *LineInput
+	lines []string
+}
+
+// httpIngester accepts lines POSTed to the web listener, queueing them to be
+// ingested so a slow rule can't hold requests open. When the queue is full
+// requests are refused with 429 Too Many Requests.
+type httpIngester struct {
+	c           *TailCollector
+	queue       chan ingestBatch
+	maxBodySize int64
+}
+
+func (c *TailCollector) newHTTPIngester(queueSize int, maxBodySize int64) *httpIngester {
+	return &httpIngester{
+		c:           c,
+		queue:       make(chan ingestBatch, queueSize),
+		maxBodySize: maxBodySize,
+	}
+}
+
+// Run ingests queued batches forever.
+func (h *httpIngester) Run() {
+	for batch := range h.queue {
+		for _, line := range batch.lines {
+			batch.input.IngestLine(line)
+		}
+	}
+}
+
+func (h *httpIngester) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	meta, err := requestMetadata(r)
+	if err != nil {
+		h.reject(w, http.StatusBadRequest, "bad_request", err)
+		return
+	}
+	lines, err := h.readLines(w, r)
+	if err == errBodyTooLarge {
+		h.reject(w, http.StatusRequestEntityTooLarge, "too_large", err)
+		return
+	} else if err != nil {
+		h.reject(w, http.StatusBadRequest, "bad_request", err)
+		return
+	}
+
+	input := h.c.Input("http").withMetadata(meta)
+	if addr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr); err == nil {
+		input.withMetadata(sourceMetadata(addr, h.c.resolver))
+		h.c.withSourceLimit(input, addr)
+	}
+
+	select {
+	case h.queue <- ingestBatch{input: input, lines: lines}:
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		w.Header().Set("Retry-After", "1")
+		h.reject(w, http.StatusTooManyRequests, "queue_full", errors.New("ingest queue is full"))
+	}
+}
+
+func (h *httpIngester) reject(w http.ResponseWriter, code int, reason string, err error) {
+	h.c.httpIngestRejected.WithLabelValues(reason).Inc()
+	log.Debugln("Rejecting ingest request:", err)
+	http.Error(w, err.Error(), code)
+}
+
+// readLines reads the lines of a request body, which is either a JSON array
+// of lines or newline delimited text, and may be gzip encoded.
+func (h *httpIngester) readLines(w http.ResponseWriter, r *http.Request) ([]string, error) {
+	var body io.Reader = http.MaxBytesReader(w, r.Body, h.maxBodySize)
+	switch strings.ToLower(r.Header.Get("Content-Encoding")) {
+	case "", "identity":
+	case "gzip":
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close() // nolint: errcheck
+		body = gz
+	default:
+		return nil, fmt.Errorf("unsupported content encoding %q", r.Header.Get("Content-Encoding"))
+	}
+	// Bound the decompressed size too, reading one byte over to notice it.
+	limited := &io.LimitedReader{R: body, N: h.maxBodySize + 1}
+
+	var lines []string
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "application/json" {
+		if err := json.NewDecoder(limited).Decode(&lines); err != nil {
+			return nil, bodyError(err, limited)
+		}
+		return lines, nil
+	}
+
+	scanner := bufio.NewScanner(limited)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, bodyError(err, limited)
+	}
+	if limited.N <= 0 {
+		return nil, errBodyTooLarge
+	}
+	return lines, nil
+}
+
+// bodyError returns errBodyTooLarge if reading the body failed because it was
+// too large, and err otherwise.
+func bodyError(err error, limited *io.LimitedReader) error {
+	if limited.N <= 0 || strings.Contains(err.Error(), "request body too large") {
+		return errBodyTooLarge
+	}
+	return err
+}
+
+// reservedRequestLabel reports whether name is metadata which an ingest
+// request can't give its lines, because it identifies where they came from.
+func reservedRequestLabel(name string) bool {
+	return name == "input" || strings.HasPrefix(name, "source_") || strings.HasPrefix(name, "tls_")
+}
+
+// requestMetadata returns the metadata an ingest request gives its lines,
+// from label query parameters and X-Tail-Exporter-Label headers.
+func requestMetadata(r *http.Request) (lineMetadata, error) {
+	var pairs []string
+	pairs = append(pairs, r.URL.Query()["label"]...)
+	for _, header := range r.Header[http.CanonicalHeaderKey(httpLabelHeader)] {
+		for _, pair := range strings.Split(header, ",") {
+			pairs = append(pairs, strings.TrimSpace(pair))
+		}
+	}
+
+	meta := make(lineMetadata, len(pairs))
+	for _, pair := range pairs {
+		idx := strings.Index(pair, "=")
+		if idx <= 0 {
+			return nil, fmt.Errorf("label %s is not of the form name=value", strconv.Quote(pair))
+		}
+		if reservedRequestLabel(pair[:idx]) {
+			return nil, fmt.Errorf("label %s is reserved", strconv.Quote(pair[:idx]))
+		}
+		meta[pair[:idx]] = pair[idx+1:]
+	}
+	return meta, nil
+}
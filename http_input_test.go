@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// gzipped returns s gzip compressed.
+func gzipped(t *testing.T, s string) string {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write([]byte(s)); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func TestHTTPIngest(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		method  string
+		target  string
+		headers map[string]string
+		body    string
+		full    bool // whether the queue is already full
+
+		code   int
+		reason string // of the rejection
+		lines  []string
+		meta   lineMetadata
+	}{
+		{
+			name: "text", method: "POST", target: "/ingest", body: "GET 200\nGET 404\n",
+			code: http.StatusAccepted, lines: []string{"GET 200", "GET 404"},
+		},
+		{
+			name: "json", method: "POST", target: "/ingest", body: `["GET 200", "GET\n404"]`,
+			headers: map[string]string{"Content-Type": "application/json; charset=utf-8"},
+			code:    http.StatusAccepted, lines: []string{"GET 200", "GET\n404"},
+		},
+		{
+			name: "gzip", method: "POST", target: "/ingest", body: gzipped(t, "GET 200\nGET 404"),
+			headers: map[string]string{"Content-Encoding": "gzip"},
+			code:    http.StatusAccepted, lines: []string{"GET 200", "GET 404"},
+		},
+		{
+			name: "gzip json", method: "POST", target: "/ingest", body: gzipped(t, `["GET 200"]`),
+			headers: map[string]string{"Content-Encoding": "gzip", "Content-Type": "application/json"},
+			code:    http.StatusAccepted, lines: []string{"GET 200"},
+		},
+		{
+			name: "labels", method: "POST", target: "/ingest?label=function=resize&label=region=a=b", body: "GET 200",
+			headers: map[string]string{httpLabelHeader: "team=images, stage=prod"},
+			code:    http.StatusAccepted, lines: []string{"GET 200"},
+			meta: lineMetadata{"function": "resize", "region": "a=b", "team": "images", "stage": "prod"},
+		},
+		{
+			name: "too large", method: "POST", target: "/ingest", body: strings.Repeat("GET 200\n", 8),
+			code: http.StatusRequestEntityTooLarge, reason: "too_large",
+		},
+		{
+			name: "too large json", method: "POST", target: "/ingest", body: `["` + strings.Repeat("GET 200 ", 8) + `"]`,
+			headers: map[string]string{"Content-Type": "application/json"},
+			code:    http.StatusRequestEntityTooLarge, reason: "too_large",
+		},
+		{
+			name: "too large decompressed", method: "POST", target: "/ingest", body: gzipped(t, strings.Repeat("GET 200\n", 8)),
+			headers: map[string]string{"Content-Encoding": "gzip"},
+			code:    http.StatusRequestEntityTooLarge, reason: "too_large",
+		},
+		{
+			name: "queue full", method: "POST", target: "/ingest", body: "GET 200", full: true,
+			code: http.StatusTooManyRequests, reason: "queue_full",
+		},
+		{
+			name: "reserved input", method: "POST", target: "/ingest?label=input=nginx", body: "GET 200",
+			code: http.StatusBadRequest, reason: "bad_request",
+		},
+		{
+			name: "reserved source", method: "POST", target: "/ingest", body: "GET 200",
+			headers: map[string]string{httpLabelHeader: "source_ip=10.0.0.1"},
+			code:    http.StatusBadRequest, reason: "bad_request",
+		},
+		{
+			name: "reserved tls", method: "POST", target: "/ingest?label=tls_client_cn=web1", body: "GET 200",
+			code: http.StatusBadRequest, reason: "bad_request",
+		},
+		{
+			name: "malformed label", method: "POST", target: "/ingest?label=function", body: "GET 200",
+			code: http.StatusBadRequest, reason: "bad_request",
+		},
+		{
+			name: "malformed json", method: "POST", target: "/ingest", body: `{"line": "GET 200"}`,
+			headers: map[string]string{"Content-Type": "application/json"},
+			code:    http.StatusBadRequest, reason: "bad_request",
+		},
+		{
+			name: "unknown encoding", method: "POST", target: "/ingest", body: "GET 200",
+			headers: map[string]string{"Content-Encoding": "br"},
+			code:    http.StatusBadRequest, reason: "bad_request",
+		},
+		{
+			name: "get", method: "GET", target: "/ingest",
+			code: http.StatusMethodNotAllowed,
+		},
+	} {
+		c := newTestCollector(t, "")
+		h := c.newHTTPIngester(1, 48)
+		if tc.full {
+			h.queue <- ingestBatch{}
+		}
+
+		r := httptest.NewRequest(tc.method, tc.target, strings.NewReader(tc.body))
+		r.RemoteAddr = "192.0.2.1:41000"
+		for name, value := range tc.headers {
+			r.Header.Set(name, value)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+
+		if w.Code != tc.code {
+			t.Errorf("%s: expected status %d, got %d: %s", tc.name, tc.code, w.Code, w.Body.String())
+		}
+		if tc.code == http.StatusTooManyRequests && w.Header().Get("Retry-After") == "" {
+			t.Errorf("%s: expected a Retry-After header", tc.name)
+		}
+		if tc.reason != "" {
+			if value := readValue(t, c.httpIngestRejected.WithLabelValues(tc.reason)); value != 1 {
+				t.Errorf("%s: expected 1 request rejected as %s, got %v", tc.name, tc.reason, value)
+			}
+		}
+
+		if tc.code != http.StatusAccepted || tc.full {
+			continue
+		}
+		batch := <-h.queue
+		if !reflect.DeepEqual(batch.lines, tc.lines) {
+			t.Errorf("%s: expected lines %q, got %q", tc.name, tc.lines, batch.lines)
+		}
+		meta := lineMetadata{"input": "http", "source_ip": "192.0.2.1", "source_port": "41000"}
+		for name, value := range tc.meta {
+			meta[name] = value
+		}
+		if !reflect.DeepEqual(batch.input.meta, meta) {
+			t.Errorf("%s: expected metadata %v, got %v", tc.name, meta, batch.input.meta)
+		}
+	}
+}
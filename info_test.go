@@ -0,0 +1,157 @@
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	dto "github.com/prometheus/client_model/go"
+)
+
+const infoConfig = `
+metric_configs:
+- name: app_build_info
+  help: build of each app
+  type: info
+  regex: '^deploy app=(\S+) version=(\S+)'
+  labels:
+  - name: app
+    value: $1
+  - name: version
+    value: $2
+  identity: [app]
+  timeout: 1m
+- name: app_last_seen_seconds
+  help: time each app last logged
+  type: gauge
+  regex: '^(\S+) seen app=(\S+)'
+  timestamp:
+    value: $1
+    format: 2006-01-02T15:04:05Z07:00
+  labels:
+  - name: app
+    value: $2
+  value: timestamp
+- name: app_last_processed_seconds
+  help: time each app's lines were last processed
+  type: gauge
+  regex: '^\S+ seen app=(\S+)'
+  labels:
+  - name: app
+    value: $1
+  value: now
+`
+
+// appLabels returns the label pairs of an app series, with its version if
+// it is given.
+func appLabels(app string, version ...string) []*dto.LabelPair {
+	labels := []*dto.LabelPair{{Name: proto.String("app"), Value: proto.String(app)}}
+	for _, v := range version {
+		labels = append(labels, &dto.LabelPair{Name: proto.String("version"), Value: proto.String(v)})
+	}
+	return labels
+}
+
+func TestInfoIdentity(t *testing.T) {
+	c := newTestCollector(t, infoConfig)
+	defer c.Close()
+	family := c.getFamily("app_build_info")
+	r := c.newRule(0, &c.cfg.MetricConfigs[0], family)
+	for _, line := range []string{
+		"deploy app=shop version=1.0",
+		"deploy app=cart version=2.0",
+		// A new version replaces the app's series.
+		"deploy app=shop version=1.1",
+		// As does going back to an earlier one.
+		"deploy app=cart version=2.1",
+		"deploy app=cart version=2.0",
+	} {
+		c.processLine(logLine{text: line}, r)
+	}
+
+	if n := family.seriesLen(); n != 2 {
+		t.Errorf("expected a series for each app, got %d", n)
+	}
+	for _, tc := range []struct {
+		app, version string
+		present      bool
+	}{
+		{"shop", "1.0", false},
+		{"shop", "1.1", true},
+		{"cart", "2.1", false},
+		{"cart", "2.0", true},
+	} {
+		series := family.getSeries(appLabels(tc.app, tc.version))
+		if !tc.present {
+			if series != nil {
+				t.Errorf("expected %s %s to be replaced", tc.app, tc.version)
+			}
+			continue
+		}
+		if series == nil {
+			t.Errorf("expected a series for %s %s", tc.app, tc.version)
+		} else if value := series.Get(); value != 1 {
+			t.Errorf("expected %s %s to be 1, got %v", tc.app, tc.version, value)
+		}
+	}
+
+	// An expired series no longer has its identity, so doesn't replace the
+	// next series of its app.
+	series := family.getSeries(appLabels("shop", "1.1"))
+	if series == nil {
+		t.Fatal("expected a series for shop 1.1")
+	}
+	atomic.StoreInt64(&series.lastUpdated, time.Now().Add(-2*time.Minute).UnixNano())
+	if !family.expireSeries(series) {
+		t.Fatal("expected shop 1.1 to expire")
+	}
+	c.processLine(logLine{text: "deploy app=shop version=1.2"}, r)
+	if family.getSeries(appLabels("shop", "1.2")) == nil || family.seriesLen() != 2 {
+		t.Errorf("expected shop 1.2 to replace only the expired series, got %d series", family.seriesLen())
+	}
+}
+
+func TestLastSeen(t *testing.T) {
+	c := newTestCollector(t, infoConfig)
+	defer c.Close()
+	seen := c.getFamily("app_last_seen_seconds")
+	processed := c.getFamily("app_last_processed_seconds")
+	seenRule := c.newRule(1, &c.cfg.MetricConfigs[1], seen)
+	processedRule := c.newRule(2, &c.cfg.MetricConfigs[2], processed)
+
+	before := time.Now()
+	for _, line := range []string{
+		"2017-07-14T02:40:00Z seen app=shop",
+		"2017-07-14T02:40:00.5Z seen app=cart",
+		"2017-07-14T02:41:00Z seen app=shop",
+		"yesterday seen app=shop",
+	} {
+		c.processLine(logLine{text: line}, seenRule)
+		c.processLine(logLine{text: line}, processedRule)
+	}
+	after := time.Now()
+
+	// The logged time is kept to a fraction of a second.
+	for app, expected := range map[string]float64{"shop": 1500000060, "cart": 1500000000.5} {
+		series := seen.getSeries(appLabels(app))
+		if series == nil {
+			t.Errorf("expected %s to have been seen", app)
+		} else if value := series.Get(); value != expected {
+			t.Errorf("expected %s to have been seen at %v, got %v", app, expected, value)
+		}
+	}
+	if value := readValue(t, c.rejectedLines.WithLabelValues("app_last_seen_seconds", "1", "unparseable_timestamp")); value != 1 {
+		t.Errorf("expected a line with an invalid timestamp to be rejected, got %v", value)
+	}
+
+	for _, app := range []string{"shop", "cart"} {
+		series := processed.getSeries(appLabels(app))
+		if series == nil {
+			t.Errorf("expected %s to have been processed", app)
+		} else if value := series.Get(); value < unixSeconds(before) || value > unixSeconds(after) {
+			t.Errorf("expected %s to have been processed between %v and %v, got %v",
+				app, unixSeconds(before), unixSeconds(after), value)
+		}
+	}
+}
@@ -0,0 +1,10 @@
+package main
+
+import (
+	"os"
+)
+
+// fileInode returns 0, as files have no inode numbers on Windows.
+func fileInode(st os.FileInfo) uint64 {
+	return 0
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"os"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+)
+
+// LineInput is a named source of lines for a TailCollector, which accounts
+// for the lines and bytes it ingests. It decodes the lines it ingests if they
+// aren't raw.
+type LineInput struct {
+	c             *TailCollector
+	name          string
+	meta          lineMetadata // metadata of every line
+	decoder       lineDecoder
+	ingestedLines prometheus.Counter
+	ingestedBytes prometheus.Counter
+	decodeErrors  prometheus.Counter
+
+	// limiter, if set, limits the rate of lines from source, counting
+	// lines over the limit in throttledLines.
+	limiter        *sourceLimiter
+	source         string
+	throttledLines prometheus.Counter
+}
+
+// Input returns the LineInput for the named source of lines.
+func (c *TailCollector) Input(name string) *LineInput {
+	return &LineInput{
+		c:             c,
+		name:          name,
+		meta:          lineMetadata{"input": name},
+		ingestedLines: c.inputLines.WithLabelValues(name),
+		ingestedBytes: c.inputBytes.WithLabelValues(name),
+		decodeErrors:  c.inputDecodeErrors.WithLabelValues(name),
+	}
+}
+
+// FileInput returns the LineInput for the named file, whose lines are in the
+// given format and have the given metadata. Container log files also have
+// metadata derived from their path.
+func (c *TailCollector) FileInput(filename string, format string, meta lineMetadata) *LineInput {
+	return c.Input(filename).withMetadata(meta).withMetadata(containerLogMetadata(filename)).withFormat(format)
+}
+
+// withMetadata adds meta to the metadata every line of the input has.
+func (i *LineInput) withMetadata(meta lineMetadata) *LineInput {
+	for name, value := range meta {
+		i.meta[name] = value
+	}
+	return i
+}
+
+// withFormat sets the format of the input's lines. It must be called after
+// any metadata is added.
+func (i *LineInput) withFormat(format string) *LineInput {
+	i.decoder = newLineDecoder(format, i.meta)
+	return i
+}
+
+// admit accounts for a line from the input, returning false if it is over
+// the rate limit of its source.
+func (i *LineInput) admit(line string) bool {
+	if i.limiter != nil && !i.limiter.allow(i.source) {
+		i.throttledLines.Inc()
+		return false
+	}
+	i.ingestedLines.Inc()
+	i.ingestedBytes.Add(float64(len(line)))
+	return true
+}
+
+// IngestLine consumes a line from the input.
+func (i *LineInput) IngestLine(line string) {
+	if !i.admit(line) {
+		return
+	}
+	if i.decoder == nil {
+		i.c.IngestLine(line, i.meta)
+		return
+	}
+
+	msg, meta, complete, err := i.decoder.Decode(line)
+	if err != nil {
+		i.decodeErrors.Inc()
+		log.Debugln("Error decoding line from", i.name, err)
+		return
+	}
+	if complete {
+		i.c.IngestLine(msg, meta)
+	}
+}
+
+// IngestMessage consumes a message which arrived with its own metadata,
+// rather than as a line to be decoded. The input's own metadata takes
+// precedence, so a message can't claim to be from another source.
+func (i *LineInput) IngestMessage(msg string, meta lineMetadata) {
+	if !i.admit(msg) {
+		return
+	}
+	msgMeta := make(lineMetadata, len(meta)+len(i.meta))
+	for name, value := range meta {
+		msgMeta[name] = value
+	}
+	for name, value := range i.meta {
+		msgMeta[name] = value
+	}
+	i.c.IngestLine(msg, msgMeta)
+}
+
+// Reads until the current connection is closed, returning any error which
+// ended reading early.
+func (i *LineInput) processReader(reader io.Reader) error {
+	if _, ok := i.decoder.(*journalDecoder); ok {
+		return i.processRawLines(reader)
+	}
+	lineScanner := bufio.NewScanner(reader)
+	for {
+		if ok := lineScanner.Scan(); !ok {
+			break
+		}
+		i.IngestLine(lineScanner.Text())
+	}
+	return lineScanner.Err()
+}
+
+// processRawLines reads like processReader, but splits lines only at
+// newlines, keeping any carriage returns and without limiting their length,
+// so the binary fields of journal entries keep their exact bytes.
+func (i *LineInput) processRawLines(reader io.Reader) error {
+	r := bufio.NewReader(reader)
+	for {
+		line, err := r.ReadString('\n')
+		if err == nil {
+			i.IngestLine(line[:len(line)-1])
+			continue
+		}
+		if line != "" {
+			i.IngestLine(line)
+		}
+		if err == io.EOF {
+			return nil
+		}
+		return err
+	}
+}
+
+// processFile ingests every line of the named file, decompressing it if it
+// is compressed.
+func (i *LineInput) processFile(filename string) error {
+	f, err := openLogFile(filename)
+	if err != nil {
+		return err
+	}
+	if err := i.processReader(f); err != nil {
+		logErr(f.Close())
+		return err
+	}
+	return f.Close()
+}
+
+// processFile ingests every line of the named file, or of stdin for "-",
+// decoding them from format.
+func processFile(c *TailCollector, filename string, format string) error {
+	if filename == "-" {
+		return c.Input("stdin").withFormat(format).processReader(os.Stdin)
+	}
+	return c.FileInput(filename, format, nil).processFile(filename)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// journalMessageField is the journal field holding the logged message.
+const journalMessageField = "MESSAGE"
+
+// journalDecoder decodes systemd journal entries in the journal export
+// format. Each field of an entry is a NAME=value line, and an empty line ends
+// the entry. Fields which aren't text are written as their name on a line
+// followed by a little endian 64 bit length, the value and a newline, so span
+// as many lines as the value has newlines.
+//
+// Decode returns an entry's MESSAGE once the entry is complete, with its
+// fields as metadata. Entries without a MESSAGE are skipped. Lines must only
+// be split at newlines, with nothing else removed, for binary fields to be
+// reassembled exactly.
+type journalDecoder struct {
+	meta lineMetadata
+
+	// fields of the entry being read, and their total size
+	fields lineMetadata
+	size   int
+	// binaryName is the name of the binary field being read, if any, and
+	// binary what has been read of its length and value.
+	binaryName string
+	binary     []byte
+	// skip is set after an invalid entry until the line ending it.
+	skip bool
+}
+
+func newJournalDecoder(meta lineMetadata) *journalDecoder {
+	return &journalDecoder{meta: meta}
+}
+
+// reset discards the entry being read.
+func (d *journalDecoder) reset() {
+	d.fields, d.size = nil, 0
+	d.binaryName, d.binary = "", nil
+}
+
+// invalid discards the invalid entry being read, skipping the rest of it.
+func (d *journalDecoder) invalid(format string, args ...interface{}) error {
+	d.reset()
+	d.skip = true
+	return fmt.Errorf("invalid journal entry: "+format, args...)
+}
+
+func (d *journalDecoder) setField(name string, value string) error {
+	d.size += len(name) + len(value)
+	if d.size > maxPartialSize {
+		return d.invalid("entry too large")
+	}
+	if d.fields == nil {
+		d.fields = make(lineMetadata, len(d.meta)+16)
+		for name, value := range d.meta {
+			d.fields[name] = value
+		}
+	}
+	d.fields[name] = value
+	return nil
+}
+
+func (d *journalDecoder) Decode(line string) (string, lineMetadata, bool, error) {
+	if d.skip {
+		d.skip = line != ""
+		return "", nil, false, nil
+	}
+	if d.binaryName != "" {
+		return "", nil, false, d.decodeBinary(line)
+	}
+
+	if line == "" {
+		fields := d.fields
+		d.reset()
+		msg, found := fields[journalMessageField]
+		if !found {
+			return "", nil, false, nil
+		}
+		return msg, fields, true, nil
+	}
+
+	idx := strings.IndexByte(line, '=')
+	if idx < 0 {
+		d.binaryName = line
+		return "", nil, false, nil
+	}
+	return "", nil, false, d.setField(line[:idx], line[idx+1:])
+}
+
+// decodeBinary reads line as part of the length and value of a binary field.
+func (d *journalDecoder) decodeBinary(line string) error {
+	d.binary = append(d.binary, line...)
+	if len(d.binary) < 8 {
+		// The line was split at a newline in the length.
+		d.binary = append(d.binary, '\n')
+		return nil
+	}
+
+	size := binary.LittleEndian.Uint64(d.binary)
+	read := uint64(len(d.binary) - 8)
+	switch {
+	case size > maxPartialSize:
+		return d.invalid("field %s too large", d.binaryName)
+	case read < size:
+		// The line was split at a newline in the value.
+		d.binary = append(d.binary, '\n')
+		return nil
+	case read > size:
+		return d.invalid("field %s longer than its length", d.binaryName)
+	}
+
+	name, value := d.binaryName, string(d.binary[8:])
+	d.binaryName, d.binary = "", nil
+	return d.setField(name, value)
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/wrouesnel/tail_exporter/config"
+)
+
+func TestJournalDecoder(t *testing.T) {
+	type entry struct {
+		msg    string
+		fields lineMetadata
+	}
+	cases := []struct {
+		fixture string
+		entries []entry
+		errors  int
+	}{
+		{
+			fixture: "journal_text.export",
+			entries: []entry{
+				{"GET /index.html 200", lineMetadata{
+					"__CURSOR":             "s=1;i=1",
+					"__REALTIME_TIMESTAMP": "1700000000000000",
+					"_SYSTEMD_UNIT":        "nginx.service",
+					"PRIORITY":             "6",
+				}},
+				// Only the first = separates the name from the value.
+				{"Accepted publickey = for root", lineMetadata{
+					"__CURSOR":      "s=1;i=2",
+					"_SYSTEMD_UNIT": "sshd.service",
+				}},
+			},
+		},
+		{
+			fixture: "journal_binary.export",
+			entries: []entry{
+				{"first line\nsecond line", lineMetadata{
+					"_SYSTEMD_UNIT": "app.service",
+					// The length of this value contains a newline.
+					"TRACE": "0123456\n89",
+				}},
+				{"ends with newline\n", lineMetadata{}},
+			},
+		},
+		{
+			fixture: "journal_no_message.export",
+			entries: []entry{
+				{"job started", lineMetadata{"_SYSTEMD_UNIT": "cron.service"}},
+			},
+		},
+		{
+			// The truncated entry and the entry its field swallowed are
+			// dropped, and an entry which never ends isn't returned.
+			fixture: "journal_truncated.export",
+			entries: []entry{
+				{"after the truncated entry", lineMetadata{"_SYSTEMD_UNIT": "c.service"}},
+			},
+			errors: 1,
+		},
+	}
+
+	for _, tc := range cases {
+		content, err := ioutil.ReadFile(filepath.Join("testdata", tc.fixture))
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Split(string(content), "\n")
+		if lines[len(lines)-1] == "" {
+			lines = lines[:len(lines)-1]
+		}
+
+		d := newJournalDecoder(lineMetadata{"input": "journal"})
+		var entries []entry
+		errors := 0
+		for _, line := range lines {
+			msg, meta, complete, err := d.Decode(line)
+			if err != nil {
+				errors++
+				continue
+			}
+			if complete {
+				entries = append(entries, entry{msg, meta})
+			}
+		}
+
+		if errors != tc.errors {
+			t.Errorf("%s: expected %d errors, got %d", tc.fixture, tc.errors, errors)
+		}
+		if len(entries) != len(tc.entries) {
+			t.Errorf("%s: expected %d entries, got %d: %v", tc.fixture, len(tc.entries), len(entries), entries)
+			continue
+		}
+		for idx, expected := range tc.entries {
+			got := entries[idx]
+			if got.msg != expected.msg {
+				t.Errorf("%s: entry %d: expected message %q, got %q", tc.fixture, idx, expected.msg, got.msg)
+			}
+			if got.fields["input"] != "journal" || got.fields[journalMessageField] != expected.msg {
+				t.Errorf("%s: entry %d: missing input metadata or message field: %v", tc.fixture, idx, got.fields)
+			}
+			for name, value := range expected.fields {
+				if got.fields[name] != value {
+					t.Errorf("%s: entry %d: expected field %s=%q, got %q", tc.fixture, idx, name, value, got.fields[name])
+				}
+			}
+		}
+	}
+}
+
+func TestJournalReaderKeepsRawBytes(t *testing.T) {
+	c := newTestCollector(t, `
+metric_configs:
+- name: journal_entries
+  help: journal entries
+  regex: '^entry'
+  labels:
+  - name: trace
+    value: $__TRACE
+  value: +1
+`)
+	var export bytes.Buffer
+	binaryField := func(name string, value string) {
+		export.WriteString(name + "\n")
+		if err := binary.Write(&export, binary.LittleEndian, uint64(len(value))); err != nil {
+			t.Fatal(err)
+		}
+		export.WriteString(value + "\n")
+	}
+	crlf := "first\r\nsecond\r\n"
+	// The length of this value is 0x0a0d, so contains a carriage return
+	// followed by a newline.
+	long := strings.Repeat("x", 0x0a0d)
+	export.WriteString("MESSAGE=entry one\r\n")
+	binaryField("TRACE", crlf)
+	export.WriteString("\n")
+	export.WriteString("MESSAGE=entry two\n")
+	binaryField("TRACE", long)
+	export.WriteString("\n")
+
+	input := c.Input("journal").withFormat(config.FormatJournal)
+	if err := input.processReader(&export); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	if value := readValue(t, input.decodeErrors); value != 0 {
+		t.Errorf("expected no decode errors, got %v", value)
+	}
+	for _, trace := range []string{crlf, long} {
+		metric := c.families[0].getSeries([]*dto.LabelPair{
+			{Name: proto.String("trace"), Value: proto.String(trace)},
+		})
+		if metric == nil || metric.Get() != 1 {
+			t.Errorf("expected an entry with a %d byte trace field", len(trace))
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/hpcloud/tail/ratelimiter"
+)
+
+// sourceLimiter limits the rate of lines from each source address with a
+// leaky bucket per source.
+type sourceLimiter struct {
+	size         uint16
+	leakInterval time.Duration
+
+	mtx     sync.Mutex
+	buckets map[string]*ratelimiter.LeakyBucket
+}
+
+// newSourceLimiter returns a limiter allowing each source rate lines per
+// second on average, in bursts of up to burst lines.
+func newSourceLimiter(rate float64, burst uint16) *sourceLimiter {
+	return &sourceLimiter{
+		size:         burst,
+		leakInterval: time.Duration(float64(time.Second) / rate),
+		buckets:      make(map[string]*ratelimiter.LeakyBucket),
+	}
+}
+
+// allow reports whether another line from source is within its limit.
+func (l *sourceLimiter) allow(source string) bool {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	bucket, found := l.buckets[source]
+	if !found {
+		// Drained buckets are the same as new ones, so drop them all now
+		// and then to bound the map to recent sources.
+		if len(l.buckets) > 4096 {
+			for source, bucket := range l.buckets {
+				if bucket.TimeToDrain() <= 0 {
+					delete(l.buckets, source)
+				}
+			}
+		}
+		bucket = ratelimiter.NewLeakyBucket(l.size, l.leakInterval)
+		l.buckets[source] = bucket
+	}
+	return bucket.Pour(1)
+}
+
+// idleTimeoutConn is a connection whose reads time out if nothing is
+// received for timeout.
+type idleTimeoutConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c idleTimeoutConn) Read(b []byte) (int, error) {
+	if err := c.Conn.SetReadDeadline(time.Now().Add(c.timeout)); err != nil {
+		return 0, err
+	}
+	return c.Conn.Read(b)
+}
+
+// isTimeout reports whether err is a network timeout.
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+const limitsConfig = `
+metric_configs:
+- name: hellos
+  help: hellos by input
+  type: counter
+  regex: '^hello'
+  labels:
+  - name: input
+    value: $__input
+  value: +1
+`
+
+// serveTCP serves a TCP listener as the named input of c, returning its
+// address. Lines are rate limited if c has a limiter.
+func serveTCP(t *testing.T, c *TailCollector, name string) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go c.serveStream(l, name, func(conn net.Conn) (*LineInput, error) {
+		return c.withSourceLimit(c.Input(name), conn.RemoteAddr()), nil
+	})
+	return l.Addr().String()
+}
+
+// expectClosed fails unless the server closes conn.
+func expectClosed(t *testing.T, conn net.Conn, what string) {
+	if err := conn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("expected %s to be closed, got %v", what, err)
+	}
+}
+
+func TestSourceLimiter(t *testing.T) {
+	l := newSourceLimiter(1, 3)
+	for i := 0; i < 3; i++ {
+		if !l.allow("10.0.0.1") {
+			t.Fatalf("expected line %d of the burst to be allowed", i)
+		}
+	}
+	if l.allow("10.0.0.1") {
+		t.Error("expected a line over the burst to be limited")
+	}
+	if !l.allow("10.0.0.2") {
+		t.Error("expected another source to have its own limit")
+	}
+
+	// Two seconds leak two lines out of the bucket.
+	later := time.Now().Add(2 * time.Second)
+	l.buckets["10.0.0.1"].Now = func() time.Time { return later }
+	for i := 0; i < 2; i++ {
+		if !l.allow("10.0.0.1") {
+			t.Fatalf("expected line %d to be allowed once the bucket leaked", i)
+		}
+	}
+	if l.allow("10.0.0.1") {
+		t.Error("expected the source to be limited again")
+	}
+}
+
+func TestConnectionLimits(t *testing.T) {
+	defer func(maxConns int, idleTimeout time.Duration) {
+		*collectorMaxConns, *collectorIdleTimeout = maxConns, idleTimeout
+	}(*collectorMaxConns, *collectorIdleTimeout)
+	*collectorMaxConns = 1
+	*collectorIdleTimeout = 200 * time.Millisecond
+
+	c := newTestCollector(t, limitsConfig)
+	address := serveTCP(t, c, "limited")
+	evaluated := c.evaluatedLines.WithLabelValues("hellos", "0")
+	active := c.activeConnections.WithLabelValues("limited")
+	rejected := c.rejectedConnections.WithLabelValues("limited")
+
+	// A connection sending lines more often than the idle timeout is kept
+	// open, however long it lasts, and holds the only slot.
+	first, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close() // nolint: errcheck
+	for i := 0; i < 10; i++ {
+		if _, err := first.Write([]byte("hello\n")); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	poll(t, func() bool { return readValue(t, evaluated) >= 10 }, "expected 10 lines from the first connection")
+
+	second, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close() // nolint: errcheck
+	expectClosed(t, second, "a connection over the limit")
+	if value := readValue(t, rejected); value != 1 {
+		t.Errorf("expected 1 rejected connection, got %v", value)
+	}
+	if value := readValue(t, active); value != 1 {
+		t.Errorf("expected 1 active connection, got %v", value)
+	}
+
+	// Once idle, the first connection is closed, freeing its slot.
+	expectClosed(t, first, "an idle connection")
+	poll(t, func() bool { return readValue(t, active) == 0 }, "expected the idle connection to be released")
+	sendLines(t, "tcp", address, "hello")
+	poll(t, func() bool { return readValue(t, evaluated) >= 11 }, "expected a line from a connection after the idle one")
+	c.Close()
+
+	if value := readValue(t, evaluated); value != 11 {
+		t.Errorf("expected 11 lines, got %v", value)
+	}
+	if value := readValue(t, rejected); value != 1 {
+		t.Errorf("expected 1 rejected connection, got %v", value)
+	}
+}
+
+func TestSourceRateLimit(t *testing.T) {
+	c := newTestCollector(t, limitsConfig)
+	// Lines leak out far too slowly for the test to notice.
+	c.limiter = newSourceLimiter(0.001, 3)
+	address := serveTCP(t, c, "throttled")
+	ingested := c.inputLines.WithLabelValues("throttled")
+	throttled := c.throttledLines.WithLabelValues("throttled")
+	evaluated := c.evaluatedLines.WithLabelValues("hellos", "0")
+
+	// The limit is per source rather than per connection.
+	sendLines(t, "tcp", address, "hello", "hello")
+	sendLines(t, "tcp", address, "hello", "hello", "hello")
+	poll(t, func() bool { return readValue(t, throttled) >= 2 && readValue(t, evaluated) >= 3 }, "expected 2 lines to be throttled")
+	c.Close()
+
+	if value := readValue(t, ingested); value != 3 {
+		t.Errorf("expected 3 lines within the limit, got %v", value)
+	}
+	if value := readValue(t, throttled); value != 2 {
+		t.Errorf("expected 2 throttled lines, got %v", value)
+	}
+	if value := readValue(t, evaluated); value != 3 {
+		t.Errorf("expected 3 lines to be evaluated, got %v", value)
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/common/log"
+	"github.com/wrouesnel/tail_exporter/config"
+)
+
+// packetBuffers are reused to read datagrams into.
+var packetBuffers = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, 65536)
+		return &buf
+	},
+}
+
+// serveStream ingests lines from every connection accepted by l, each with
+// the input newInput returns for it.
+func (c *TailCollector) serveStream(l net.Listener, name string, newInput func(conn net.Conn) (*LineInput, error)) {
+	c.acceptStream(l, name, func(conn net.Conn, r io.Reader) error {
+		input, err := newInput(conn)
+		if err != nil {
+			return fmt.Errorf("error setting up connection from %s: %s", conn.RemoteAddr(), err)
+		}
+		return input.processReader(r)
+	})
+}
+
+// acceptStream calls serve for every connection accepted by l, with a reader
+// of the connection. At most collector.max-connections are served at once,
+// and connections idle for collector.idle-timeout are closed.
+func (c *TailCollector) acceptStream(l net.Listener, name string, serve func(conn net.Conn, r io.Reader) error) {
+	activeConnections := c.activeConnections.WithLabelValues(name)
+	rejectedConnections := c.rejectedConnections.WithLabelValues(name)
+	var slots chan struct{}
+	if *collectorMaxConns > 0 {
+		slots = make(chan struct{}, *collectorMaxConns)
+	}
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			log.Errorf("Error accepting connection on %s: %s", l.Addr(), err)
+			continue
+		}
+		if slots != nil {
+			select {
+			case slots <- struct{}{}:
+			default:
+				log.Warnf("Rejecting connection from %s: too many connections", conn.RemoteAddr())
+				rejectedConnections.Inc()
+				logErr(conn.Close())
+				continue
+			}
+		}
+
+		activeConnections.Inc()
+		go func() {
+			defer func() {
+				logErr(conn.Close())
+				activeConnections.Dec()
+				if slots != nil {
+					<-slots
+				}
+			}()
+
+			var reader io.Reader = conn
+			if *collectorIdleTimeout > 0 {
+				// The deadline also bounds the TLS handshake.
+				logErr(conn.SetReadDeadline(time.Now().Add(*collectorIdleTimeout)))
+				reader = idleTimeoutConn{conn, *collectorIdleTimeout}
+			}
+			if err := serve(conn, reader); isTimeout(err) {
+				log.Debugln("Closing idle connection from", conn.RemoteAddr())
+			} else {
+				logErr(err)
+			}
+		}()
+	}
+}
+
+// servePackets ingests the lines of every datagram read from conn, with the
+// input newInput returns for its source. Up to workers datagrams are
+// processed at once, so inputs with stateful decoders must have one worker.
+func (c *TailCollector) servePackets(conn net.PacketConn, workers int, newInput func(addr net.Addr) *LineInput) {
+	readPackets(conn, workers, func(addr net.Addr, packet []byte) {
+		logErr(newInput(addr).processReader(bytes.NewReader(packet)))
+	})
+}
+
+// readPackets calls handle for every datagram read from conn, with up to
+// workers datagrams handled at once. The datagram is only valid until handle
+// returns.
+func readPackets(conn net.PacketConn, workers int, handle func(addr net.Addr, packet []byte)) {
+	slots := make(chan struct{}, workers)
+	for {
+		buf := packetBuffers.Get().(*[]byte)
+		n, srcAddress, err := conn.ReadFrom(*buf)
+		if err != nil {
+			packetBuffers.Put(buf)
+			log.Errorf("Error reading packet from %v on %s: %s", srcAddress, conn.LocalAddr(), err)
+			continue
+		}
+
+		slots <- struct{}{}
+		go func() {
+			defer func() {
+				packetBuffers.Put(buf)
+				<-slots
+			}()
+			handle(srcAddress, (*buf)[:n])
+		}()
+	}
+}
+
+// networkInput returns the input of lines a network protocol input received
+// from addr, which have the input's labels and the source metadata of addr,
+// and are rate limited by addr.
+func (c *TailCollector) networkInput(cfg *config.InputConfig, addr net.Addr) *LineInput {
+	input := c.Input(cfg.Name).withMetadata(cfg.Labels).withMetadata(sourceMetadata(addr, c.resolver))
+	return c.withSourceLimit(input, addr)
+}
+
+// withSourceLimit rate limits the lines of input from the source at addr,
+// if rate limiting is enabled.
+func (c *TailCollector) withSourceLimit(input *LineInput, addr net.Addr) *LineInput {
+	if c.limiter == nil {
+		return input
+	}
+	if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+		input.limiter, input.source = c.limiter, host
+		input.throttledLines = c.throttledLines.WithLabelValues(input.name)
+	}
+	return input
+}
+
+// listenTCP binds the TCP collector, which is wrapped in TLS if tlsConfig is
+// set, and starts ingesting lines from it. Lines have the metadata of the
+// connection they arrived on.
+func (c *TailCollector) listenTCP(address string, tlsConfig *tls.Config) error {
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	if tlsConfig != nil {
+		l = tls.NewListener(l, tlsConfig)
+	}
+
+	go c.serveStream(l, "tcp", func(conn net.Conn) (*LineInput, error) {
+		input := c.Input("tcp").withMetadata(sourceMetadata(conn.RemoteAddr(), c.resolver))
+		c.withSourceLimit(input, conn.RemoteAddr())
+		if tlsConn, ok := conn.(*tls.Conn); ok {
+			meta, err := tlsClientMetadata(tlsConn)
+			if err != nil {
+				return nil, err
+			}
+			input.withMetadata(meta)
+		}
+		return input, nil
+	})
+	return nil
+}
+
+// listenUDP binds the UDP collector and starts ingesting lines from it.
+// Lines have the metadata of the address they were sent from.
+func (c *TailCollector) listenUDP(address string) error {
+	conn, err := net.ListenPacket("udp", address)
+	if err != nil {
+		return err
+	}
+	go c.servePackets(conn, *collectorUDPWorkers, func(addr net.Addr) *LineInput {
+		return c.withSourceLimit(c.Input("udp").withMetadata(sourceMetadata(addr, c.resolver)), addr)
+	})
+	return nil
+}
+
+// listenUnix binds the socket of a unix or unixgram input and starts
+// ingesting lines from it.
+func (c *TailCollector) listenUnix(cfg *config.InputConfig) error {
+	abstract := strings.HasPrefix(cfg.Path, config.AbstractSocketPrefix)
+	if !abstract {
+		// A socket left behind by a previous run would fail the bind.
+		if st, err := os.Lstat(cfg.Path); err == nil && st.Mode()&os.ModeSocket != 0 {
+			if err := os.Remove(cfg.Path); err != nil {
+				return err
+			}
+		}
+	}
+
+	switch cfg.Kind {
+	case config.InputKindUnix:
+		l, err := net.Listen("unix", cfg.Path)
+		if err != nil {
+			return err
+		}
+		go c.serveStream(l, cfg.Name, func(net.Conn) (*LineInput, error) {
+			return c.Input(cfg.Name).withMetadata(cfg.Labels).withFormat(cfg.Format), nil
+		})
+	case config.InputKindUnixgram:
+		conn, err := net.ListenPacket("unixgram", cfg.Path)
+		if err != nil {
+			return err
+		}
+		// Datagrams are independent, so one input decodes them all.
+		input := c.Input(cfg.Name).withMetadata(cfg.Labels).withFormat(cfg.Format)
+		go c.servePackets(conn, 1, func(net.Addr) *LineInput { return input })
+	default:
+		return fmt.Errorf("not a unix socket input kind: %q", cfg.Kind)
+	}
+
+	if abstract {
+		return nil
+	}
+	return setSocketPermissions(cfg)
+}
+
+// setSocketPermissions applies the configured mode, owner and group to the
+// socket file of a unix or unixgram input.
+func setSocketPermissions(cfg *config.InputConfig) error {
+	if cfg.Mode != "" {
+		mode, err := config.ParseFileMode(cfg.Mode)
+		if err != nil {
+			return err
+		}
+		if err := os.Chmod(cfg.Path, mode); err != nil {
+			return err
+		}
+	}
+
+	if cfg.Owner == "" && cfg.Group == "" {
+		return nil
+	}
+	uid, gid := -1, -1
+	if cfg.Owner != "" {
+		id, err := lookupID(cfg.Owner, func(name string) (string, error) {
+			u, err := user.Lookup(name)
+			if err != nil {
+				return "", err
+			}
+			return u.Uid, nil
+		})
+		if err != nil {
+			return err
+		}
+		uid = id
+	}
+	if cfg.Group != "" {
+		id, err := lookupID(cfg.Group, func(name string) (string, error) {
+			g, err := user.LookupGroup(name)
+			if err != nil {
+				return "", err
+			}
+			return g.Gid, nil
+		})
+		if err != nil {
+			return err
+		}
+		gid = id
+	}
+	return os.Lchown(cfg.Path, uid, gid)
+}
+
+// lookupID resolves a user or group given by name or numeric id.
+func lookupID(s string, lookup func(name string) (string, error)) (int, error) {
+	if id, err := strconv.Atoi(s); err == nil {
+		return id, nil
+	}
+	id, err := lookup(s)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(id)
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/wrouesnel/tail_exporter/config"
+)
+
+const socketConfig = `
+inputs:
+- kind: unix
+  path: '%s'
+  mode: "0620"
+  labels:
+    socket: stream
+- kind: unixgram
+  path: '%s'
+  labels:
+    socket: datagram
+- kind: unix
+  name: abstract
+  path: '%s'
+  labels:
+    socket: abstract
+metric_configs:
+- name: hellos
+  help: hellos by socket
+  type: counter
+  regex: '^hello'
+  labels:
+  - name: socket
+    value: $__socket
+  value: +1
+`
+
+// sendLines writes each line to a new connection to address on network.
+func sendLines(t *testing.T, network, address string, lines ...string) {
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close() // nolint: errcheck
+	for _, line := range lines {
+		if _, err := conn.Write([]byte(line + "\n")); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestUnixSocketInputs(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("abstract sockets are specific to Linux")
+	}
+	dir, err := ioutil.TempDir("", "sockets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir) // nolint: errcheck
+
+	streamPath := filepath.Join(dir, "stream.sock")
+	datagramPath := filepath.Join(dir, "datagram.sock")
+	// The listeners outlive the test, so the abstract name must be unique.
+	abstractPath := fmt.Sprintf("@tail_exporter_test_%d_%d", os.Getpid(), time.Now().UnixNano())
+
+	// A socket left behind by a previous run is replaced.
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: streamPath, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.SetUnlinkOnClose(false)
+	if err := stale.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	c := newTestCollector(t, fmt.Sprintf(socketConfig, streamPath, datagramPath, abstractPath))
+	for _, input := range c.cfg.Inputs {
+		if err := c.listenUnix(input); err != nil {
+			t.Fatalf("%s: %v", input.Path, err)
+		}
+	}
+
+	st, err := os.Stat(streamPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Mode()&os.ModeSocket == 0 || st.Mode().Perm() != 0620 {
+		t.Errorf("expected a socket with mode 0620, got %v", st.Mode())
+	}
+	if _, err := os.Stat(abstractPath); !os.IsNotExist(err) {
+		t.Errorf("expected no file for an abstract socket, got %v", err)
+	}
+
+	sendLines(t, "unix", streamPath, "hello", "hello", "goodbye")
+	sendLines(t, "unix", streamPath, "hello")
+	sendLines(t, "unixgram", datagramPath, "hello")
+	sendLines(t, "unixgram", datagramPath, "hello\nhello")
+	sendLines(t, "unix", abstractPath, "hello")
+	evaluated := c.evaluatedLines.WithLabelValues("hellos", "0")
+	poll(t, func() bool { return readValue(t, evaluated) >= 8 }, "expected 8 lines to be evaluated")
+
+	// Inputs are named after their paths unless they are given a name.
+	for name, lines := range map[string]float64{
+		streamPath:   4,
+		datagramPath: 3,
+		"abstract":   1,
+	} {
+		if ingested := readValue(t, c.inputLines.WithLabelValues(name)); ingested != lines {
+			t.Errorf("%s: expected %v lines, got %v", name, lines, ingested)
+		}
+	}
+	c.Close()
+
+	for socket, hellos := range map[string]float64{
+		"stream":   3,
+		"datagram": 3,
+		"abstract": 1,
+	} {
+		series := c.families[0].getSeries([]*dto.LabelPair{
+			{Name: proto.String("socket"), Value: proto.String(socket)},
+		})
+		if series == nil {
+			t.Errorf("%s: expected a series", socket)
+		} else if value := series.Get(); value != hellos {
+			t.Errorf("%s: expected %v hellos, got %v", socket, hellos, value)
+		}
+	}
+}
+
+func TestListenUnixRejectsOtherKinds(t *testing.T) {
+	c := newTestCollector(t, "")
+	defer c.Close()
+	err := c.listenUnix(&config.InputConfig{Kind: config.InputKindFile, Path: "@not_a_socket"})
+	if err == nil {
+		t.Error("expected an error listening on a file input")
+	}
+}
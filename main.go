@@ -4,48 +4,118 @@
 package main
 
 import (
-	"bufio"
-	"bytes"
 	"flag"
-	"io"
-	"net"
 	"net/http"
 
-	"github.com/hpcloud/tail"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/common/log"
 	"github.com/wrouesnel/tail_exporter/config"
+	"math"
 	"os"
+	"os/signal"
+	"runtime"
 	"strings"
+	"sync"
+	"syscall"
 
 	"fmt"
-	"github.com/cornelk/hashmap"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
 	"time"
-	"unsafe"
 )
 
 // Namespace is the metric namespace of this collector
 const Namespace string = "tail_collector"
 
 var (
-	listeningAddress = flag.String("web.listen-address", ":9130", "Address on which to expose metrics.")
-	metricsPath      = flag.String("web.telemetry-path", "/metrics", "Path under which to expose Prometheus metrics.")
-	collectorAddress = flag.String("collector.listen-address", ":9129", "TCP and UDP address on which to accept lines")
-	configFile       = flag.String("config.file", "", "Configuration file path")
+	listeningAddress  = flag.String("web.listen-address", ":9130", "Address on which to expose metrics.")
+	metricsPath       = flag.String("web.telemetry-path", "/metrics", "Path under which to expose Prometheus metrics.")
+	ingestPath        = flag.String("web.ingest-path", "", "Path under which lines can be POSTed to the web listener, or empty to disable")
+	ingestQueueSize   = flag.Int("web.ingest-queue-size", 100, "Number of POSTed batches of lines which can wait to be ingested before requests are refused")
+	ingestMaxBodySize = flag.Int64("web.ingest-max-body-size", 10<<20, "Maximum size in bytes of a POSTed batch of lines, after decompression")
+	collectorAddress  = flag.String("collector.listen-address", ":9129", "TCP and UDP address on which to accept lines")
+	collectorUDP      = flag.Bool("collector.udp", true, "Accept lines over UDP as well as TCP on the collector address")
+	configFile        = flag.String("config.file", "", "Configuration file path")
+	configStrict      = flag.Bool("config.strict", false, "Refuse to start if the configuration file fails strict validation")
+
+	collectorTLSCert     = flag.String("collector.tls-cert-file", "", "Certificate file, enabling TLS on the TCP collector")
+	collectorTLSKey      = flag.String("collector.tls-key-file", "", "Key file of the TCP collector's certificate")
+	collectorTLSClientCA = flag.String("collector.tls-client-ca-file", "", "CA certificates file which TCP collector clients' certificates must be signed by")
+
+	collectorMaxConns    = flag.Int("collector.max-connections", 0, "Maximum number of connections served at once by each stream socket input, or 0 for no limit")
+	collectorIdleTimeout = flag.Duration("collector.idle-timeout", 0, "How long a connection can be idle before it is closed, or 0 for no limit")
+	collectorRateLimit   = flag.Float64("collector.rate-limit", 0, "Average number of lines per second accepted from each TCP or UDP source address, or 0 for no limit")
+	collectorRateBurst   = flag.Uint("collector.rate-burst", 100, "Number of lines each TCP or UDP source address can send at once above its rate limit")
+	collectorUDPWorkers  = flag.Int("collector.udp-workers", runtime.NumCPU(), "Number of UDP datagrams processed at once")
+
+	collectorHostsFile   = flag.String("collector.hosts-file", "", "Hosts file whose names are used for source addresses rather than reverse DNS")
+	collectorDNSCacheTTL = flag.Duration("collector.dns-cache-ttl", 5*time.Minute, "How long reverse DNS names of source addresses are cached")
+
+	pushGatewayURL = flag.String("push.gateway-url", "", "Pushgateway URL the push command sends metrics to")
+	pushJob        = flag.String("push.job", "tail_exporter", "Job name the push command pushes metrics as")
+	pushMethod     = flag.String("push.method", "put", "put replaces every metric in the grouping key, post only those with the same names")
+	pushGrouping   = groupingKey{}
+
+	inputFormat = flag.String("input.format", config.FormatRaw, "Format of the lines of files named on the command line: raw, docker, cri, container or journal")
+
+	tailPositionsFile = flag.String("tail.positions-file", "", "File recording how far each followed file has been read, so reading resumes there after a restart")
+	tailPositionsSync = flag.Duration("tail.positions-sync-interval", 10*time.Second, "How often the positions file is saved")
+	tailPollInterval  = flag.Duration("tail.poll-interval", 250*time.Millisecond, "How often followed files are checked for new lines and rotation")
+	tailRefresh       = flag.Duration("tail.refresh-interval", 10*time.Second, "How often the path globs of file inputs are checked for new files")
+
+	execStopTimeout = flag.Duration("exec.stop-timeout", 10*time.Second, "How long exec input commands have to exit on shutdown before they are killed")
+
+	replayOutput = flag.String("replay.output", "-", "File the replay command writes metrics to, or - for stdout")
+	replayFormat = flag.String("replay.format", "text", "Output format of the replay command, text or openmetrics")
 )
 
+func init() {
+	flag.Var(pushGrouping, "push.grouping", "Grouping key label of the push command as name=value, may be repeated")
+}
+
 // TailCollector implements the main collector process.
 type TailCollector struct {
-	cfg     *config.Config   // Configuration
-	metrics *hashmap.HashMap // map of currently stored metrics
-
-	regexCh []chan string // list of regex processors
-
-	numMetrics      prometheus.Gauge       // our own metric + lets initialization succeed
-	ingestedLines   prometheus.Counter     // number of lines we've ingested
-	rejectedLines   *prometheus.CounterVec // number of rejected values
-	timedoutMetrics prometheus.Counter     // number of metrics which have been dropped due to internal timeouts
+	cfg            *config.Config           // Configuration
+	families       []*metricFamily          // currently stored metrics, by metric name
+	familiesByName map[string]*metricFamily // families indexed by metric name
+	familiesMtx    sync.RWMutex             // guards families added at runtime by mapping inputs
+
+	resolver *hostResolver  // resolves source host names, if any rule uses them
+	limiter  *sourceLimiter // limits the rate of lines from each source, if set
+
+	regexCh    []chan logLine // list of regex processors
+	processors sync.WaitGroup // running regex processors
+
+	numMetrics        prometheus.Gauge       // our own metric + lets initialization succeed
+	ingestedLines     prometheus.Counter     // number of lines we've ingested
+	inputLines        *prometheus.CounterVec // number of lines ingested per input
+	inputBytes        *prometheus.CounterVec // number of bytes ingested per input
+	inputDecodeErrors *prometheus.CounterVec // number of lines each input failed to decode
+
+	activeConnections   *prometheus.GaugeVec   // number of open connections per input
+	rejectedConnections *prometheus.CounterVec // number of connections rejected by the connection limit per input
+	throttledLines      *prometheus.CounterVec // number of lines dropped by the rate limit per input
+	httpIngestRejected  *prometheus.CounterVec // number of ingest requests refused, by reason
+	rejectedSamples     *prometheus.CounterVec // number of mapped samples each input could not store, by reason
+
+	evaluatedLines  *prometheus.CounterVec   // number of lines each rule has evaluated
+	matchedLines    *prometheus.CounterVec   // number of lines each rule's regex matched
+	rejectedLines   *prometheus.CounterVec   // number of matched lines each rule rejected, by reason
+	regexDuration   *prometheus.HistogramVec // time each rule spends evaluating its regex
+	seriesCount     *prometheus.GaugeVec     // number of stored series per metric name
+	timedoutMetrics prometheus.Counter       // number of metrics which have been dropped due to internal timeouts
+
+	correlationOrphanedStarts *prometheus.CounterVec // number of events each correlation rule dropped before they ended, by reason
+	correlationUnmatchedEnds  *prometheus.CounterVec // number of end lines each correlation rule had no started event for
+	correlationPendingStarts  *prometheus.GaugeVec   // number of started events each correlation rule is waiting to end
+
+	execRestarts *prometheus.CounterVec // number of times each exec input's command was restarted
+	execExitCode *prometheus.GaugeVec   // exit code of each exec input's command when it last exited
+	execRunning  *prometheus.GaugeVec   // whether each exec input's command is running
+
+	remoteWriteSent        *prometheus.CounterVec // number of write requests sent to each remote write url
+	remoteWriteFailures    *prometheus.CounterVec // number of failed attempts to send write requests
+	remoteWriteDropped     *prometheus.CounterVec // number of write requests dropped without being sent
+	remoteWriteQueueLength *prometheus.GaugeVec   // number of write requests waiting to be sent
 }
 
 func logErr(err error) {
@@ -54,18 +124,10 @@ func logErr(err error) {
 	}
 }
 
-func newTailCollector(cfg *config.Config) *TailCollector {
+func newTailCollector(cfg *config.Config) (*TailCollector, error) {
 	c := TailCollector{}
 	c.cfg = cfg
-	c.metrics = hashmap.New()
-	c.regexCh = make([]chan string, len(cfg.MetricConfigs))
-
-	// Initialize regex processors
-	for idx, mp := range cfg.MetricConfigs {
-		ch := make(chan string, 1)
-		c.regexCh[idx] = ch
-		go c.lineProcessor(ch, mp)
-	}
+	c.regexCh = make([]chan logLine, 0, len(cfg.MetricConfigs))
 
 	// Set constant metrics
 	c.numMetrics = prometheus.NewGauge(
@@ -76,29 +138,130 @@ func newTailCollector(cfg *config.Config) *TailCollector {
 		},
 	)
 
-	c.numMetrics = prometheus.NewGauge(
+	c.ingestedLines = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: Namespace,
+			Name:      "ingested_lines_total",
+			Help:      "total number of lines ingested by collection inputs",
+		},
+	)
+
+	c.inputLines = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: Namespace,
+			Name:      "input_lines_total",
+			Help:      "total number of lines ingested by each collection input",
+		},
+		[]string{"input"},
+	)
+
+	c.inputBytes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: Namespace,
+			Name:      "input_bytes_total",
+			Help:      "total number of bytes of line content ingested by each collection input",
+		},
+		[]string{"input"},
+	)
+
+	c.inputDecodeErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: Namespace,
+			Name:      "input_decode_errors_total",
+			Help:      "total number of lines each collection input could not decode from its format",
+		},
+		[]string{"input"},
+	)
+
+	c.activeConnections = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Namespace: Namespace,
-			Name:      "hashmap_size",
-			Help:      "size of the internal hashmap for persisting metric values",
+			Name:      "input_active_connections",
+			Help:      "number of open connections to each stream socket input",
 		},
+		[]string{"input"},
 	)
 
-	c.ingestedLines = prometheus.NewCounter(
+	c.rejectedConnections = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Namespace: Namespace,
-			Name:      "ingested_lines_total",
-			Help:      "total number of lines ingested by collection inputs",
+			Name:      "input_rejected_connections_total",
+			Help:      "total number of connections to each stream socket input rejected by the connection limit",
+		},
+		[]string{"input"},
+	)
+
+	c.throttledLines = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: Namespace,
+			Name:      "input_throttled_lines_total",
+			Help:      "total number of lines each collection input dropped for exceeding their source's rate limit",
+		},
+		[]string{"input"},
+	)
+
+	c.httpIngestRejected = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: Namespace,
+			Name:      "http_ingest_rejected_requests_total",
+			Help:      "total number of requests to the HTTP ingest endpoint which were refused, by reason",
+		},
+		[]string{"reason"},
+	)
+
+	c.rejectedSamples = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: Namespace,
+			Name:      "input_rejected_samples_total",
+			Help:      "total number of samples each statsd or graphite input could not store, by reason",
 		},
+		[]string{"input", "reason"},
+	)
+
+	c.evaluatedLines = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: Namespace,
+			Name:      "rule_evaluated_lines_total",
+			Help:      "total number of lines evaluated by each rule",
+		},
+		[]string{"metric", "rule"},
+	)
+
+	c.matchedLines = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: Namespace,
+			Name:      "rule_matched_lines_total",
+			Help:      "total number of lines matched by each rule's regex",
+		},
+		[]string{"metric", "rule"},
 	)
 
 	c.rejectedLines = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Namespace: Namespace,
 			Name:      "rejected_lines_total",
-			Help:      "total number of lines rejected during parsing",
+			Help:      "total number of matched lines rejected during parsing by each rule",
 		},
-		[]string{"reason"},
+		[]string{"metric", "rule", "reason"},
+	)
+
+	c.regexDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: Namespace,
+			Name:      "rule_regex_duration_seconds",
+			Help:      "time spent evaluating each rule's regex against a line",
+			Buckets:   prometheus.ExponentialBuckets(0.000001, 4, 8),
+		},
+		[]string{"metric", "rule"},
+	)
+
+	c.seriesCount = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: Namespace,
+			Name:      "series",
+			Help:      "current number of stored series for each metric name",
+		},
+		[]string{"metric"},
 	)
 
 	c.timedoutMetrics = prometheus.NewCounter(
@@ -109,202 +272,559 @@ func newTailCollector(cfg *config.Config) *TailCollector {
 		},
 	)
 
+	c.correlationOrphanedStarts = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: Namespace,
+			Name:      "correlation_orphaned_starts_total",
+			Help:      "total number of started events each correlation rule dropped before they ended, by reason",
+		},
+		[]string{"metric", "rule", "reason"},
+	)
+
+	c.correlationUnmatchedEnds = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: Namespace,
+			Name:      "correlation_unmatched_ends_total",
+			Help:      "total number of end lines each correlation rule had no started event for",
+		},
+		[]string{"metric", "rule"},
+	)
+
+	c.correlationPendingStarts = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: Namespace,
+			Name:      "correlation_pending_starts",
+			Help:      "current number of started events each correlation rule is waiting to see end",
+		},
+		[]string{"metric", "rule"},
+	)
+
+	c.execRestarts = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: Namespace,
+			Name:      "exec_restarts_total",
+			Help:      "total number of times each exec input's command was restarted after exiting",
+		},
+		[]string{"input"},
+	)
+
+	c.execExitCode = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: Namespace,
+			Name:      "exec_last_exit_code",
+			Help:      "exit code of each exec input's command when it last exited, or -1 if it was killed by a signal",
+		},
+		[]string{"input"},
+	)
+
+	c.execRunning = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: Namespace,
+			Name:      "exec_running",
+			Help:      "whether each exec input's command is running",
+		},
+		[]string{"input"},
+	)
+
+	c.remoteWriteSent = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: Namespace,
+			Name:      "remote_write_requests_total",
+			Help:      "total number of write requests sent to each remote write url",
+		},
+		[]string{"url"},
+	)
+
+	c.remoteWriteFailures = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: Namespace,
+			Name:      "remote_write_failures_total",
+			Help:      "total number of failed attempts to send a write request to each remote write url",
+		},
+		[]string{"url"},
+	)
+
+	c.remoteWriteDropped = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: Namespace,
+			Name:      "remote_write_dropped_requests_total",
+			Help:      "total number of write requests for each remote write url dropped without being sent",
+		},
+		[]string{"url"},
+	)
+
+	c.remoteWriteQueueLength = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: Namespace,
+			Name:      "remote_write_queue_length",
+			Help:      "current number of write requests queued for each remote write url",
+		},
+		[]string{"url"},
+	)
+
 	c.numMetrics.Set(float64(len(cfg.MetricConfigs)))
-	return &c
-}
 
-// Reads until the current connection is closed
-func (c *TailCollector) processReader(reader io.Reader) {
-	lineScanner := bufio.NewScanner(reader)
-	for {
-		if ok := lineScanner.Scan(); !ok {
-			break
+	// Initialize metric families
+	c.familiesByName = make(map[string]*metricFamily, len(cfg.MetricFamilies))
+	for _, familyCfg := range cfg.MetricFamilies {
+		family, err := newMetricFamily(familyCfg)
+		if err != nil {
+			return nil, err
 		}
-		c.IngestLine(lineScanner.Text())
+		c.families = append(c.families, family)
+		c.familiesByName[familyCfg.Name] = family
 	}
+
+	// Initialize regex processors
+	for idx := range cfg.MetricConfigs {
+		mp := &cfg.MetricConfigs[idx]
+		r := c.newRule(idx, mp, c.familiesByName[mp.Name])
+		ch := make(chan logLine, 1)
+		c.regexCh = append(c.regexCh, ch)
+		c.processors.Add(1)
+		go c.lineProcessor(ch, r)
+	}
+
+	return &c, nil
 }
 
-// IngestLine consumes a line from the file tailing engine
-func (c *TailCollector) IngestLine(line string) {
+// IngestLine dispatches a line to every rule. Inputs should ingest lines
+// through their LineInput so they are accounted for.
+func (c *TailCollector) IngestLine(line string, meta lineMetadata) {
 	c.ingestedLines.Inc()
 	// Dispatch the line to all active regex parsers
 	for _, ch := range c.regexCh {
-		ch <- line
+		ch <- logLine{text: line, meta: meta}
 	}
 }
 
+// Close stops the collector accepting lines, and waits for every line already
+// ingested to be processed.
+func (c *TailCollector) Close() {
+	for _, ch := range c.regexCh {
+		close(ch)
+	}
+	c.processors.Wait()
+}
+
 // Processes lines through the regexes we have loaded
-func (c *TailCollector) lineProcessor(lineCh chan string, cfg config.MetricParser) {
-	for line := range lineCh {
-		m := cfg.Regex.MatcherString(line, 0)
-		if !m.Matches() {
-			continue
+func (c *TailCollector) lineProcessor(lineCh chan logLine, r *rule) {
+	defer c.processors.Done()
+	if r.correlation == nil {
+		for line := range lineCh {
+			c.processLine(line, r)
 		}
+		return
+	}
 
-		// Parse the
-		labelPairs, lerr := ParseLabelPairsFromMatch(cfg.Labels, m)
-		if lerr != nil {
-			log.With("line", line).Warnln("Dropping line due to unparseable labels:", lerr)
-			c.rejectedLines.WithLabelValues(lerr.Error()).Inc()
-			continue
+	// Correlation rules also expire the events they started which never
+	// ended.
+	ticker := time.NewTicker(correlationExpiryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case line, ok := <-lineCh:
+			if !ok {
+				return
+			}
+			c.processLine(line, r)
+		case now := <-ticker.C:
+			r.correlation.expire(now)
 		}
+	}
+}
+
+// processLine applies a single rule to a line.
+func (c *TailCollector) processLine(l logLine, r *rule) {
+	cfg, family := r.cfg, r.family
+	line, meta := l.text, l.meta
+
+	r.evaluatedLines.Inc()
+	if r.correlation != nil {
+		c.processCorrelation(l, r)
+		return
+	}
 
-		// Convert the parsed line into the matching metric definition
-		metric, merr := newMetricValue(cfg.Name, cfg.Help, cfg.Type, time.Duration(cfg.Timeout), labelPairs)
-		if merr != nil {
-			log.With("line", line).Errorln("Dropping line due to metric parsing error:", merr)
-			c.rejectedLines.WithLabelValues(merr.Error()).Inc()
+	start := time.Now()
+	m := cfg.Regex.MatcherString(line, 0)
+	r.regexDuration.Observe(time.Since(start).Seconds())
+	if !m.Matches() {
+		return
+	}
+	r.matchedLines.Inc()
+
+	// Identify the series from the labels the line produces
+	hash, herr := HashLabelPairsFromMatch(cfg.Labels, m, meta)
+	if herr != nil {
+		log.With("line", line).Warnln("Dropping line due to unparseable labels:", herr)
+		r.reject(rejectUnparseableLabels)
+		return
+	}
+
+	var loggedAt time.Time
+	if cfg.Timestamp != nil {
+		var terr error
+		if loggedAt, terr = ParseTimestampFromMatch(cfg.Timestamp, m, meta); terr != nil {
+			log.With("line", line).Warnln("Dropping line due to unparseable timestamp:", terr)
+			r.reject(rejectUnparseableTimestamp)
+			return
 		}
+	}
+
+	// Get the value from the metric.
+	value, verr := ParseValueFromMatch(cfg.Value, m, loggedAt)
+	if verr != nil {
+		log.With("line", line).Errorln("Dropping line due to value parsing error:", verr)
+		r.reject(rejectUnparseableValue)
+		return
+	}
+
+	// Do a lookup in the hashtable to see if we have this metric
+	storedMetric := family.lookupSeries(hash, cfg.Labels, m, meta)
 
-		// Get the value from the metric.
-		value, verr := ParseValueFromMatch(cfg.Value, m)
-		if verr != nil {
-			log.With("line", line).Errorln("Dropping line due to value parsing error:", verr)
-			c.rejectedLines.WithLabelValues(verr.Error()).Inc()
+	if storedMetric == nil {
+		// Parse the labels in full to create the new series
+		labelPairs, lerr := ParseLabelPairsFromMatch(cfg.Labels, m, meta)
+		if lerr != nil {
+			log.With("line", line).Warnln("Dropping line due to unparseable labels:", lerr)
+			r.reject(rejectUnparseableLabels)
+			return
 		}
 
-		// Do a lookup in the hashtable to see if we have this metric
-		storedMetricPtr, found := c.metrics.GetStringKey(metric.GetHash())
-		if !found {
+		metric, created, ferr := family.addSeries(hash, labelPairs, time.Duration(cfg.Timeout))
+		if ferr != nil {
+			log.With("line", line).Warnln("Dropping line due to labels inconsistent with metric:", ferr)
+			r.reject(rejectInconsistentLabels)
+			return
+		}
+		// Rate series start empty, and add the value like any other update.
+		if created && family.identities != nil {
+			family.replaceIdentity(metric)
+		}
+		if created && metric.rate == nil {
 			log.Debugln("Initializing new metric")
 			metric.Set(value)
-			c.metrics.Set(metric.GetHash(), unsafe.Pointer(metric)) // nolint: gas
-		} else {
-			storedMetric := (*metricValue)(storedMetricPtr)
-			// Found a stored metric, do the correct operation for the config
-			// on its value
-			switch cfg.Value.ValueOp {
-			case config.ValueOpAdd:
-				storedMetric.Add(value)
-			case config.ValueOpSubtract:
-				storedMetric.Sub(value)
-			case config.ValueOpEquals:
-				storedMetric.Set(value)
-			default:
-				// panic because we should *never* get here and testing
-				// should catch it.
-				panic(fmt.Sprintf("unknown value source specification in config: %v", cfg.Value.ValueOp))
+			r.annotate(metric, m, meta, value, loggedAt)
+			return
+		}
+		storedMetric = metric
+	}
+
+	// Found a stored metric, do the correct operation for the config
+	// on its value
+	switch cfg.Value.ValueOp {
+	case config.ValueOpAdd:
+		storedMetric.Add(value)
+	case config.ValueOpSubtract:
+		storedMetric.Sub(value)
+	case config.ValueOpEquals:
+		storedMetric.Set(value)
+	default:
+		// panic because we should *never* get here and testing
+		// should catch it.
+		panic(fmt.Sprintf("unknown value source specification in config: %v", cfg.Value.ValueOp))
+	}
+
+	r.annotate(storedMetric, m, meta, value, loggedAt)
+}
+
+// getFamilies returns every metric family. Families are only ever added, so
+// the slice returned can be used without holding the lock.
+func (c *TailCollector) getFamilies() []*metricFamily {
+	c.familiesMtx.RLock()
+	defer c.familiesMtx.RUnlock()
+	return c.families
+}
+
+// getFamily returns the named metric family, or nil if there is none.
+func (c *TailCollector) getFamily(name string) *metricFamily {
+	c.familiesMtx.RLock()
+	defer c.familiesMtx.RUnlock()
+	return c.familiesByName[name]
+}
+
+// mappedFamily returns the family of a metric a mapping input received,
+// adding it if it is new. Mapped metrics can't share a name with the metrics
+// of rules, or with mapped metrics of another type.
+func (c *TailCollector) mappedFamily(cfg *config.MetricFamily) (*metricFamily, error) {
+	family := c.getFamily(cfg.Name)
+	if family == nil {
+		c.familiesMtx.Lock()
+		defer c.familiesMtx.Unlock()
+		if family = c.familiesByName[cfg.Name]; family == nil {
+			var err error
+			if family, err = newMetricFamily(cfg); err != nil {
+				return nil, err
 			}
+			c.families = append(c.families, family)
+			c.familiesByName[cfg.Name] = family
+			return family, nil
 		}
 	}
+
+	if len(family.cfg.Parsers) > 0 || family.cfg.Type != cfg.Type {
+		return nil, errMetricConflict
+	}
+	return family, nil
+}
+
+// seriesMetadata implements seriesMetadataFunc for the stored series.
+func (c *TailCollector) seriesMetadata(name string, labels []*dto.LabelPair) (seriesMetadata, bool) {
+	family := c.getFamily(name)
+	if family == nil {
+		return seriesMetadata{}, false
+	}
+	metric := family.getSeries(labels)
+	if metric == nil {
+		return seriesMetadata{}, false
+	}
+	return metric.Metadata(), true
 }
 
-// Collect implements prometheus.Collector.
+// Collect implements prometheus.Collector. Each metric family is collected
+// separately so an inconsistent series is dropped rather than failing the
+// whole scrape.
 func (c *TailCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, family := range c.getFamilies() {
+		c.timedoutMetrics.Add(float64(family.Collect(ch)))
+		c.seriesCount.WithLabelValues(family.cfg.Name).Set(float64(family.seriesLen()))
+	}
+
 	c.numMetrics.Collect(ch)
 	c.ingestedLines.Collect(ch)
+	c.inputLines.Collect(ch)
+	c.inputBytes.Collect(ch)
+	c.inputDecodeErrors.Collect(ch)
+	c.activeConnections.Collect(ch)
+	c.rejectedConnections.Collect(ch)
+	c.throttledLines.Collect(ch)
+	c.httpIngestRejected.Collect(ch)
+	c.rejectedSamples.Collect(ch)
+	c.evaluatedLines.Collect(ch)
+	c.matchedLines.Collect(ch)
 	c.rejectedLines.Collect(ch)
+	c.regexDuration.Collect(ch)
+	c.seriesCount.Collect(ch)
 	c.timedoutMetrics.Collect(ch)
-
-	for kv := range c.metrics.Iter() {
-		metric := (*metricValue)(kv.Value)
-		metric.Collect(ch)
-		// Maybe GC the metric if it hasn't been updated for a while.
-		// Doing this after a collection biases us to reporting existent
-		// metrics at least once.
-		if metric.IsStale() {
-			log.Debugln("Expiring stale metric from cache.")
-			c.metrics.Del(kv.Key)
-		}
-	}
+	c.correlationOrphanedStarts.Collect(ch)
+	c.correlationUnmatchedEnds.Collect(ch)
+	c.correlationPendingStarts.Collect(ch)
+	c.execRestarts.Collect(ch)
+	c.execExitCode.Collect(ch)
+	c.execRunning.Collect(ch)
+	c.remoteWriteSent.Collect(ch)
+	c.remoteWriteFailures.Collect(ch)
+	c.remoteWriteDropped.Collect(ch)
+	c.remoteWriteQueueLength.Collect(ch)
 }
 
 // Describe implements prometheus.Collector.
 func (c *TailCollector) Describe(ch chan<- *prometheus.Desc) {
 	c.numMetrics.Describe(ch)
 	c.ingestedLines.Describe(ch)
+	c.inputLines.Describe(ch)
+	c.inputBytes.Describe(ch)
+	c.inputDecodeErrors.Describe(ch)
+	c.activeConnections.Describe(ch)
+	c.rejectedConnections.Describe(ch)
+	c.throttledLines.Describe(ch)
+	c.httpIngestRejected.Describe(ch)
+	c.rejectedSamples.Describe(ch)
+	c.evaluatedLines.Describe(ch)
+	c.matchedLines.Describe(ch)
 	c.rejectedLines.Describe(ch)
+	c.regexDuration.Describe(ch)
+	c.seriesCount.Describe(ch)
 	c.timedoutMetrics.Describe(ch)
-
-	for kv := range c.metrics.Iter() {
-		metric := (*metricValue)(kv.Value)
-		metric.Describe(ch)
+	c.correlationOrphanedStarts.Describe(ch)
+	c.correlationUnmatchedEnds.Describe(ch)
+	c.correlationPendingStarts.Describe(ch)
+	c.execRestarts.Describe(ch)
+	c.execExitCode.Describe(ch)
+	c.execRunning.Describe(ch)
+	c.remoteWriteSent.Describe(ch)
+	c.remoteWriteFailures.Describe(ch)
+	c.remoteWriteDropped.Describe(ch)
+	c.remoteWriteQueueLength.Describe(ch)
+
+	for _, family := range c.getFamilies() {
+		family.Describe(ch)
 	}
 }
 
 func main() {
 	flag.Parse()
-	http.Handle(*metricsPath, promhttp.Handler())
 
-	cfg, err := config.LoadFile(*configFile)
+	// check-config [file...] validates configs and exits.
+	if flag.NArg() > 0 && flag.Arg(0) == "check-config" {
+		filenames := flag.Args()[1:]
+		if len(filenames) == 0 && *configFile != "" {
+			filenames = []string{*configFile}
+		}
+		os.Exit(checkConfig(filenames))
+	}
+
+	loadConfig := config.LoadFile
+	if *configStrict {
+		loadConfig = config.LoadFileStrict
+	}
+	cfg, err := loadConfig(*configFile)
 	if err != nil {
 		log.Fatalln("Configuration file could not be read.", err)
 	}
+	if !config.IsFormat(*inputFormat) {
+		log.Fatalf("Unknown input format %q", *inputFormat)
+	}
+
+	// push [file...] processes files to EOF, pushes the result and exits.
+	if flag.NArg() > 0 && flag.Arg(0) == "push" {
+		os.Exit(pushCommand(cfg, flag.Args()[1:]))
+	}
+
+	// replay file... processes files from the start and prints the result.
+	if flag.NArg() > 0 && flag.Arg(0) == "replay" {
+		os.Exit(replayCommand(cfg, flag.Args()[1:]))
+	}
 
-	c := newTailCollector(cfg)
+	c, err := newTailCollector(cfg)
+	if err != nil {
+		log.Fatalln("Configuration could not be loaded.", err)
+	}
 	prometheus.MustRegister(c)
+	http.Handle(*metricsPath, metricsHandler(prometheus.DefaultGatherer, c.seriesMetadata))
+
+	// Source addresses are rate limited and resolved for every network
+	// input, so both are set up before any input starts.
+	if *collectorRateLimit > 0 {
+		if *collectorRateBurst < 1 || *collectorRateBurst > math.MaxUint16 {
+			log.Fatalf("Rate limit burst must be between 1 and %d", math.MaxUint16)
+		}
+		c.limiter = newSourceLimiter(*collectorRateLimit, uint16(*collectorRateBurst))
+	}
+	// Reverse DNS lookups are only worth their cost if they're used.
+	if cfg.ReferencesMetadata("source_host") {
+		if c.resolver, err = newHostResolver(*collectorHostsFile, *collectorDNSCacheTTL); err != nil {
+			log.Fatalf("Error loading hosts file: %s", err)
+		}
+	}
+
+	for _, rwCfg := range cfg.RemoteWrite {
+		w, err := c.newRemoteWriter(rwCfg)
+		if err != nil {
+			log.Fatalln("Remote write could not be started.", err)
+		}
+		go w.Run()
+	}
+
+	// If args or file inputs then start file/fifo collectors
+	var positions *positions
+	if len(flag.Args()) > 0 || len(cfg.Inputs) > 0 {
+		checkDecompressors()
+		if *tailPositionsFile != "" {
+			if positions, err = loadPositions(*tailPositionsFile); err != nil {
+				log.Fatalln("Positions file could not be read.", err)
+			}
+			go positions.syncEvery(*tailPositionsSync)
+		}
 
-	// If args then start file/fifo collectors
-	if len(flag.Args()) > 0 {
 		for _, filename := range flag.Args() {
-			go func(filename string) {
-				var isPipe bool
-				st, err := os.Stat(filename)
-				if err == nil {
-					if st.Mode()&os.ModeNamedPipe == os.ModeNamedPipe {
-						isPipe = true
-					}
-				} else {
-					isPipe = false
-				}
-
-				t, err := tail.TailFile(filename, tail.Config{
-					Location: &tail.SeekInfo{0, io.SeekEnd},
-					ReOpen:   true,
-					Follow:   isPipe,
-				})
-				if err != nil {
-					log.Errorln("Error tailing file:", filename)
-				}
-
-				for line := range t.Lines {
-					c.IngestLine(line.Text)
-				}
-
-			}(filename)
+			go c.watchFile(c.newFileFollower(filename, *inputFormat, nil, positions))
+		}
+		for _, input := range cfg.Inputs {
+			if input.Kind == config.InputKindFile {
+				go c.watchInput(input, positions, nil)
+			}
 		}
 	}
 
+	// Start exec inputs, and stop their commands on shutdown
+	var execs []*execInput
+	for _, input := range cfg.Inputs {
+		if input.Kind == config.InputKindExec {
+			e := c.newExecInput(input)
+			execs = append(execs, e)
+			go e.Run()
+		}
+	}
+
+	// On shutdown stop the exec inputs' commands, and save how far files
+	// were read.
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-sigCh
+		log.Infoln("Received", sig, "shutting down")
+		var wg sync.WaitGroup
+		for _, e := range execs {
+			wg.Add(1)
+			go func(e *execInput) {
+				defer wg.Done()
+				e.Stop(sig, *execStopTimeout)
+			}(e)
+		}
+		wg.Wait()
+		savePositions(positions)
+		os.Exit(0)
+	}()
+
 	// If collector address present, then start port collector.
 	if *collectorAddress != "" {
-		tcpSock, err := net.Listen("tcp", *collectorAddress)
+		if *collectorUDPWorkers < 1 {
+			log.Fatalln("At least one UDP worker is required")
+		}
+
+		tlsConfig, err := collectorTLSConfig(*collectorTLSCert, *collectorTLSKey, *collectorTLSClientCA)
 		if err != nil {
+			log.Fatalf("Error loading collector TLS configuration: %s", err)
+		}
+		if err := c.listenTCP(*collectorAddress, tlsConfig); err != nil {
 			log.Fatalf("Error binding to TCP socket: %s", err)
 		}
-		go func() {
-			for {
-				conn, aerr := tcpSock.Accept()
-				if aerr != nil {
-					log.Errorf("Error accepting TCP connection: %s", aerr)
-					continue
-				}
-				go func() {
-					defer logErr(conn.Close())
-					c.processReader(conn)
-				}()
-			}
-		}()
 
-		udpAddress, uerr := net.ResolveUDPAddr("udp", *collectorAddress)
-		if uerr != nil {
-			log.Fatalf("Error resolving UDP address: %s", err)
+		if *collectorUDP {
+			if err := c.listenUDP(*collectorAddress); err != nil {
+				log.Fatalf("Error listening to UDP address: %s", err)
+			}
 		}
-		udpSock, lerr := net.ListenUDP("udp", udpAddress)
-		if lerr != nil {
-			log.Fatalf("Error listening to UDP address: %s", err)
+	}
+
+	// If ingest path present, then accept lines over HTTP.
+	if *ingestPath != "" {
+		if *ingestQueueSize < 1 || *ingestMaxBodySize < 1 {
+			log.Fatalln("The ingest queue and maximum body size must be positive")
 		}
-		go func() {
-			defer logErr(udpSock.Close())
-			for {
-				buf := make([]byte, 65536)
-				chars, srcAddress, err := udpSock.ReadFromUDP(buf)
-				if err != nil {
-					log.Errorf("Error reading UDP packet from %s: %s", srcAddress, err)
-					continue
-				}
-				go c.processReader(bytes.NewReader(buf[0:chars]))
+		ingester := c.newHTTPIngester(*ingestQueueSize, *ingestMaxBodySize)
+		go ingester.Run()
+		http.Handle(*ingestPath, ingester)
+	}
+
+	// Start unix socket inputs
+	for _, input := range cfg.Inputs {
+		if input.Kind == config.InputKindUnix || input.Kind == config.InputKindUnixgram {
+			if err := c.listenUnix(input); err != nil {
+				log.Fatalf("Error listening on unix socket %s: %s", input.Path, err)
 			}
-		}()
+		}
+	}
+
+	// Start network protocol inputs
+	for _, input := range cfg.Inputs {
+		var err error
+		switch input.Kind {
+		case config.InputKindGELF:
+			err = c.listenGELF(input)
+		case config.InputKindForward:
+			err = c.listenForward(input)
+		case config.InputKindBeats:
+			err = c.listenBeats(input)
+		case config.InputKindStatsd:
+			err = c.listenStatsd(input)
+		case config.InputKindGraphite:
+			err = c.listenGraphite(input)
+		}
+		if err != nil {
+			log.Fatalf("Error listening for %s input on %s: %s", input.Kind, input.Address, err)
+		}
 	}
 
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
@@ -326,4 +846,15 @@ func main() {
 
 	log.Infof("Starting Server: %s", *listeningAddress)
 	logErr(http.ListenAndServe(*listeningAddress, nil))
+	savePositions(positions)
+}
+
+// savePositions saves the positions file, if there is one, before exiting.
+func savePositions(positions *positions) {
+	if positions == nil {
+		return
+	}
+	if err := positions.save(); err != nil {
+		log.Errorln("Error saving positions file:", err)
+	}
 }
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/wrouesnel/tail_exporter/config"
+)
+
+// newTestCollector returns a collector with the rules of cfg loaded.
+func newTestCollector(t testing.TB, cfg string) *TailCollector {
+	loaded, err := config.Load(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := newTailCollector(loaded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// readValue returns the value of a counter, gauge or untyped metric.
+func readValue(t testing.TB, m prometheus.Metric) float64 {
+	out := &dto.Metric{}
+	if err := m.Write(out); err != nil {
+		t.Fatal(err)
+	}
+	switch {
+	case out.Counter != nil:
+		return out.Counter.GetValue()
+	case out.Gauge != nil:
+		return out.Gauge.GetValue()
+	}
+	return out.Untyped.GetValue()
+}
+
+// poll waits for cond to hold, failing with the given message if it doesn't
+// within a few seconds.
+func poll(t testing.TB, cond func() bool, format string, args ...interface{}) {
+	for deadline := time.Now().Add(5 * time.Second); !cond(); time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf(format, args...)
+		}
+	}
+}
+
+const benchConfig = `
+metric_configs:
+- name: example_counter
+  help: example_counter only ever goes up
+  regex: '^COUNTER: (\S+)=(\S+) (\S+)=(\S+) (\d+)'
+  labels:
+  - name: $1
+    value: $2
+  - name: $3
+    value: $4
+  value: +$5
+`
+
+// newBenchRule returns a collector with benchConfig loaded, and a rule for
+// its counter which lines can be processed with directly.
+func newBenchRule(b *testing.B) (*TailCollector, *rule) {
+	cfg, err := config.Load(benchConfig)
+	if err != nil {
+		b.Fatal(err)
+	}
+	c, err := newTailCollector(cfg)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return c, c.newRule(0, &cfg.MetricConfigs[0], c.families[0])
+}
+
+// BenchmarkProcessLine measures a line updating a series which already
+// exists, which is the common case and should only allocate for the match.
+func BenchmarkProcessLine(b *testing.B) {
+	c, r := newBenchRule(b)
+	defer c.Close()
+
+	line := logLine{text: "COUNTER: a=1 b=2 5"}
+	c.processLine(line, r)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c.processLine(line, r)
+	}
+}
+
+// BenchmarkProcessLineSeries measures lines spread over many series, so the
+// series lookup is done against a populated family.
+func BenchmarkProcessLineSeries(b *testing.B) {
+	c, r := newBenchRule(b)
+	defer c.Close()
+
+	lines := make([]logLine, 1000)
+	for i := range lines {
+		lines[i] = logLine{text: fmt.Sprintf("COUNTER: a=%d b=%d 5", i, i%7)}
+		c.processLine(lines[i], r)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c.processLine(lines[i%len(lines)], r)
+	}
+}
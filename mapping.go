@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/model"
+	"github.com/wrouesnel/tail_exporter/config"
+)
+
+// sampleOp is how a mapped sample updates its series.
+type sampleOp int
+
+const (
+	sampleAdd sampleOp = iota
+	sampleSet
+	sampleObserve
+)
+
+// mappedSample is a sample of a metric received by a mapping input, such as
+// statsd or graphite, which is stored directly rather than matched by rules.
+type mappedSample struct {
+	// name is the metric name as it was received, which is mapped to the
+	// name of the series.
+	name string
+	// tags are labels sent with the sample.
+	tags  prometheus.Labels
+	typ   config.MetricType
+	op    sampleOp
+	value float64
+	// count is the number of observations a histogram sample stands for.
+	count uint64
+	// timestamp is when the sample was taken, if it was sent with one.
+	timestamp time.Time
+}
+
+// mapper maps the samples a mapping input receives to series, and stores
+// them.
+type mapper struct {
+	c   *TailCollector
+	cfg *config.InputConfig
+}
+
+// store maps a sample received by input to its series, and applies it. The
+// mapping's labels can use the metadata of input.
+func (m *mapper) store(input *LineInput, s *mappedSample) {
+	name, help, labels, ok, err := m.mapName(s.name, input.meta)
+	if err != nil {
+		m.reject(s, "unparseable_labels", err)
+		return
+	}
+	if !ok {
+		return
+	}
+	if !model.IsValidMetricName(model.LabelValue(name)) {
+		m.reject(s, "invalid_name", fmt.Errorf("invalid metric name %q", name))
+		return
+	}
+	for tag, value := range s.tags {
+		if _, found := labels[tag]; !found {
+			labels[tag] = value
+		}
+	}
+
+	family, err := m.c.mappedFamily(&config.MetricFamily{
+		Name:              name,
+		Help:              help,
+		Type:              s.typ,
+		DynamicLabelNames: true,
+		Buckets:           m.cfg.Buckets,
+	})
+	if err != nil {
+		m.reject(s, "conflict", err)
+		return
+	}
+	// Tags vary between samples, so the labels of tags a sample doesn't have
+	// are empty. Tags the family doesn't have are inconsistent.
+	if fl := family.getLabels(); fl != nil {
+		for _, name := range fl.names {
+			if _, found := labels[name]; !found {
+				labels[name] = ""
+			}
+		}
+	}
+	metric, err := family.labelledSeries(labels, time.Duration(m.cfg.Timeout))
+	if err != nil {
+		m.reject(s, "inconsistent_labels", err)
+		return
+	}
+
+	switch s.op {
+	case sampleAdd:
+		metric.Add(s.value)
+	case sampleSet:
+		metric.Set(s.value)
+	case sampleObserve:
+		if err := metric.Observe(s.value, s.count); err != nil {
+			m.reject(s, "conflict", err)
+			return
+		}
+	}
+	if !s.timestamp.IsZero() {
+		metric.SetLoggedAt(s.timestamp)
+	}
+}
+
+// mapName returns the metric name, help and labels of a received metric
+// name, or ok false if a mapping drops it.
+func (m *mapper) mapName(name string, meta lineMetadata) (string, string, prometheus.Labels, bool, error) {
+	for _, mapping := range m.cfg.Mappings {
+		matcher := mapping.Regex.MatcherString(name, 0)
+		if !matcher.Matches() {
+			continue
+		}
+		if mapping.Drop {
+			return "", "", nil, false, nil
+		}
+
+		labels, err := ParseLabelPairsFromMatch(mapping.Labels, matcher, meta)
+		if err != nil {
+			return "", "", nil, false, err
+		}
+		mapped := mapping.ExpandName(func(n int) string {
+			if n > matcher.Groups() {
+				return ""
+			}
+			return matcher.GroupString(n)
+		})
+		help := mapping.Help
+		if help == "" {
+			help = m.help(name)
+		}
+		return mapped, help, labels, true, nil
+	}
+	return escapeName(name), m.help(name), prometheus.Labels{}, true, nil
+}
+
+func (m *mapper) help(name string) string {
+	return fmt.Sprintf("Metric %s received by %s input %s", name, m.cfg.Kind, m.cfg.Name)
+}
+
+func (m *mapper) reject(s *mappedSample, reason string, err error) {
+	m.c.rejectedSamples.WithLabelValues(m.cfg.Name, reason).Inc()
+	log.Debugf("Dropping sample of %s from %s: %s", s.name, m.cfg.Name, err)
+}
+
+// escapeName replaces the characters of a received metric or tag name which
+// aren't valid in metric and label names with underscores, and prefixes
+// names starting with a digit with one.
+func escapeName(name string) string {
+	escaped := []byte(name)
+	for idx, b := range escaped {
+		if !(b == '_' || (b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z') || (b >= '0' && b <= '9')) {
+			escaped[idx] = '_'
+		}
+	}
+	if len(escaped) > 0 && escaped[0] >= '0' && escaped[0] <= '9' {
+		return "_" + string(escaped)
+	}
+	return string(escaped)
+}
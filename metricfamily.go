@@ -0,0 +1,488 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"github.com/cornelk/hashmap"
+	"github.com/glenn-brown/golang-pkg-pcre/src/pkg/pcre"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/model"
+	"github.com/wrouesnel/tail_exporter/config"
+)
+
+// errMetricConflict is returned when a mapped metric's name is already used
+// by a rule, or by a mapped metric of another type.
+var errMetricConflict = errors.New("metric name is used by a rule or by a metric of another type")
+
+// familyLabels is the immutable description of the label names of a
+// metricFamily.
+type familyLabels struct {
+	desc  *prometheus.Desc
+	names []string
+	// index maps label names to their position in names
+	index map[string]int
+}
+
+func newFamilyLabels(cfg *config.MetricFamily, names []string) *familyLabels {
+	l := &familyLabels{
+		desc:  prometheus.NewDesc(cfg.Name, cfg.Help, names, nil),
+		names: names,
+		index: make(map[string]int, len(names)),
+	}
+	for idx, name := range names {
+		l.index[name] = idx
+	}
+	return l
+}
+
+// metricFamily stores every series of a single metric name. All the
+// MetricParsers which populate the name share the family, so the series it
+// exposes always have a consistent type, help and set of label names.
+type metricFamily struct {
+	cfg *config.MetricFamily
+	// valueType is the prometheus TYPE of every series in the family
+	valueType prometheus.ValueType
+	// series is the map of currently stored metricValues, keyed by the
+	// hash of their labels
+	series *hashmap.HashMap
+	// seriesMtx serializes the creation and deletion of series
+	seriesMtx sync.Mutex
+	// collided chains the series whose label hash is already used in series
+	// by another series. Chains are replaced rather than modified.
+	collided    map[uint64][]*metricValue
+	collidedMtx sync.RWMutex
+
+	// labels holds a *familyLabels. It is fixed by the first series
+	// ingested if the family takes its label names from capture groups.
+	labels    atomic.Value
+	labelsMtx sync.Mutex
+
+	// identities maps the identity of each series of an info family to the
+	// series.
+	identities    map[uint64]*metricValue
+	identitiesMtx sync.Mutex
+}
+
+func newMetricFamily(cfg *config.MetricFamily) (*metricFamily, error) {
+	f := &metricFamily{
+		cfg:      cfg,
+		series:   hashmap.New(),
+		collided: make(map[uint64][]*metricValue),
+	}
+
+	valueType, err := prometheusValueType(cfg.Type)
+	if err != nil {
+		return nil, err
+	}
+	f.valueType = valueType
+
+	if !model.IsValidMetricName(model.LabelValue(cfg.Name)) {
+		return nil, fmt.Errorf("invalid metric name: %q", cfg.Name)
+	}
+
+	if !cfg.DynamicLabelNames {
+		for _, name := range cfg.LabelNames {
+			if !model.LabelName(name).IsValid() {
+				return nil, fmt.Errorf("invalid label name for %s: %q", cfg.Name, name)
+			}
+		}
+		f.labels.Store(newFamilyLabels(cfg, cfg.LabelNames))
+	}
+	if cfg.Type == config.MetricInfo {
+		f.identities = make(map[uint64]*metricValue)
+	}
+
+	return f, nil
+}
+
+// getLabels returns the label names of the family, or nil if they are not
+// yet known.
+func (f *metricFamily) getLabels() *familyLabels {
+	labels, _ := f.labels.Load().(*familyLabels)
+	return labels
+}
+
+// fixLabelNames sets the family's label names from the first series seen
+// when they come from capture groups.
+func (f *metricFamily) fixLabelNames(labels prometheus.Labels) (*familyLabels, error) {
+	f.labelsMtx.Lock()
+	defer f.labelsMtx.Unlock()
+
+	// Another rule may have got here first.
+	if fl := f.getLabels(); fl != nil {
+		return fl, nil
+	}
+
+	labelNames := make([]string, 0, len(labels))
+	for name := range labels {
+		if !model.LabelName(name).IsValid() {
+			return nil, fmt.Errorf("invalid label name: %q", name)
+		}
+		labelNames = append(labelNames, name)
+	}
+	sort.Strings(labelNames)
+
+	fl := newFamilyLabels(f.cfg, labelNames)
+	f.labels.Store(fl)
+	return fl, nil
+}
+
+// labelValues orders the values of labels by the family's label names,
+// returning an error if the label names of labels don't match the family.
+func (f *metricFamily) labelValues(labels prometheus.Labels) (*familyLabels, []string, error) {
+	fl := f.getLabels()
+	if fl == nil {
+		var err error
+		if fl, err = f.fixLabelNames(labels); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if len(labels) != len(fl.names) {
+		return nil, nil, fmt.Errorf("series has %d labels but %s has %d", len(labels), f.cfg.Name, len(fl.names))
+	}
+
+	labelValues := make([]string, len(fl.names))
+	for idx, name := range fl.names {
+		value, found := labels[name]
+		if !found {
+			return nil, nil, fmt.Errorf("series is missing label %q of %s", name, f.cfg.Name)
+		}
+		labelValues[idx] = value
+	}
+	return fl, labelValues, nil
+}
+
+// lookupSeries returns the stored series with the given label hash and the
+// labels the rule def produces for m and meta, or nil if there is none. The
+// labels are checked against the series without building them, so this is
+// allocation free in the common case.
+func (f *metricFamily) lookupSeries(hash uint64, def []config.LabelDef, m *pcre.Matcher, meta lineMetadata) *metricValue {
+	ptr, found := f.series.GetHashedKey(hash)
+	if !found {
+		return nil
+	}
+	fl := f.getLabels()
+	if metric := (*metricValue)(ptr); matchesDef(fl, metric, def, m, meta) {
+		return metric
+	}
+	for _, metric := range f.collisions(hash) {
+		if matchesDef(fl, metric, def, m, meta) {
+			return metric
+		}
+	}
+	return nil
+}
+
+func matchesDef(fl *familyLabels, metric *metricValue, def []config.LabelDef, m *pcre.Matcher, meta lineMetadata) bool {
+	if len(def) != len(metric.labelValues) {
+		return false
+	}
+	for _, v := range def {
+		name, _ := ParseLabelKey(v.Name, m, meta)
+		value, _ := ParseLabelKey(v.Value, m, meta)
+		idx, found := fl.index[name]
+		if !found || metric.labelValues[idx] != value {
+			return false
+		}
+	}
+	return true
+}
+
+// getSeries returns the stored series with exactly the given labels.
+func (f *metricFamily) getSeries(labels []*dto.LabelPair) *metricValue {
+	fl := f.getLabels()
+	if fl == nil || len(labels) != len(fl.names) {
+		return nil
+	}
+
+	var hash uint64
+	for _, lp := range labels {
+		hash += hashLabelPair(lp.GetName(), lp.GetValue())
+	}
+
+	ptr, found := f.series.GetHashedKey(hash)
+	if !found {
+		return nil
+	}
+	if metric := (*metricValue)(ptr); matchesPairs(fl, metric, labels) {
+		return metric
+	}
+	for _, metric := range f.collisions(hash) {
+		if matchesPairs(fl, metric, labels) {
+			return metric
+		}
+	}
+	return nil
+}
+
+func matchesPairs(fl *familyLabels, metric *metricValue, labels []*dto.LabelPair) bool {
+	for _, lp := range labels {
+		idx, found := fl.index[lp.GetName()]
+		if !found || metric.labelValues[idx] != lp.GetValue() {
+			return false
+		}
+	}
+	return true
+}
+
+// labelledSeries returns the stored series with exactly the given labels,
+// adding it if there is none.
+func (f *metricFamily) labelledSeries(labels prometheus.Labels, timeout time.Duration) (*metricValue, error) {
+	var hash uint64
+	for name, value := range labels {
+		hash += hashLabelPair(name, value)
+	}
+
+	ptr, found := f.series.GetHashedKey(hash)
+	if found {
+		fl := f.getLabels()
+		if metric := (*metricValue)(ptr); matchesLabels(fl, metric, labels) {
+			return metric, nil
+		}
+		for _, metric := range f.collisions(hash) {
+			if matchesLabels(fl, metric, labels) {
+				return metric, nil
+			}
+		}
+	}
+	metric, _, err := f.addSeries(hash, labels, timeout)
+	return metric, err
+}
+
+func matchesLabels(fl *familyLabels, metric *metricValue, labels prometheus.Labels) bool {
+	if len(labels) != len(metric.labelValues) {
+		return false
+	}
+	for name, value := range labels {
+		idx, found := fl.index[name]
+		if !found || metric.labelValues[idx] != value {
+			return false
+		}
+	}
+	return true
+}
+
+// addSeries stores a new series with labels under hash. If the series was
+// concurrently added it is returned instead, and created is false. A series
+// whose hash is already used by another series is chained in collided.
+func (f *metricFamily) addSeries(hash uint64, labels prometheus.Labels, timeout time.Duration) (metric *metricValue, created bool, err error) {
+	// Order the labels to match the rest of the metric family
+	fl, labelValues, err := f.labelValues(labels)
+	if err != nil {
+		return nil, false, err
+	}
+
+	f.seriesMtx.Lock()
+	defer f.seriesMtx.Unlock()
+
+	ptr, collided := f.series.GetHashedKey(hash)
+	if collided {
+		if metric := (*metricValue)(ptr); equalValues(metric.labelValues, labelValues) {
+			return metric, false, nil
+		}
+		for _, metric := range f.collisions(hash) {
+			if equalValues(metric.labelValues, labelValues) {
+				return metric, false, nil
+			}
+		}
+	}
+
+	metric = newMetricValue(fl.desc, f.valueType, timeout, hash, fl.names, labelValues)
+	switch f.cfg.Type {
+	case config.MetricHistogram:
+		metric.histogram = newHistogramValue(f.cfg.Buckets)
+	case config.MetricRate:
+		metric.rate = newRateValue(time.Duration(f.cfg.Window))
+	}
+	if !collided {
+		f.series.SetHashedKey(hash, unsafe.Pointer(metric)) // nolint: gas
+		return metric, true, nil
+	}
+
+	log.Debugln("Chaining series with a colliding label hash.")
+	f.collidedMtx.Lock()
+	defer f.collidedMtx.Unlock()
+	chain := f.collided[hash]
+	f.collided[hash] = append(chain[:len(chain):len(chain)], metric)
+	return metric, true, nil
+}
+
+func equalValues(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// collisions returns the series chained under hash. The returned slice is
+// never modified, so can be used without holding collidedMtx.
+func (f *metricFamily) collisions(hash uint64) []*metricValue {
+	f.collidedMtx.RLock()
+	defer f.collidedMtx.RUnlock()
+	return f.collided[hash]
+}
+
+// deleteSeries removes a stored series. A series chained under its hash
+// takes its place.
+func (f *metricFamily) deleteSeries(metric *metricValue) {
+	hash := metric.GetHash()
+	f.seriesMtx.Lock()
+	defer f.seriesMtx.Unlock()
+	f.collidedMtx.Lock()
+	defer f.collidedMtx.Unlock()
+
+	chain := f.collided[hash]
+	if ptr, found := f.series.GetHashedKey(hash); found && (*metricValue)(ptr) == metric {
+		if len(chain) == 0 {
+			f.series.DelHashedKey(hash)
+			return
+		}
+		f.series.SetHashedKey(hash, unsafe.Pointer(chain[0])) // nolint: gas
+		metric = chain[0]
+	}
+	for idx, chained := range chain {
+		if chained != metric {
+			continue
+		}
+		if len(chain) == 1 {
+			delete(f.collided, hash)
+		} else {
+			rest := make([]*metricValue, 0, len(chain)-1)
+			f.collided[hash] = append(append(rest, chain[:idx]...), chain[idx+1:]...)
+		}
+		return
+	}
+}
+
+// eachSeries calls fn with every stored series, including chained ones. fn
+// may delete the series. The chains are read first, so a chained series which
+// takes the place of a deleted one is still visited once.
+func (f *metricFamily) eachSeries(fn func(metric *metricValue)) {
+	f.collidedMtx.RLock()
+	chains := make([][]*metricValue, 0, len(f.collided))
+	for _, chain := range f.collided {
+		chains = append(chains, chain)
+	}
+	f.collidedMtx.RUnlock()
+
+	for kv := range f.series.Iter() {
+		fn((*metricValue)(kv.Value))
+	}
+	for _, chain := range chains {
+		for _, metric := range chain {
+			fn(metric)
+		}
+	}
+}
+
+// seriesLen returns the number of stored series.
+func (f *metricFamily) seriesLen() int {
+	n := int(f.series.Len())
+	f.collidedMtx.RLock()
+	defer f.collidedMtx.RUnlock()
+	for _, chain := range f.collided {
+		n += len(chain)
+	}
+	return n
+}
+
+// Describe implements prometheus.Collector. Nothing is described until the
+// family's label names are known.
+func (f *metricFamily) Describe(ch chan<- *prometheus.Desc) {
+	if fl := f.getLabels(); fl != nil {
+		ch <- fl.desc
+	}
+}
+
+// Collect sends every stored series to ch, expiring stale series after they
+// have been sent. It returns the number of series expired.
+func (f *metricFamily) Collect(ch chan<- prometheus.Metric) (expired int) {
+	f.eachSeries(func(metric *metricValue) {
+		ch <- metric
+		// Maybe GC the metric if it hasn't been updated for a while.
+		// Doing this after a collection biases us to reporting existent
+		// metrics at least once.
+		if f.expireSeries(metric) {
+			expired++
+		}
+	})
+	return expired
+}
+
+// expireSeries deletes metric if it is stale, returning whether it was.
+// Everything which exports the series calls this after exporting them, so
+// series expire whether they are scraped or remote written.
+func (f *metricFamily) expireSeries(metric *metricValue) bool {
+	if !metric.IsStale() {
+		return false
+	}
+	log.Debugln("Expiring stale metric from cache.")
+	f.deleteSeries(metric)
+	if f.identities != nil {
+		f.forgetIdentity(metric)
+	}
+	return true
+}
+
+// identity returns the hash of the identity label values of a series of an
+// info family.
+func (f *metricFamily) identity(metric *metricValue) uint64 {
+	fl := f.getLabels()
+	var hash uint64
+	for _, name := range f.cfg.Identity {
+		if idx, found := fl.index[name]; found {
+			hash += hashLabelPair(name, metric.labelValues[idx])
+		}
+	}
+	return hash
+}
+
+// sameIdentity returns whether two series of an info family have the same
+// identity label values.
+func (f *metricFamily) sameIdentity(a, b *metricValue) bool {
+	fl := f.getLabels()
+	for _, name := range f.cfg.Identity {
+		if idx, found := fl.index[name]; found && a.labelValues[idx] != b.labelValues[idx] {
+			return false
+		}
+	}
+	return true
+}
+
+// replaceIdentity makes a new series of an info family the series of its
+// identity, deleting the series it replaces.
+func (f *metricFamily) replaceIdentity(metric *metricValue) {
+	identity := f.identity(metric)
+	f.identitiesMtx.Lock()
+	defer f.identitiesMtx.Unlock()
+	if prev, found := f.identities[identity]; found && prev != metric && f.sameIdentity(prev, metric) {
+		log.Debugln("Replacing info metric series with new labels.")
+		f.deleteSeries(prev)
+	}
+	f.identities[identity] = metric
+}
+
+// forgetIdentity removes an expired series of an info family from the
+// identities, unless it has already been replaced.
+func (f *metricFamily) forgetIdentity(metric *metricValue) {
+	identity := f.identity(metric)
+	f.identitiesMtx.Lock()
+	defer f.identitiesMtx.Unlock()
+	if f.identities[identity] == metric {
+		delete(f.identities, identity)
+	}
+}
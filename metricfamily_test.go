@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/wrouesnel/tail_exporter/config"
+)
+
+func newTestFamily(t *testing.T) *metricFamily {
+	f, err := newMetricFamily(&config.MetricFamily{
+		Name:       "test_metric",
+		Help:       "test metric",
+		Type:       config.MetricGauge,
+		LabelNames: []string{"a", "b"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestSeriesHashesDistinct(t *testing.T) {
+	f := newTestFamily(t)
+	for i := 0; i < 1000; i++ {
+		for j := 0; j < 10; j++ {
+			labels := prometheus.Labels{"a": fmt.Sprint(i), "b": fmt.Sprint(j)}
+			if _, err := f.labelledSeries(labels, 0); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if n := f.seriesLen(); n != 10000 {
+		t.Errorf("expected 10000 series, got %d", n)
+	}
+	if len(f.collided) != 0 {
+		t.Errorf("expected no hash collisions, got %d", len(f.collided))
+	}
+}
+
+func TestSeriesHashCollision(t *testing.T) {
+	f := newTestFamily(t)
+	var stored []*metricValue
+	for i := 0; i < 3; i++ {
+		metric, created, err := f.addSeries(42, prometheus.Labels{"a": fmt.Sprint(i), "b": "x"}, 0)
+		if err != nil || !created {
+			t.Fatalf("series %d not created: %v", i, err)
+		}
+		metric.Set(float64(i))
+		stored = append(stored, metric)
+	}
+
+	metric, created, err := f.addSeries(42, prometheus.Labels{"a": "1", "b": "x"}, 0)
+	if err != nil || created || metric != stored[1] {
+		t.Fatalf("expected the chained series to be found, got %v %v", metric, err)
+	}
+	if n := f.seriesLen(); n != 3 {
+		t.Fatalf("expected 3 series, got %d", n)
+	}
+
+	// Deleting the series in the map promotes a chained one.
+	f.deleteSeries(stored[0])
+	if n := f.seriesLen(); n != 2 {
+		t.Fatalf("expected 2 series after deletion, got %d", n)
+	}
+	var seen []float64
+	f.eachSeries(func(metric *metricValue) {
+		seen = append(seen, metric.Get())
+	})
+	if len(seen) != 2 || seen[0]+seen[1] != 3 {
+		t.Errorf("expected series 1 and 2 to remain, got %v", seen)
+	}
+
+	f.deleteSeries(stored[1])
+	f.deleteSeries(stored[2])
+	if n := f.seriesLen(); n != 0 || len(f.collided) != 0 {
+		t.Errorf("expected no series, got %d", n)
+	}
+}
+
+func TestDynamicLabelNames(t *testing.T) {
+	c := newTestCollector(t, `
+metric_configs:
+- name: pairs
+  help: key value pairs
+  regex: '^a (\S+)=(\S+)'
+  labels:
+  - name: $1
+    value: $2
+  value: +1
+- name: pairs
+  help: key value pairs
+  regex: '^b (\S+)=(\S+)'
+  labels:
+  - name: $1
+    value: $2
+  value: +1
+`)
+	defer c.Close()
+	a := c.newRule(0, &c.cfg.MetricConfigs[0], c.families[0])
+	b := c.newRule(1, &c.cfg.MetricConfigs[1], c.families[0])
+
+	// The first series fixes the family's label names for every rule.
+	c.processLine(logLine{text: "a x=1"}, a)
+	c.processLine(logLine{text: "b y=2"}, b)
+	c.processLine(logLine{text: "b x=3"}, b)
+	c.processLine(logLine{text: "a z=4"}, a)
+
+	f := c.families[0]
+	if names := f.getLabels().names; len(names) != 1 || names[0] != "x" {
+		t.Errorf("expected the label names to be [x], got %v", names)
+	}
+	if n := f.seriesLen(); n != 2 {
+		t.Errorf("expected 2 series, got %d", n)
+	}
+	for _, r := range []*rule{a, b} {
+		if value := readValue(t, r.rejectedLines[rejectInconsistentLabels]); value != 1 {
+			t.Errorf("expected 1 line with inconsistent labels, got %v", value)
+		}
+	}
+}
@@ -1,113 +1,353 @@
 package main
 
 import (
-	"crypto/sha256"
+	"errors"
 	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/golang/protobuf/proto"
 	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/wrouesnel/tail_exporter/config"
 )
 
 // metricValue stores the typed value of a metric being collected by the
-// exporter.
+// exporter. It implements prometheus.Metric so stored series can be
+// collected directly.
 type metricValue struct {
-	// desc is the prometheus description of this metric value.
+	// valBits is the math.Float64bits of the current value. It is accessed
+	// atomically, and so is kept first to guarantee 64-bit alignment.
+	valBits uint64
+	// stores the UnixNano time of the last update for GC purposes. Accessed
+	// atomically.
+	lastUpdated int64
+	// loggedAt is the UnixNano log timestamp of the last update, if the
+	// rule which made it extracts one. Accessed atomically.
+	loggedAt int64
+	// hash identifying the series within its metricFamily
+	hash uint64
+	// desc is the prometheus description of this metric value, shared with
+	// the rest of its metricFamily
 	desc *prometheus.Desc
-	// hash representing a structured interpretation of label values
-	hash string
+	// labelValues of the series, ordered by its metricFamily's label names
+	labelValues []string
+	// labelPairs are built once when the series is created.
+	labelPairs []*dto.LabelPair
 	// valueType is the prometheus TYPE of the generated metric
 	valueType prometheus.ValueType
-	// value is the current value of the internal metric
-	value float64
 	// metric timeout for GC purposes
 	timeout time.Duration
-	// stores the time of the last update for GC purposes
-	lastUpdated time.Time
+	// created is when the series was first seen
+	created time.Time
+	// lastExemplar holds the *exemplar of the last update, if the rule
+	// which made it extracts one.
+	lastExemplar atomic.Value
+	// histogram holds the observations of a histogram series, which has
+	// no value of its own.
+	histogram *histogramValue
+	// rate holds the values recently added to a rate series, which it
+	// reports instead of its own value.
+	rate *rateValue
 }
 
-func newMetricValue(fqName string, help string, valueType config.MetricType, timeout time.Duration, labelPairs prometheus.Labels) (*metricValue, error) {
-	metric := &metricValue{}
+// histogramValue is the observations of a histogram series.
+type histogramValue struct {
+	mtx         sync.Mutex
+	upperBounds []float64
+	// counts are the number of observations in each bucket, excluding
+	// those counted in lower buckets.
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func newHistogramValue(upperBounds []float64) *histogramValue {
+	return &histogramValue{
+		upperBounds: upperBounds,
+		counts:      make([]uint64, len(upperBounds)),
+	}
+}
+
+// observe records n observations of v.
+func (h *histogramValue) observe(v float64, n uint64) {
+	idx := sort.SearchFloat64s(h.upperBounds, v)
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	if idx < len(h.counts) {
+		h.counts[idx] += n
+	}
+	h.count += n
+	h.sum += v * float64(n)
+}
+
+// write returns the histogram's buckets, sum and count.
+func (h *histogramValue) write() *dto.Histogram {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	out := &dto.Histogram{
+		SampleCount: proto.Uint64(h.count),
+		SampleSum:   proto.Float64(h.sum),
+		Bucket:      make([]*dto.Bucket, len(h.upperBounds)),
+	}
+	var cumulative uint64
+	for idx, upperBound := range h.upperBounds {
+		cumulative += h.counts[idx]
+		out.Bucket[idx] = &dto.Bucket{
+			CumulativeCount: proto.Uint64(cumulative),
+			UpperBound:      proto.Float64(upperBound),
+		}
+	}
+	return out
+}
+
+// rateSlots is the number of slots the window of a rate series is divided
+// into. Values leave the window a slot at a time.
+const rateSlots = 60
+
+// rateValue is the sum of the values added to a rate series in a sliding
+// window.
+type rateValue struct {
+	mtx    sync.Mutex
+	window time.Duration
+	slot   time.Duration
+	// sums are the values added in each slot of the window, and slots the
+	// number since the epoch of the slot each sum is for.
+	sums  [rateSlots]float64
+	slots [rateSlots]int64
+}
+
+func newRateValue(window time.Duration) *rateValue {
+	return &rateValue{
+		window: window,
+		slot:   window / rateSlots,
+	}
+}
+
+// add adds v to the window at now.
+func (r *rateValue) add(v float64, now time.Time) {
+	slot := now.UnixNano() / int64(r.slot)
+	idx := slot % rateSlots
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if r.slots[idx] != slot {
+		r.slots[idx] = slot
+		r.sums[idx] = 0
+	}
+	r.sums[idx] += v
+}
 
+// get returns the per second rate of the values in the window at now.
+func (r *rateValue) get(now time.Time) float64 {
+	slot := now.UnixNano() / int64(r.slot)
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	var sum float64
+	for idx := range r.sums {
+		if slot-r.slots[idx] < rateSlots {
+			sum += r.sums[idx]
+		}
+	}
+	return sum / r.window.Seconds()
+}
+
+// prometheusValueType converts a configured metric type to its prometheus
+// equivalent.
+func prometheusValueType(valueType config.MetricType) (prometheus.ValueType, error) {
 	switch valueType {
 	case config.MetricUntyped:
-		metric.valueType = prometheus.UntypedValue
+		return prometheus.UntypedValue, nil
 	case config.MetricGauge:
-		metric.valueType = prometheus.GaugeValue
+		return prometheus.GaugeValue, nil
 	case config.MetricCounter:
-		metric.valueType = prometheus.CounterValue
+		return prometheus.CounterValue, nil
+	case config.MetricRate, config.MetricInfo:
+		return prometheus.GaugeValue, nil
+	case config.MetricHistogram:
+		// Histograms aren't a prometheus.ValueType, but have a value
+		// type to write their series with.
+		return prometheus.UntypedValue, nil
 	default:
-		return nil, fmt.Errorf("unknown metric value type: %s", valueType)
+		return 0, fmt.Errorf("unknown metric value type: %v", valueType)
 	}
+}
 
-	metric.desc = prometheus.NewDesc(fqName, help, []string{}, labelPairs)
-
-	// Calculate the hash of the new metric from it's labels
-	h := sha256.New()
-	if _, err := h.Write([]byte(metric.desc.String())); err != nil {
-		return nil, fmt.Errorf("error while calculating metric hash: %v", err)
+// newMetricValue creates a series. labelNames must be sorted, and match the
+// variable labels of desc.
+func newMetricValue(desc *prometheus.Desc, valueType prometheus.ValueType, timeout time.Duration,
+	hash uint64, labelNames []string, labelValues []string) *metricValue {
+	metric := &metricValue{
+		hash:        hash,
+		desc:        desc,
+		labelValues: labelValues,
+		labelPairs:  make([]*dto.LabelPair, len(labelNames)),
+		valueType:   valueType,
+		timeout:     timeout,
+		created:     time.Now(),
 	}
-	metric.hash = string(h.Sum(nil))
 
-	metric.timeout = timeout
+	for idx, name := range labelNames {
+		metric.labelPairs[idx] = &dto.LabelPair{
+			Name:  proto.String(name),
+			Value: proto.String(labelValues[idx]),
+		}
+	}
 
-	return metric, nil
+	return metric
 }
 
-func (mv *metricValue) Describe(ch chan<- *prometheus.Desc) {
-	ch <- mv.desc
+// Desc implements prometheus.Metric.
+func (mv *metricValue) Desc() *prometheus.Desc {
+	return mv.desc
 }
 
-func (mv *metricValue) Collect(ch chan<- prometheus.Metric) {
-	// Metrics are dynamically generated when needed, because value updates
-	// are common but scrapes are infrequent.
-	// TODO: implement prometheus.Metric directly.
-	ch <- prometheus.MustNewConstMetric(mv.desc, mv.valueType, mv.value)
+// Write implements prometheus.Metric.
+func (mv *metricValue) Write(out *dto.Metric) error {
+	out.Label = mv.labelPairs
+	if mv.histogram != nil {
+		out.Histogram = mv.histogram.write()
+		return nil
+	}
+	value := proto.Float64(mv.Get())
+
+	switch mv.valueType {
+	case prometheus.CounterValue:
+		out.Counter = &dto.Counter{Value: value}
+	case prometheus.GaugeValue:
+		out.Gauge = &dto.Gauge{Value: value}
+	case prometheus.UntypedValue:
+		out.Untyped = &dto.Untyped{Value: value}
+	default:
+		return fmt.Errorf("encountered unknown type %v", mv.valueType)
+	}
+	return nil
 }
 
-// GetHash gets a cryptographically strong hash which describes the metric
-// uniquely. This is currently SHA256 but is not considered a stable interface.
-func (mv *metricValue) GetHash() string {
+// GetHash gets the hash which identifies the series within its metric
+// family. It is not considered a stable interface.
+func (mv *metricValue) GetHash() uint64 {
 	return mv.hash
 }
 
 // Get returns the current value
 func (mv *metricValue) Get() float64 {
-	return mv.value
+	if mv.rate != nil {
+		return mv.rate.get(time.Now())
+	}
+	return math.Float64frombits(atomic.LoadUint64(&mv.valBits))
+}
+
+// touch records an update for GC purposes
+func (mv *metricValue) touch() {
+	atomic.StoreInt64(&mv.lastUpdated, time.Now().UnixNano())
 }
 
 // Set sets the current value
 func (mv *metricValue) Set(v float64) {
 	// TODO: prevent counter from going < 0?
-	mv.value = v
-	mv.lastUpdated = time.Now()
+	atomic.StoreUint64(&mv.valBits, math.Float64bits(v))
+	mv.touch()
 }
 
 // Sub decreases the stored value by v
 func (mv *metricValue) Sub(v float64) {
 	if mv.valueType == prometheus.CounterValue {
-		mv.value = 0
+		atomic.StoreUint64(&mv.valBits, math.Float64bits(0))
 	} else {
-		mv.value -= v
+		for {
+			oldBits := atomic.LoadUint64(&mv.valBits)
+			newBits := math.Float64bits(math.Float64frombits(oldBits) - v)
+			if atomic.CompareAndSwapUint64(&mv.valBits, oldBits, newBits) {
+				break
+			}
+		}
 	}
-	mv.lastUpdated = time.Now()
+	mv.touch()
 }
 
 // Add increases the stored value by v
 func (mv *metricValue) Add(v float64) {
-	mv.value += v
-	// Check for an overflow
-	if mv.value < 0 && mv.valueType == prometheus.CounterValue {
-		mv.value = 0
+	if mv.rate != nil {
+		mv.rate.add(v, time.Now())
+		mv.touch()
+		return
+	}
+	for {
+		oldBits := atomic.LoadUint64(&mv.valBits)
+		value := math.Float64frombits(oldBits) + v
+		// Check for an overflow
+		if value < 0 && mv.valueType == prometheus.CounterValue {
+			value = 0
+		}
+		if atomic.CompareAndSwapUint64(&mv.valBits, oldBits, math.Float64bits(value)) {
+			break
+		}
+	}
+	mv.touch()
+}
+
+// errNotHistogram is returned when observing a series which isn't a histogram.
+var errNotHistogram = errors.New("series is not a histogram")
+
+// Observe records n observations of v in a histogram series. Other series
+// are left unchanged.
+func (mv *metricValue) Observe(v float64, n uint64) error {
+	if mv.histogram == nil {
+		return errNotHistogram
+	}
+	mv.histogram.observe(v, n)
+	mv.touch()
+	return nil
+}
+
+// SetLoggedAt records the log timestamp of the latest update.
+func (mv *metricValue) SetLoggedAt(t time.Time) {
+	atomic.StoreInt64(&mv.loggedAt, t.UnixNano())
+}
+
+// LoggedAt returns the log timestamp of the latest update, or the zero time
+// if it isn't known.
+func (mv *metricValue) LoggedAt() time.Time {
+	nsecs := atomic.LoadInt64(&mv.loggedAt)
+	if nsecs == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, nsecs)
+}
+
+// SetExemplar records the exemplar of the latest update.
+func (mv *metricValue) SetExemplar(ex *exemplar) {
+	mv.lastExemplar.Store(ex)
+}
+
+// Metadata returns the OpenMetrics detail of the series.
+func (mv *metricValue) Metadata() seriesMetadata {
+	ex, _ := mv.lastExemplar.Load().(*exemplar)
+	return seriesMetadata{
+		created:  mv.created,
+		exemplar: ex,
 	}
-	mv.lastUpdated = time.Now()
 }
 
 // IsStale reports if the metric has exceeded its timeout, provided its timeout
-// is greater then 0.
+// is greater then 0. A rate series isn't stale until its last update has left
+// its window, and without a timeout is stale as soon as it has.
 func (mv *metricValue) IsStale() bool {
-	if mv.timeout > 0 {
-		return time.Since(mv.lastUpdated) > mv.timeout
+	return mv.isStale(time.Now())
+}
+
+// isStale reports if the metric is stale at now.
+func (mv *metricValue) isStale(now time.Time) bool {
+	if mv.timeout <= 0 && mv.rate == nil {
+		return false
+	}
+	lastUpdated := time.Unix(0, atomic.LoadInt64(&mv.lastUpdated))
+	idle := now.Sub(lastUpdated)
+	if mv.rate != nil && idle <= mv.rate.window {
+		return false
 	}
-	return false
+	return idle > mv.timeout
 }
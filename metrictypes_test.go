@@ -0,0 +1,70 @@
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestRateValue(t *testing.T) {
+	start := time.Unix(1500000000, 0)
+	r := newRateValue(time.Minute)
+	r.add(30, start)
+	r.add(30, start.Add(30*time.Second))
+
+	for _, tc := range []struct {
+		at       time.Duration
+		expected float64
+	}{
+		{0, 1},
+		{30 * time.Second, 1},
+		{59 * time.Second, 1},
+		// Values leave the window a slot at a time.
+		{60 * time.Second, 0.5},
+		{89 * time.Second, 0.5},
+		{90 * time.Second, 0},
+	} {
+		if rate := r.get(start.Add(tc.at)); rate != tc.expected {
+			t.Errorf("expected a rate of %v after %v, got %v", tc.expected, tc.at, rate)
+		}
+	}
+
+	// A slot is reset when it is reused by a later window.
+	r.add(6, start.Add(2*time.Minute))
+	if rate := r.get(start.Add(2 * time.Minute)); rate != 0.1 {
+		t.Errorf("expected a rate of 0.1 from a reused slot, got %v", rate)
+	}
+}
+
+func TestRateSeriesStale(t *testing.T) {
+	desc := prometheus.NewDesc("test_rate", "test rate", nil, nil)
+	newSeries := func(timeout time.Duration, window time.Duration) (*metricValue, time.Time) {
+		mv := newMetricValue(desc, prometheus.GaugeValue, timeout, 0, nil, nil)
+		if window != 0 {
+			mv.rate = newRateValue(window)
+		}
+		mv.Add(1)
+		return mv, time.Unix(0, atomic.LoadInt64(&mv.lastUpdated))
+	}
+
+	noTimeout, noTimeoutUpdated := newSeries(0, time.Minute)
+	timeout, timeoutUpdated := newSeries(3*time.Minute, time.Minute)
+	gauge, gaugeUpdated := newSeries(0, 0)
+	if noTimeout.isStale(noTimeoutUpdated.Add(time.Minute)) || timeout.isStale(timeoutUpdated.Add(time.Minute)) {
+		t.Error("expected rate series with values in their window not to be stale")
+	}
+	if !noTimeout.isStale(noTimeoutUpdated.Add(time.Minute + time.Second)) {
+		t.Error("expected a rate series without a timeout to be stale once its window is empty")
+	}
+	if timeout.isStale(timeoutUpdated.Add(2 * time.Minute)) {
+		t.Error("expected a rate series not to be stale before its timeout")
+	}
+	if !timeout.isStale(timeoutUpdated.Add(3*time.Minute + time.Second)) {
+		t.Error("expected a rate series to be stale after its timeout")
+	}
+	if gauge.isStale(gaugeUpdated.Add(time.Hour)) {
+		t.Error("expected a series without a timeout never to be stale")
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// Bounds on the msgpack values decoded, so a corrupt or hostile stream can't
+// exhaust memory or the stack.
+const (
+	msgpackMaxLength = 64 << 20
+	msgpackMaxDepth  = 32
+)
+
+// msgpackExt is a msgpack extension value.
+type msgpackExt struct {
+	Type int8
+	Data []byte
+}
+
+// msgpackDecoder decodes a stream of msgpack values. Maps decode to
+// map[string]interface{}, arrays to []interface{}, strings to string, binary
+// to []byte, signed integers to int64 and unsigned integers above 127 to
+// uint64.
+type msgpackDecoder struct {
+	r   *bufio.Reader
+	buf [8]byte
+}
+
+func newMsgpackDecoder(r io.Reader) *msgpackDecoder {
+	return &msgpackDecoder{r: bufio.NewReader(r)}
+}
+
+// Decode returns the next value of the stream, or io.EOF if the stream ended
+// between values.
+func (d *msgpackDecoder) Decode() (interface{}, error) {
+	b, err := d.r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	v, err := d.decode(b, 0)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return v, err
+}
+
+func (d *msgpackDecoder) value(depth int) (interface{}, error) {
+	b, err := d.r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	return d.decode(b, depth)
+}
+
+func (d *msgpackDecoder) decode(b byte, depth int) (interface{}, error) {
+	if depth > msgpackMaxDepth {
+		return nil, errors.New("msgpack value nested too deeply")
+	}
+
+	switch {
+	case b <= 0x7f:
+		return int64(b), nil
+	case b >= 0xe0:
+		return int64(int8(b)), nil
+	case b&0xf0 == 0x80:
+		return d.decodeMap(int(b&0x0f), depth)
+	case b&0xf0 == 0x90:
+		return d.decodeArray(int(b&0x0f), depth)
+	case b&0xe0 == 0xa0:
+		return d.decodeString(int(b & 0x1f))
+	}
+
+	switch b {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xc5, 0xc6:
+		n, err := d.length(1 << (b - 0xc4))
+		if err != nil {
+			return nil, err
+		}
+		return d.bytes(n)
+	case 0xc7, 0xc8, 0xc9:
+		n, err := d.length(1 << (b - 0xc7))
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeExt(n)
+	case 0xca:
+		u, err := d.uint(4)
+		return float64(math.Float32frombits(uint32(u))), err
+	case 0xcb:
+		u, err := d.uint(8)
+		return math.Float64frombits(u), err
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		return d.uint(1 << (b - 0xcc))
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		size := 1 << (b - 0xd0)
+		u, err := d.uint(size)
+		// Sign extend from the integer's size.
+		shift := uint(64 - 8*size)
+		return int64(u<<shift) >> shift, err
+	case 0xd4, 0xd5, 0xd6, 0xd7, 0xd8:
+		return d.decodeExt(1 << (b - 0xd4))
+	case 0xd9, 0xda, 0xdb:
+		n, err := d.length(1 << (b - 0xd9))
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeString(n)
+	case 0xdc, 0xdd:
+		n, err := d.length(2 << (b - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeArray(n, depth)
+	case 0xde, 0xdf:
+		n, err := d.length(2 << (b - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeMap(n, depth)
+	}
+	return nil, fmt.Errorf("invalid msgpack type 0x%02x", b)
+}
+
+// uint reads a big endian unsigned integer of size bytes.
+func (d *msgpackDecoder) uint(size int) (uint64, error) {
+	buf := d.buf[8-size:]
+	for i := range d.buf {
+		d.buf[i] = 0
+	}
+	if _, err := io.ReadFull(d.r, buf); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint64(d.buf[:]), nil
+}
+
+// length reads the length of a value, in size bytes.
+func (d *msgpackDecoder) length(size int) (int, error) {
+	n, err := d.uint(size)
+	if err != nil {
+		return 0, err
+	}
+	if n > msgpackMaxLength {
+		return 0, fmt.Errorf("msgpack value length %d is too long", n)
+	}
+	return int(n), nil
+}
+
+// bytes reads n bytes. They are buffered as they are read rather than
+// allocated up front, since n is only checked against the stream as it is
+// read.
+func (d *msgpackDecoder) bytes(n int) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.Grow(capacity(n))
+	_, err := io.CopyN(&buf, d.r, int64(n))
+	return buf.Bytes(), err
+}
+
+func (d *msgpackDecoder) decodeString(n int) (interface{}, error) {
+	data, err := d.bytes(n)
+	return string(data), err
+}
+
+func (d *msgpackDecoder) decodeExt(n int) (interface{}, error) {
+	extType, err := d.r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	data, err := d.bytes(n)
+	return msgpackExt{Type: int8(extType), Data: data}, err
+}
+
+// capacity bounds the capacity allocated up front for n elements, since n is
+// only checked against the stream as the elements are read.
+func capacity(n int) int {
+	if n > 1024 {
+		return 1024
+	}
+	return n
+}
+
+func (d *msgpackDecoder) decodeArray(n int, depth int) (interface{}, error) {
+	array := make([]interface{}, 0, capacity(n))
+	for i := 0; i < n; i++ {
+		v, err := d.value(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		array = append(array, v)
+	}
+	return array, nil
+}
+
+func (d *msgpackDecoder) decodeMap(n int, depth int) (interface{}, error) {
+	m := make(map[string]interface{}, capacity(n))
+	for i := 0; i < n; i++ {
+		k, err := d.value(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		v, err := d.value(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		switch k := k.(type) {
+		case string:
+			m[k] = v
+		case []byte:
+			m[string(k)] = v
+		default:
+			m[fmt.Sprint(k)] = v
+		}
+	}
+	return m, nil
+}
+
+// appendMsgpackString appends the msgpack encoding of s to buf.
+func appendMsgpackString(buf []byte, s string) []byte {
+	switch n := len(s); {
+	case n < 32:
+		buf = append(buf, 0xa0|byte(n))
+	case n < 1<<8:
+		buf = append(buf, 0xd9, byte(n))
+	case n < 1<<16:
+		buf = append(buf, 0xda, byte(n>>8), byte(n))
+	default:
+		buf = append(buf, 0xdb, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	}
+	return append(buf, s...)
+}
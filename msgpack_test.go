@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+	"reflect"
+	"runtime"
+	"testing"
+)
+
+// packMsgpack returns the msgpack encoding of v, which is made of the types
+// msgpackDecoder decodes to, or ints.
+func packMsgpack(v interface{}) []byte {
+	return appendMsgpack(nil, v)
+}
+
+func appendMsgpack(buf []byte, v interface{}) []byte {
+	appendUint := func(buf []byte, u uint64, size int) []byte {
+		var b [8]byte
+		binary.BigEndian.PutUint64(b[:], u)
+		return append(buf, b[8-size:]...)
+	}
+
+	switch v := v.(type) {
+	case nil:
+		return append(buf, 0xc0)
+	case bool:
+		if v {
+			return append(buf, 0xc3)
+		}
+		return append(buf, 0xc2)
+	case int:
+		return appendMsgpack(buf, int64(v))
+	case int64:
+		return appendUint(append(buf, 0xd3), uint64(v), 8)
+	case uint64:
+		return appendUint(append(buf, 0xcf), v, 8)
+	case float64:
+		return appendUint(append(buf, 0xcb), math.Float64bits(v), 8)
+	case string:
+		return appendMsgpackString(buf, v)
+	case []byte:
+		return append(appendUint(append(buf, 0xc6), uint64(len(v)), 4), v...)
+	case msgpackExt:
+		buf = appendUint(append(buf, 0xc9), uint64(len(v.Data)), 4)
+		return append(append(buf, byte(v.Type)), v.Data...)
+	case []interface{}:
+		buf = appendUint(append(buf, 0xdd), uint64(len(v)), 4)
+		for _, elem := range v {
+			buf = appendMsgpack(buf, elem)
+		}
+		return buf
+	case map[string]interface{}:
+		buf = appendUint(append(buf, 0xdf), uint64(len(v)), 4)
+		for name, elem := range v {
+			buf = appendMsgpack(appendMsgpackString(buf, name), elem)
+		}
+		return buf
+	}
+	panic("can't encode " + reflect.TypeOf(v).String())
+}
+
+func TestMsgpackDecode(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		data     []byte
+		expected interface{}
+	}{
+		{"positive fixint", []byte{0x7f}, int64(127)},
+		{"negative fixint", []byte{0xe0}, int64(-32)},
+		{"uint8", []byte{0xcc, 0xff}, uint64(255)},
+		{"uint16", []byte{0xcd, 0x01, 0x00}, uint64(256)},
+		{"int8", []byte{0xd0, 0x80}, int64(-128)},
+		{"int16", []byte{0xd1, 0xff, 0x00}, int64(-256)},
+		{"int32", []byte{0xd2, 0xff, 0xff, 0xff, 0xfe}, int64(-2)},
+		{"float32", []byte{0xca, 0x3f, 0xc0, 0x00, 0x00}, float64(1.5)},
+		{"fixstr", []byte{0xa3, 'f', 'o', 'o'}, "foo"},
+		{"str8", []byte{0xd9, 0x03, 'f', 'o', 'o'}, "foo"},
+		{"bin8", []byte{0xc4, 0x02, 0x00, 0x01}, []byte{0x00, 0x01}},
+		{"fixext4", []byte{0xd6, 0x00, 0x01, 0x02, 0x03, 0x04}, msgpackExt{Type: 0, Data: []byte{1, 2, 3, 4}}},
+		{"fixarray", []byte{0x92, 0x01, 0xc0}, []interface{}{int64(1), nil}},
+		{"fixmap", []byte{0x82, 0xa1, 'a', 0xc3, 0x01, 0xc2}, map[string]interface{}{"a": true, "1": false}},
+		{"nested", packMsgpack([]interface{}{"tag", map[string]interface{}{
+			"log": "hello", "bytes": []byte("raw"), "level": int64(-3), "size": uint64(1 << 40), "ratio": 0.25,
+		}}), []interface{}{"tag", map[string]interface{}{
+			"log": "hello", "bytes": []byte("raw"), "level": int64(-3), "size": uint64(1 << 40), "ratio": 0.25,
+		}}},
+	} {
+		v, err := newMsgpackDecoder(bytes.NewReader(tc.data)).Decode()
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.name, err)
+		} else if !reflect.DeepEqual(v, tc.expected) {
+			t.Errorf("%s: expected %#v, got %#v", tc.name, tc.expected, v)
+		}
+
+		// Every truncation of a value is an error, rather than a value.
+		for n := 1; n < len(tc.data); n++ {
+			if v, err := newMsgpackDecoder(bytes.NewReader(tc.data[:n])).Decode(); err != io.ErrUnexpectedEOF {
+				t.Errorf("%s: expected %d bytes to be truncated, got %#v, %v", tc.name, n, v, err)
+			}
+		}
+	}
+
+	// A stream ends cleanly only between values.
+	d := newMsgpackDecoder(bytes.NewReader([]byte{0x01, 0x02}))
+	for _, expected := range []int64{1, 2} {
+		if v, err := d.Decode(); err != nil || v != expected {
+			t.Errorf("expected %d, got %v, %v", expected, v, err)
+		}
+	}
+	if _, err := d.Decode(); err != io.EOF {
+		t.Errorf("expected the stream to end, got %v", err)
+	}
+}
+
+func TestMsgpackDecodeBounds(t *testing.T) {
+	nested := bytes.Repeat([]byte{0x91}, msgpackMaxDepth+2)
+	for _, tc := range []struct {
+		name string
+		data []byte
+	}{
+		{"invalid type", []byte{0xc1}},
+		{"too long string", []byte{0xdb, 0x04, 0x00, 0x00, 0x01, 'a'}},
+		{"too long binary", []byte{0xc6, 0xff, 0xff, 0xff, 0xff}},
+		{"too long array", []byte{0xdd, 0x04, 0x00, 0x00, 0x01, 0x01}},
+		{"too deep", append(nested, 0x01)},
+	} {
+		if v, err := newMsgpackDecoder(bytes.NewReader(tc.data)).Decode(); err == nil || err == io.ErrUnexpectedEOF {
+			t.Errorf("%s: expected the value to be rejected, got %#v, %v", tc.name, v, err)
+		}
+	}
+
+	// Lengths within the limit only cost what the stream actually holds.
+	for _, header := range [][]byte{
+		{0xdb, 0x04, 0x00, 0x00, 0x00},
+		{0xc6, 0x04, 0x00, 0x00, 0x00},
+		{0xdd, 0x04, 0x00, 0x00, 0x00},
+	} {
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		_, err := newMsgpackDecoder(bytes.NewReader(append(header, 0x01, 0x02))).Decode()
+		runtime.ReadMemStats(&after)
+		if err != io.ErrUnexpectedEOF {
+			t.Errorf("0x%02x: expected a truncated value, got %v", header[0], err)
+		}
+		if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1<<20 {
+			t.Errorf("0x%02x: expected a truncated value to allocate little, allocated %d bytes", header[0], allocated)
+		}
+	}
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/model"
+)
+
+const openMetricsContentType = `application/openmetrics-text; version=1.0.0; charset=utf-8`
+
+// exemplar identifies the line which last updated a series.
+type exemplar struct {
+	// labels are sorted by name
+	labels    []*dto.LabelPair
+	value     float64
+	timestamp time.Time
+}
+
+// seriesMetadata is the detail of a series which only OpenMetrics can
+// expose, and which the vendored client_model can't carry.
+type seriesMetadata struct {
+	created  time.Time
+	exemplar *exemplar
+	// timestamp, if set, is exposed as the timestamp of the series'
+	// samples.
+	timestamp time.Time
+}
+
+// seriesMetadataFunc looks up the metadata of the series of the named
+// metric family with the given labels.
+type seriesMetadataFunc func(name string, labels []*dto.LabelPair) (seriesMetadata, bool)
+
+// acceptsOpenMetrics reports if a scrape request negotiates OpenMetrics.
+func acceptsOpenMetrics(req *http.Request) bool {
+	for _, part := range strings.Split(req.Header.Get("Accept"), ",") {
+		mediaType := strings.TrimSpace(strings.Split(part, ";")[0])
+		if mediaType == "application/openmetrics-text" {
+			return true
+		}
+	}
+	return false
+}
+
+// metricsHandler serves the metrics gathered by g as OpenMetrics if the
+// scraper asks for it, and otherwise in the formats promhttp negotiates.
+func metricsHandler(g prometheus.Gatherer, metadata seriesMetadataFunc) http.Handler {
+	promHandler := promhttp.HandlerFor(g, promhttp.HandlerOpts{})
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !acceptsOpenMetrics(req) {
+			promHandler.ServeHTTP(w, req)
+			return
+		}
+
+		mfs, err := g.Gather()
+		if err != nil {
+			http.Error(w, "An error has occurred during metrics gathering:\n\n"+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		var buf bytes.Buffer
+		var writer io.Writer = &buf
+		encoding := ""
+		for _, part := range strings.Split(req.Header.Get("Accept-Encoding"), ",") {
+			part = strings.TrimSpace(part)
+			if part == "gzip" || strings.HasPrefix(part, "gzip;") {
+				writer, encoding = gzip.NewWriter(&buf), "gzip"
+				break
+			}
+		}
+
+		if err := writeOpenMetrics(writer, mfs, metadata); err != nil {
+			http.Error(w, "An error has occurred during metrics encoding:\n\n"+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if closer, ok := writer.(io.Closer); ok {
+			logErr(closer.Close())
+		}
+
+		header := w.Header()
+		header.Set("Content-Type", openMetricsContentType)
+		header.Set("Content-Length", fmt.Sprint(buf.Len()))
+		if encoding != "" {
+			header.Set("Content-Encoding", encoding)
+		}
+		if _, err := w.Write(buf.Bytes()); err != nil {
+			log.Debugln("Error writing metrics response:", err)
+		}
+	})
+}
+
+var openMetricsEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+// formatOpenMetricsFloat renders f in the canonical OpenMetrics form, which
+// requires integral values to carry a fractional part.
+func formatOpenMetricsFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	case math.IsNaN(f):
+		return "NaN"
+	}
+	s := strconv.FormatFloat(f, 'g', -1, 64)
+	if !strings.ContainsAny(s, ".e") {
+		s += ".0"
+	}
+	return s
+}
+
+func formatOpenMetricsTimestamp(t time.Time) string {
+	return strconv.FormatFloat(float64(t.UnixNano())/1e9, 'f', 3, 64)
+}
+
+// openMetricsWriter accumulates the first error encountered while writing.
+type openMetricsWriter struct {
+	w   *bufio.Writer
+	err error
+}
+
+func (w *openMetricsWriter) printf(format string, args ...interface{}) {
+	if w.err == nil {
+		_, w.err = fmt.Fprintf(w.w, format, args...)
+	}
+}
+
+func (w *openMetricsWriter) writeLabels(labels []*dto.LabelPair, extraName string, extraValue string) {
+	if len(labels) == 0 && extraName == "" {
+		return
+	}
+	w.printf("{")
+	for idx, lp := range labels {
+		if idx > 0 {
+			w.printf(",")
+		}
+		w.printf(`%s="%s"`, lp.GetName(), openMetricsEscaper.Replace(lp.GetValue()))
+	}
+	if extraName != "" {
+		if len(labels) > 0 {
+			w.printf(",")
+		}
+		w.printf(`%s="%s"`, extraName, openMetricsEscaper.Replace(extraValue))
+	}
+	w.printf("}")
+}
+
+// writeSample writes a single sample line, with the exemplar ex if it is not
+// nil.
+func (w *openMetricsWriter) writeSample(name string, m *dto.Metric, extraName string, extraValue string,
+	value float64, ex *exemplar) {
+	w.printf("%s", name)
+	w.writeLabels(m.Label, extraName, extraValue)
+	w.printf(" %s", formatOpenMetricsFloat(value))
+	if m.TimestampMs != nil {
+		w.printf(" %s", formatOpenMetricsTimestamp(time.Unix(0, m.GetTimestampMs()*int64(time.Millisecond))))
+	}
+	if ex != nil {
+		w.printf(" # ")
+		w.writeLabels(ex.labels, "", "")
+		w.printf(" %s %s", formatOpenMetricsFloat(ex.value), formatOpenMetricsTimestamp(ex.timestamp))
+	}
+	w.printf("\n")
+}
+
+func (w *openMetricsWriter) writeCreated(name string, m *dto.Metric, meta seriesMetadata) {
+	if !meta.created.IsZero() {
+		w.printf("%s_created", name)
+		w.writeLabels(m.Label, "", "")
+		w.printf(" %s\n", formatOpenMetricsTimestamp(meta.created))
+	}
+}
+
+// writeOpenMetrics writes mfs to out in the OpenMetrics text format. metadata
+// supplies created timestamps and exemplars where it knows of them.
+func writeOpenMetrics(out io.Writer, mfs []*dto.MetricFamily, metadata seriesMetadataFunc) error {
+	w := &openMetricsWriter{w: bufio.NewWriter(out)}
+
+	for _, mf := range mfs {
+		name := mf.GetName()
+		typeName := "unknown"
+		switch mf.GetType() {
+		case dto.MetricType_COUNTER:
+			// OpenMetrics counter families are named without their
+			// _total suffix, which every sample then carries.
+			name = strings.TrimSuffix(name, "_total")
+			typeName = "counter"
+		case dto.MetricType_GAUGE:
+			typeName = "gauge"
+		case dto.MetricType_SUMMARY:
+			typeName = "summary"
+		case dto.MetricType_HISTOGRAM:
+			typeName = "histogram"
+		}
+
+		w.printf("# TYPE %s %s\n", name, typeName)
+		if mf.Help != nil {
+			w.printf("# HELP %s %s\n", name, openMetricsEscaper.Replace(mf.GetHelp()))
+		}
+
+		for _, m := range mf.Metric {
+			var meta seriesMetadata
+			if metadata != nil {
+				meta, _ = metadata(mf.GetName(), m.Label)
+			}
+			if m.TimestampMs == nil && !meta.timestamp.IsZero() {
+				timestamped := *m
+				timestamped.TimestampMs = proto.Int64(meta.timestamp.UnixNano() / int64(time.Millisecond))
+				m = &timestamped
+			}
+
+			switch mf.GetType() {
+			case dto.MetricType_COUNTER:
+				w.writeSample(name+"_total", m, "", "", m.GetCounter().GetValue(), meta.exemplar)
+				w.writeCreated(name, m, meta)
+			case dto.MetricType_GAUGE:
+				w.writeSample(name, m, "", "", m.GetGauge().GetValue(), nil)
+			case dto.MetricType_SUMMARY:
+				s := m.GetSummary()
+				for _, q := range s.Quantile {
+					w.writeSample(name, m, model.QuantileLabel, formatOpenMetricsFloat(q.GetQuantile()), q.GetValue(), nil)
+				}
+				w.writeSample(name+"_sum", m, "", "", s.GetSampleSum(), nil)
+				w.writeSample(name+"_count", m, "", "", float64(s.GetSampleCount()), nil)
+				w.writeCreated(name, m, meta)
+			case dto.MetricType_HISTOGRAM:
+				h := m.GetHistogram()
+				ex := meta.exemplar
+				sawInf := false
+				for _, b := range h.Bucket {
+					upperBound := b.GetUpperBound()
+					sawInf = sawInf || math.IsInf(upperBound, 1)
+					// An exemplar belongs to the first bucket it falls in.
+					var bucketEx *exemplar
+					if ex != nil && ex.value <= upperBound {
+						bucketEx, ex = ex, nil
+					}
+					w.writeSample(name+"_bucket", m, model.BucketLabel, formatOpenMetricsFloat(upperBound),
+						float64(b.GetCumulativeCount()), bucketEx)
+				}
+				if !sawInf {
+					w.writeSample(name+"_bucket", m, model.BucketLabel, "+Inf", float64(h.GetSampleCount()), ex)
+				}
+				w.writeSample(name+"_sum", m, "", "", h.GetSampleSum(), nil)
+				w.writeSample(name+"_count", m, "", "", float64(h.GetSampleCount()), nil)
+				w.writeCreated(name, m, meta)
+			default:
+				w.writeSample(name, m, "", "", m.GetUntyped().GetValue(), nil)
+			}
+		}
+	}
+
+	w.printf("# EOF\n")
+	if w.err != nil {
+		return w.err
+	}
+	return w.w.Flush()
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"math"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+const openMetricsGolden = `# TYPE requests counter
+# HELP requests Requests.\nWith a \\ and a \"quote\"
+requests_total{path="/a\"b\\c\nd"} 3.0 # {trace_id="abc"} 1.0 1500000001.500
+requests_created{path="/a\"b\\c\nd"} 1500000000.000
+# TYPE latency_seconds histogram
+# HELP latency_seconds Latency.
+latency_seconds_bucket{job="a",le="0.1"} 1.0
+latency_seconds_bucket{job="a",le="1.0"} 3.0 # {trace_id="x"} 0.5 1500000001.500
+latency_seconds_bucket{job="a",le="+Inf"} 4.0
+latency_seconds_sum{job="a"} 5.5
+latency_seconds_count{job="a"} 4.0
+latency_seconds_created{job="a"} 1500000000.000
+latency_seconds_bucket{job="b",le="0.1"} 0.0
+latency_seconds_bucket{job="b",le="1.0"} 0.0
+latency_seconds_bucket{job="b",le="+Inf"} 1.0 # {trace_id="y"} 7.0 1500000001.500
+latency_seconds_sum{job="b"} 7.0
+latency_seconds_count{job="b"} 1.0
+# TYPE temperature gauge
+temperature -1.5 1500000002.000
+temperature{room="hall"} NaN
+# TYPE last_seen unknown
+last_seen 1.5e+09 1500000003.000
+# EOF
+`
+
+var (
+	openMetricsCreated   = time.Unix(1500000000, 0)
+	openMetricsExemplarT = time.Unix(1500000001, 500*int64(time.Millisecond))
+)
+
+func labelPair(name, value string) *dto.LabelPair {
+	return &dto.LabelPair{Name: proto.String(name), Value: proto.String(value)}
+}
+
+func openMetricsFamilies() []*dto.MetricFamily {
+	bucket := func(upperBound float64, count uint64) *dto.Bucket {
+		return &dto.Bucket{UpperBound: proto.Float64(upperBound), CumulativeCount: proto.Uint64(count)}
+	}
+	return []*dto.MetricFamily{
+		{
+			Name: proto.String("requests_total"),
+			Help: proto.String("Requests.\nWith a \\ and a \"quote\""),
+			Type: dto.MetricType_COUNTER.Enum(),
+			Metric: []*dto.Metric{{
+				Label:   []*dto.LabelPair{labelPair("path", "/a\"b\\c\nd")},
+				Counter: &dto.Counter{Value: proto.Float64(3)},
+			}},
+		},
+		{
+			Name: proto.String("latency_seconds"),
+			Help: proto.String("Latency."),
+			Type: dto.MetricType_HISTOGRAM.Enum(),
+			Metric: []*dto.Metric{
+				{
+					Label: []*dto.LabelPair{labelPair("job", "a")},
+					Histogram: &dto.Histogram{
+						SampleCount: proto.Uint64(4),
+						SampleSum:   proto.Float64(5.5),
+						Bucket:      []*dto.Bucket{bucket(0.1, 1), bucket(1, 3)},
+					},
+				},
+				{
+					Label: []*dto.LabelPair{labelPair("job", "b")},
+					Histogram: &dto.Histogram{
+						SampleCount: proto.Uint64(1),
+						SampleSum:   proto.Float64(7),
+						Bucket:      []*dto.Bucket{bucket(0.1, 0), bucket(1, 0), bucket(math.Inf(1), 1)},
+					},
+				},
+			},
+		},
+		{
+			Name: proto.String("temperature"),
+			Type: dto.MetricType_GAUGE.Enum(),
+			Metric: []*dto.Metric{
+				{Gauge: &dto.Gauge{Value: proto.Float64(-1.5)}, TimestampMs: proto.Int64(1500000002000)},
+				{Label: []*dto.LabelPair{labelPair("room", "hall")}, Gauge: &dto.Gauge{Value: proto.Float64(math.NaN())}},
+			},
+		},
+		{
+			Name:   proto.String("last_seen"),
+			Type:   dto.MetricType_UNTYPED.Enum(),
+			Metric: []*dto.Metric{{Untyped: &dto.Untyped{Value: proto.Float64(1.5e9)}}},
+		},
+	}
+}
+
+func openMetricsMetadata(name string, labels []*dto.LabelPair) (seriesMetadata, bool) {
+	ex := func(traceID string, value float64) *exemplar {
+		return &exemplar{labels: []*dto.LabelPair{labelPair("trace_id", traceID)}, value: value, timestamp: openMetricsExemplarT}
+	}
+	key := name
+	for _, lp := range labels {
+		key += "," + lp.GetValue()
+	}
+	switch key {
+	case "requests_total,/a\"b\\c\nd":
+		return seriesMetadata{created: openMetricsCreated, exemplar: ex("abc", 1)}, true
+	case "latency_seconds,a":
+		// The exemplar is in the first bucket it falls in.
+		return seriesMetadata{created: openMetricsCreated, exemplar: ex("x", 0.5)}, true
+	case "latency_seconds,b":
+		return seriesMetadata{exemplar: ex("y", 7)}, true
+	case "last_seen":
+		return seriesMetadata{timestamp: time.Unix(1500000003, 0)}, true
+	}
+	return seriesMetadata{}, false
+}
+
+func TestWriteOpenMetrics(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeOpenMetrics(&buf, openMetricsFamilies(), openMetricsMetadata); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != openMetricsGolden {
+		t.Errorf("unexpected output:\n%s\nexpected:\n%s", buf.String(), openMetricsGolden)
+	}
+}
+
+func TestMetricsHandlerNegotiation(t *testing.T) {
+	handler := metricsHandler(prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		return openMetricsFamilies(), nil
+	}), openMetricsMetadata)
+
+	cases := []struct {
+		accept, acceptEncoding string
+		contentType, encoding  string
+	}{
+		{"application/openmetrics-text; version=1.0.0", "", openMetricsContentType, ""},
+		{"text/plain;q=0.5, application/openmetrics-text;version=1.0.0", "deflate, gzip;q=1.0", openMetricsContentType, "gzip"},
+		{"text/plain", "", "text/plain; version=0.0.4", ""},
+	}
+	for _, tc := range cases {
+		req := httptest.NewRequest("GET", "/metrics", nil)
+		req.Header.Set("Accept", tc.accept)
+		req.Header.Set("Accept-Encoding", tc.acceptEncoding)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		if contentType := rec.Header().Get("Content-Type"); contentType != tc.contentType {
+			t.Errorf("%s: expected content type %q, got %q", tc.accept, tc.contentType, contentType)
+		}
+		if encoding := rec.Header().Get("Content-Encoding"); encoding != tc.encoding {
+			t.Errorf("%s: expected encoding %q, got %q", tc.accept, tc.encoding, encoding)
+		}
+		if tc.contentType != openMetricsContentType {
+			continue
+		}
+
+		body := rec.Body.Bytes()
+		if tc.encoding == "gzip" {
+			r, err := gzip.NewReader(rec.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if body, err = ioutil.ReadAll(r); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if string(body) != openMetricsGolden {
+			t.Errorf("%s: unexpected body:\n%s", tc.accept, body)
+		}
+		if !strings.HasSuffix(string(body), "# EOF\n") {
+			t.Errorf("%s: body doesn't end with # EOF", tc.accept)
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/common/log"
+	"gopkg.in/yaml.v2"
+)
+
+// fingerprintSize is how much of the start of a file identifies it. A file
+// keeps its fingerprint when it is rotated, and when it is compressed once
+// decompressed.
+const fingerprintSize = 1024
+
+// maxRetiredPositions bounds how many positions of files which were rotated
+// away or removed are kept, to recognise their content under another name.
+const maxRetiredPositions = 100
+
+// filePosition is how far a followed file has been ingested.
+type filePosition struct {
+	Offset int64 `yaml:"offset"`
+	// FingerprintSize is the number of bytes at the start of the file
+	// hashed into Fingerprint. It is less than fingerprintSize for files
+	// which were shorter when the position was saved.
+	FingerprintSize int    `yaml:"fingerprint_size"`
+	Fingerprint     string `yaml:"fingerprint"`
+	// Inode identifies the file, with its fingerprint, when it is renamed
+	// before the fingerprint is full size.
+	Inode uint64 `yaml:"inode,omitempty"`
+	// Compressed files are read to their end at once, so Offset is unused.
+	Compressed bool `yaml:"compressed,omitempty"`
+}
+
+// fingerprint hashes the first n bytes read from r, returning an error if r
+// is shorter than n.
+func fingerprint(r io.Reader, n int) (string, error) {
+	h := fnv.New64a()
+	if _, err := io.CopyN(h, r, int64(n)); err != nil {
+		return "", err
+	}
+	return strconv.FormatUint(h.Sum64(), 16), nil
+}
+
+// readHead returns the first fingerprintSize bytes read from r, or fewer if
+// r is shorter.
+func readHead(r io.Reader) ([]byte, error) {
+	head := make([]byte, fingerprintSize)
+	n, err := io.ReadFull(r, head)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	return head[:n], err
+}
+
+// savedPositions is the content of a positions file.
+type savedPositions struct {
+	Positions map[string]filePosition `yaml:"positions"`
+	Retired   []filePosition          `yaml:"retired,omitempty"`
+}
+
+// positions is the set of file positions persisted in a positions file, so
+// followed files resume where they left off after a restart. The positions
+// of files which were rotated away or removed are retired rather than
+// forgotten, so their content isn't ingested again if it reappears under
+// another name, such as a rotated or compressed segment.
+type positions struct {
+	filename string
+
+	mtx       sync.Mutex
+	positions map[string]filePosition
+	retired   []filePosition
+	dirty     bool
+}
+
+// loadPositions reads the positions file, which need not exist yet.
+func loadPositions(filename string) (*positions, error) {
+	p := &positions{
+		filename:  filename,
+		positions: make(map[string]filePosition),
+	}
+	content, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return p, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var saved savedPositions
+	if err := yaml.Unmarshal(content, &saved); err != nil {
+		return nil, err
+	}
+	for path, pos := range saved.Positions {
+		p.positions[path] = pos
+	}
+	p.retired = saved.Retired
+	return p, nil
+}
+
+func (p *positions) get(path string) (filePosition, bool) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	pos, found := p.positions[path]
+	return pos, found
+}
+
+func (p *positions) set(path string, pos filePosition) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if p.positions[path] != pos {
+		p.positions[path] = pos
+		p.dirty = true
+	}
+}
+
+// remove retires the position of a file which no longer exists.
+func (p *positions) remove(path string) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if pos, found := p.positions[path]; found {
+		delete(p.positions, path)
+		p.retireLocked(pos)
+		p.dirty = true
+	}
+}
+
+// retire records the final position of a file which was rotated away.
+func (p *positions) retire(pos filePosition) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	p.retireLocked(pos)
+}
+
+func (p *positions) retireLocked(pos filePosition) {
+	if pos.FingerprintSize <= 0 {
+		// Nothing was ingested, so there is nothing to recognise.
+		return
+	}
+	p.retired = append(p.retired, pos)
+	if len(p.retired) > maxRetiredPositions {
+		p.retired = p.retired[len(p.retired)-maxRetiredPositions:]
+	}
+	p.dirty = true
+}
+
+// consumed finds the position of content which was already ingested, under
+// any name, for a file starting with head. inode is the file's inode, or 0 if
+// it isn't known. Fingerprints shorter than fingerprintSize are too likely to
+// be shared by unrelated files, so only identify the same inode. Positions
+// of compressed files only identify other compressed files.
+func (p *positions) consumed(head []byte, inode uint64, compressed bool) (filePosition, bool) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	var best filePosition
+	found := false
+	check := func(pos filePosition) {
+		n := pos.FingerprintSize
+		if n <= 0 || n > len(head) || (pos.Compressed && !compressed) {
+			return
+		}
+		if n < fingerprintSize && (inode == 0 || pos.Inode != inode) {
+			return
+		}
+		if fp, _ := fingerprint(bytes.NewReader(head), n); fp != pos.Fingerprint {
+			return
+		}
+		if !found || pos.Compressed || (!best.Compressed && pos.Offset > best.Offset) {
+			best, found = pos, true
+		}
+	}
+	for _, pos := range p.positions {
+		check(pos)
+	}
+	for _, pos := range p.retired {
+		check(pos)
+	}
+	return best, found
+}
+
+// save writes the positions file if any position changed since it was last
+// written.
+func (p *positions) save() error {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if !p.dirty {
+		return nil
+	}
+
+	content, err := yaml.Marshal(savedPositions{p.positions, p.retired})
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(p.filename+".tmp", content, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(p.filename+".tmp", p.filename); err != nil {
+		return err
+	}
+	p.dirty = false
+	return nil
+}
+
+// syncEvery saves the positions file every interval. It never returns.
+func (p *positions) syncEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := p.save(); err != nil {
+			log.Errorln("Error saving positions file:", err)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/model"
+	"github.com/wrouesnel/tail_exporter/config"
+)
+
+// groupingKey is the set of labels, besides the job, identifying a group of
+// metrics on a Pushgateway. It is set from repeated name=value flags.
+type groupingKey map[string]string
+
+func (g groupingKey) String() string {
+	pairs := make([]string, 0, len(g))
+	for name, value := range g {
+		pairs = append(pairs, name+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (g groupingKey) Set(s string) error {
+	idx := strings.Index(s, "=")
+	if idx < 0 {
+		return fmt.Errorf("grouping label %q is not of the form name=value", s)
+	}
+	name, value := s[:idx], s[idx+1:]
+	if !model.LabelName(name).IsValid() || name == "job" {
+		return fmt.Errorf("invalid grouping label name %q", name)
+	}
+	g[name] = value
+	return nil
+}
+
+// pushURLComponent encodes a label value as a Pushgateway URL path segment,
+// using the base64 form for values a path segment can't hold.
+func pushURLComponent(name string, value string) string {
+	if value == "" || strings.Contains(value, "/") {
+		encoded := base64.RawURLEncoding.EncodeToString([]byte(value))
+		if encoded == "" {
+			encoded = "="
+		}
+		return name + "@base64/" + encoded
+	}
+	return name + "/" + url.PathEscape(value)
+}
+
+// pushURL is the Pushgateway URL of the group of metrics identified by job
+// and grouping.
+func pushURL(gatewayURL string, job string, grouping groupingKey) string {
+	names := make([]string, 0, len(grouping))
+	for name := range grouping {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	components := []string{strings.TrimSuffix(gatewayURL, "/"), "metrics", pushURLComponent("job", job)}
+	for _, name := range names {
+		components = append(components, pushURLComponent(name, grouping[name]))
+	}
+	return strings.Join(components, "/")
+}
+
+// pushMetrics sends everything g gathers to a Pushgateway. method is PUT to
+// replace the whole group, or POST to replace only metrics of the same names.
+func pushMetrics(gatewayURL string, job string, grouping groupingKey, method string, g prometheus.Gatherer) error {
+	mfs, err := g.Gather()
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	enc := expfmt.NewEncoder(&buf, expfmt.FmtProtoDelim)
+	for _, mf := range mfs {
+		if err := enc.Encode(mf); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequest(method, pushURL(gatewayURL, job, grouping), &buf)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", string(expfmt.FmtProtoDelim))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close() // nolint: errcheck
+
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 256))
+		return fmt.Errorf("pushgateway returned HTTP status %s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+	return nil
+}
+
+// pushCommand processes the named files, or stdin if there are none, to EOF
+// and pushes the resulting metrics to the Pushgateway. It returns the
+// process exit code.
+func pushCommand(cfg *config.Config, filenames []string) int {
+	if *pushGatewayURL == "" {
+		fmt.Fprintln(os.Stderr, "push: --push.gateway-url must be set")
+		return 2
+	}
+	method := strings.ToUpper(*pushMethod)
+	if method != "PUT" && method != "POST" {
+		fmt.Fprintf(os.Stderr, "push: unknown push method %q\n", *pushMethod)
+		return 2
+	}
+	if len(filenames) == 0 {
+		filenames = []string{"-"}
+	}
+
+	c, err := newTailCollector(cfg)
+	if err != nil {
+		log.Errorln("Configuration could not be loaded.", err)
+		return 1
+	}
+
+	exitCode := 0
+	for _, filename := range filenames {
+		if err := processFile(c, filename, *inputFormat); err != nil {
+			log.Errorln("Error reading input:", err)
+			exitCode = 1
+		}
+	}
+	c.Close()
+
+	registry := prometheus.NewRegistry()
+	if err := registry.Register(seriesCollector{c}); err != nil {
+		log.Errorln("Error registering metrics:", err)
+		return 1
+	}
+	if err := pushMetrics(*pushGatewayURL, *pushJob, pushGrouping, method, registry); err != nil {
+		log.Errorln("Error pushing metrics:", err)
+		return 1
+	}
+	log.Infoln("Pushed metrics to", *pushGatewayURL)
+	return exitCode
+}
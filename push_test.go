@@ -0,0 +1,140 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/wrouesnel/tail_exporter/config"
+)
+
+func TestPushURL(t *testing.T) {
+	for _, tc := range []struct {
+		name, value, expected string
+	}{
+		{"job", "nightly", "job/nightly"},
+		{"instance", "a b", "instance/a%20b"},
+		// Values a path segment can't hold are base64 encoded.
+		{"instance", "", "instance@base64/="},
+		{"path", "/var/log", "path@base64/L3Zhci9sb2c"},
+		{"path", "a/b?", "path@base64/YS9iPw"},
+	} {
+		if component := pushURLComponent(tc.name, tc.value); component != tc.expected {
+			t.Errorf("%s=%q: expected %s, got %s", tc.name, tc.value, tc.expected, component)
+		}
+	}
+
+	grouping := groupingKey{}
+	for _, label := range []string{"path=/a", "instance=batch-01", "empty="} {
+		if err := grouping.Set(label); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, label := range []string{"job=other", "no-value", "0invalid=x"} {
+		if err := grouping.Set(label); err == nil {
+			t.Errorf("expected grouping label %q to be rejected", label)
+		}
+	}
+	expected := "http://gateway:9091/metrics/job/nightly/empty@base64/=/instance/batch-01/path@base64/L2E"
+	if u := pushURL("http://gateway:9091/", "nightly", grouping); u != expected {
+		t.Errorf("expected %s, got %s", expected, u)
+	}
+}
+
+// pushgateway is a stand-in Pushgateway recording the metric families pushed
+// to it.
+type pushgateway struct {
+	t      *testing.T
+	status int
+	method string
+	path   string
+	mfs    map[string]*dto.MetricFamily
+}
+
+func (p *pushgateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.method, p.path = r.Method, r.URL.Path
+	if contentType := r.Header.Get("Content-Type"); contentType != string(expfmt.FmtProtoDelim) {
+		p.t.Errorf("unexpected content type %q", contentType)
+	}
+	p.mfs = make(map[string]*dto.MetricFamily)
+	dec := expfmt.NewDecoder(r.Body, expfmt.FmtProtoDelim)
+	for {
+		mf := &dto.MetricFamily{}
+		if err := dec.Decode(mf); err == io.EOF {
+			break
+		} else if err != nil {
+			p.t.Error(err)
+			break
+		}
+		p.mfs[mf.GetName()] = mf
+	}
+	if p.status != 0 {
+		http.Error(w, "push rejected", p.status)
+	}
+}
+
+func TestPushCommand(t *testing.T) {
+	gateway := &pushgateway{t: t}
+	srv := httptest.NewServer(gateway)
+	defer srv.Close()
+
+	f, err := ioutil.TempFile("", "push_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name()) // nolint: errcheck
+	if _, err := f.WriteString("request\nrequest\nother\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := config.Load(`
+metric_configs:
+- name: requests_total
+  help: requests
+  type: counter
+  regex: '^request'
+  value: +1
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prevURL, prevJob, prevMethod := *pushGatewayURL, *pushJob, *pushMethod
+	defer func() {
+		*pushGatewayURL, *pushJob, *pushMethod = prevURL, prevJob, prevMethod
+	}()
+	*pushGatewayURL, *pushJob, *pushMethod = srv.URL, "nightly", "post"
+
+	if code := pushCommand(cfg, []string{f.Name()}); code != 0 {
+		t.Fatalf("expected exit code 0, got %d", code)
+	}
+	if gateway.method != "POST" || gateway.path != "/metrics/job/nightly" {
+		t.Errorf("unexpected push %s %s", gateway.method, gateway.path)
+	}
+	// Only the series extracted from lines are pushed.
+	if len(gateway.mfs) != 1 {
+		t.Errorf("expected only the extracted metric to be pushed, got %d families", len(gateway.mfs))
+	}
+	mf := gateway.mfs["requests_total"]
+	if mf == nil || len(mf.Metric) != 1 || mf.Metric[0].GetCounter().GetValue() != 2 {
+		t.Errorf("expected requests_total to be 2, got %v", mf)
+	}
+
+	gateway.status = http.StatusBadRequest
+	if code := pushCommand(cfg, []string{f.Name()}); code != 1 {
+		t.Errorf("expected exit code 1 for a rejected push, got %d", code)
+	}
+	err = pushMetrics(srv.URL, "nightly", nil, "PUT", prometheus.NewRegistry())
+	if err == nil || !strings.Contains(err.Error(), "push rejected") {
+		t.Errorf("expected the Pushgateway's error, got %v", err)
+	}
+}
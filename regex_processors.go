@@ -4,15 +4,33 @@ import (
 	"fmt"
 	"math"
 	"strconv"
+	"time"
 
 	"github.com/glenn-brown/golang-pkg-pcre/src/pkg/pcre"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/wrouesnel/tail_exporter/config"
 )
 
-// ParseLabelKey converts a regex match to prometheus label key string.
-func ParseLabelKey(def config.LabelValueDef, m *pcre.Matcher) (string, error) {
+// lineMetadata is the named values an input attaches to a line, such as the
+// stream a container logged it to. Rules reference them as $__name.
+type lineMetadata map[string]string
+
+// logLine is a line and the metadata its input attached to it.
+type logLine struct {
+	text string
+	meta lineMetadata
+}
+
+// ParseLabelKey converts a regex match, or the metadata of the matched line,
+// to prometheus label key string.
+func ParseLabelKey(def config.LabelValueDef, m *pcre.Matcher, meta lineMetadata) (string, error) {
 	switch def.FieldType {
+	case config.LabelValueMetadata:
+		value, found := meta[def.MetadataName]
+		if !found {
+			return "", fmt.Errorf("line has no metadata %q", def.MetadataName)
+		}
+		return value, nil
 	case config.LabelValueLiteral:
 		return def.Literal, nil
 	case config.LabelValueCaptureGroupNamed:
@@ -23,24 +41,24 @@ func ParseLabelKey(def config.LabelValueDef, m *pcre.Matcher) (string, error) {
 	case config.LabelValueCaptureGroup:
 		return m.GroupString(def.CaptureGroup), nil
 	default:
-		return "", fmt.Errorf("unknown conversion type: %s", def.FieldType)
+		return "", fmt.Errorf("unknown conversion type: %v", def.FieldType)
 	}
 }
 
 // ParseLabelPairsFromMatch converts a regex match to a prometheus.Labels map. If
 // a label can't be parsed at all it will be dropped, and the entire metric
 // will be ignored for the given input match.
-func ParseLabelPairsFromMatch(def []config.LabelDef, m *pcre.Matcher) (prometheus.Labels, error) {
+func ParseLabelPairsFromMatch(def []config.LabelDef, m *pcre.Matcher, meta lineMetadata) (prometheus.Labels, error) {
 	labels := make(prometheus.Labels, len(def))
 
 	// Calculate label names from the rule
 	for _, v := range def {
-		name, nerr := ParseLabelKey(v.Name, m)
+		name, nerr := ParseLabelKey(v.Name, m, meta)
 		if nerr != nil {
 			return nil, fmt.Errorf("error parsing LabelDef for name")
 		}
 
-		value, verr := ParseLabelKey(v.Value, m)
+		value, verr := ParseLabelKey(v.Value, m, meta)
 		if verr != nil {
 			return nil, fmt.Errorf("error parsing LabelDef for value")
 		}
@@ -51,13 +69,44 @@ func ParseLabelPairsFromMatch(def []config.LabelDef, m *pcre.Matcher) (prometheu
 	return labels, nil
 }
 
+// HashLabelPairsFromMatch computes the identity hash of the labels
+// ParseLabelPairsFromMatch would produce, without allocating them. Each label
+// pair is hashed separately and the results summed, so the hash does not
+// depend on the order of the LabelDefs in the rule. Different labels can
+// still share a hash, so it only narrows a series lookup down.
+func HashLabelPairsFromMatch(def []config.LabelDef, m *pcre.Matcher, meta lineMetadata) (uint64, error) {
+	var h uint64
+	for _, v := range def {
+		name, nerr := ParseLabelKey(v.Name, m, meta)
+		if nerr != nil {
+			return 0, fmt.Errorf("error parsing LabelDef for name")
+		}
+
+		value, verr := ParseLabelKey(v.Value, m, meta)
+		if verr != nil {
+			return 0, fmt.Errorf("error parsing LabelDef for value")
+		}
+
+		h += hashLabelPair(name, value)
+	}
+	return h, nil
+}
+
 // ParseValueFromMatch converts a regex match to a float64 suitable for use as
-// a metric value, based on the value of a metric ValueDef. Returns NaN if a
-// value is not convertible and an error.
-func ParseValueFromMatch(def config.ValueDef, m *pcre.Matcher) (float64, error) {
+// a metric value, based on the value of a metric ValueDef. loggedAt is the
+// time the line was logged, if the rule extracts it. Returns NaN if a value
+// is not convertible and an error.
+func ParseValueFromMatch(def config.ValueDef, m *pcre.Matcher, loggedAt time.Time) (float64, error) {
 	switch def.ValueSource {
 	case config.ValueSourceLiteral:
 		return def.Literal, nil
+	case config.ValueSourceNow:
+		return unixSeconds(time.Now()), nil
+	case config.ValueSourceTimestamp:
+		if loggedAt.IsZero() {
+			return math.NaN(), fmt.Errorf("rule extracts no timestamp")
+		}
+		return unixSeconds(loggedAt), nil
 	case config.ValueSourceNamedCaptureGroup:
 		if !m.NamedPresent(def.CaptureGroupName) {
 			return math.NaN(), fmt.Errorf("named capture group not present")
@@ -73,6 +122,43 @@ func ParseValueFromMatch(def config.ValueDef, m *pcre.Matcher) (float64, error)
 		val, err := strconv.ParseFloat(valstr, 64)
 		return val, err
 	default:
-		return math.NaN(), fmt.Errorf("unknown conversion type: %s", def.ValueSource)
+		return math.NaN(), fmt.Errorf("unknown conversion type: %v", def.ValueSource)
+	}
+}
+
+// unixSeconds converts a time to seconds since the epoch.
+func unixSeconds(t time.Time) float64 {
+	return float64(t.UnixNano()) / float64(time.Second)
+}
+
+// ParseTimestampFromMatch extracts the time a line was logged from a regex
+// match.
+func ParseTimestampFromMatch(def *config.TimestampDef, m *pcre.Matcher, meta lineMetadata) (time.Time, error) {
+	s, err := ParseLabelKey(def.Value, m, meta)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	switch def.Format {
+	case config.TimestampUnix:
+		secs, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return time.Time{}, err
+		}
+		return time.Unix(0, int64(secs*float64(time.Second))), nil
+	case config.TimestampUnixMs:
+		ms, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return time.Time{}, err
+		}
+		return time.Unix(0, ms*int64(time.Millisecond)), nil
+	case config.TimestampUnixUs:
+		us, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return time.Time{}, err
+		}
+		return time.Unix(0, us*int64(time.Microsecond)), nil
+	default:
+		return time.Parse(def.Format, s)
 	}
 }
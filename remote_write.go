@@ -0,0 +1,466 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/model"
+	"github.com/wrouesnel/tail_exporter/config"
+)
+
+const remoteWriteQueueSuffix = ".snappy"
+
+// writeQueue is a bounded FIFO of encoded write requests. If it has a
+// directory the requests are kept there rather than in memory.
+type writeQueue struct {
+	mtx      sync.Mutex
+	capacity int
+	dir      string
+	entries  []queueEntry
+	nextSeq  uint64
+	// notify is signalled whenever a request is pushed
+	notify chan struct{}
+}
+
+type queueEntry struct {
+	seq     uint64
+	payload []byte
+}
+
+func (q *writeQueue) path(seq uint64) string {
+	return filepath.Join(q.dir, fmt.Sprintf("%020d%s", seq, remoteWriteQueueSuffix))
+}
+
+// newWriteQueue creates a queue, loading any requests left in dir by a
+// previous run.
+func newWriteQueue(capacity int, dir string) (*writeQueue, error) {
+	q := &writeQueue{
+		capacity: capacity,
+		dir:      dir,
+		notify:   make(chan struct{}, 1),
+	}
+	if dir == "" {
+		return q, nil
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	// ReadDir sorts by name, and so by sequence number.
+	for _, file := range files {
+		name := file.Name()
+		if !strings.HasSuffix(name, remoteWriteQueueSuffix) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, remoteWriteQueueSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		q.entries = append(q.entries, queueEntry{seq: seq})
+		q.nextSeq = seq + 1
+	}
+	for len(q.entries) > q.capacity {
+		q.dropFront()
+	}
+	if len(q.entries) > 0 {
+		q.notify <- struct{}{}
+	}
+	return q, nil
+}
+
+// dropFront removes the oldest request. The caller must hold mtx.
+func (q *writeQueue) dropFront() {
+	if q.dir != "" {
+		if err := os.Remove(q.path(q.entries[0].seq)); err != nil && !os.IsNotExist(err) {
+			log.Errorln("Error removing queued write request:", err)
+		}
+	}
+	q.entries = q.entries[1:]
+}
+
+// push appends payload to the queue, returning the number of older requests
+// dropped to make room for it.
+func (q *writeQueue) push(payload []byte) (dropped int, err error) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	entry := queueEntry{seq: q.nextSeq, payload: payload}
+	if q.dir != "" {
+		path := q.path(entry.seq)
+		if err := ioutil.WriteFile(path+".tmp", payload, 0644); err != nil {
+			return 0, err
+		}
+		if err := os.Rename(path+".tmp", path); err != nil {
+			return 0, err
+		}
+		entry.payload = nil
+	}
+	q.nextSeq++
+
+	for len(q.entries) >= q.capacity {
+		q.dropFront()
+		dropped++
+	}
+	q.entries = append(q.entries, entry)
+
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+	return dropped, nil
+}
+
+// front returns the oldest request, if there is one.
+func (q *writeQueue) front() (seq uint64, payload []byte, ok bool, err error) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	if len(q.entries) == 0 {
+		return 0, nil, false, nil
+	}
+	entry := q.entries[0]
+	if q.dir == "" {
+		return entry.seq, entry.payload, true, nil
+	}
+	payload, err = ioutil.ReadFile(q.path(entry.seq))
+	return entry.seq, payload, true, err
+}
+
+// pop removes the request seq if it is still the oldest. It may already
+// have been dropped to make room.
+func (q *writeQueue) pop(seq uint64) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	if len(q.entries) > 0 && q.entries[0].seq == seq {
+		q.dropFront()
+	}
+}
+
+// isFront reports if seq is the oldest request.
+func (q *writeQueue) isFront(seq uint64) bool {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	return len(q.entries) > 0 && q.entries[0].seq == seq
+}
+
+func (q *writeQueue) len() int {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	return len(q.entries)
+}
+
+// remoteWriter periodically sends every stored series to a Prometheus remote
+// write endpoint.
+type remoteWriter struct {
+	c      *TailCollector
+	cfg    *config.RemoteWriteConfig
+	client *http.Client
+	queue  *writeQueue
+	// externalLabels are cfg.ExternalLabels sorted by name
+	externalLabels []*dto.LabelPair
+
+	requestsSent    prometheus.Counter
+	requestsFailed  prometheus.Counter
+	requestsDropped prometheus.Counter
+	queueLength     prometheus.Gauge
+}
+
+func (c *TailCollector) newRemoteWriter(cfg *config.RemoteWriteConfig) (*remoteWriter, error) {
+	queue, err := newWriteQueue(cfg.Queue.Capacity, cfg.Queue.Directory)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &remoteWriter{
+		c:               c,
+		cfg:             cfg,
+		client:          &http.Client{Timeout: time.Duration(cfg.Timeout)},
+		queue:           queue,
+		requestsSent:    c.remoteWriteSent.WithLabelValues(cfg.URL),
+		requestsFailed:  c.remoteWriteFailures.WithLabelValues(cfg.URL),
+		requestsDropped: c.remoteWriteDropped.WithLabelValues(cfg.URL),
+		queueLength:     c.remoteWriteQueueLength.WithLabelValues(cfg.URL),
+	}
+	for name, value := range cfg.ExternalLabels {
+		w.externalLabels = append(w.externalLabels, &dto.LabelPair{
+			Name:  proto.String(name),
+			Value: proto.String(value),
+		})
+	}
+	sort.Sort(labelPairSorter(w.externalLabels))
+	w.queueLength.Set(float64(queue.len()))
+	return w, nil
+}
+
+// labelPairSorter sorts label pairs by name.
+type labelPairSorter []*dto.LabelPair
+
+func (s labelPairSorter) Len() int           { return len(s) }
+func (s labelPairSorter) Less(i, j int) bool { return s[i].GetName() < s[j].GetName() }
+func (s labelPairSorter) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// Run queues a snapshot of every series each interval, and sends the queue
+// to the endpoint. It never returns.
+func (w *remoteWriter) Run() {
+	go w.sendLoop()
+
+	ticker := time.NewTicker(time.Duration(w.cfg.Interval))
+	defer ticker.Stop()
+	for now := range ticker.C {
+		payload, samples := w.c.encodeWriteRequest(w.externalLabels, now)
+		if samples == 0 {
+			continue
+		}
+		dropped, err := w.queue.push(snappy.Encode(nil, payload))
+		if err != nil {
+			log.With("url", w.cfg.URL).Errorln("Error queueing write request:", err)
+			w.requestsDropped.Inc()
+			continue
+		}
+		w.requestsDropped.Add(float64(dropped))
+		w.queueLength.Set(float64(w.queue.len()))
+	}
+}
+
+func (w *remoteWriter) sendLoop() {
+	for range w.queue.notify {
+		for {
+			seq, payload, ok, err := w.queue.front()
+			if !ok {
+				break
+			}
+			if err != nil {
+				log.With("url", w.cfg.URL).Errorln("Dropping unreadable queued write request:", err)
+				w.requestsDropped.Inc()
+			} else {
+				w.sendWithRetries(seq, payload)
+			}
+			w.queue.pop(seq)
+			w.queueLength.Set(float64(w.queue.len()))
+		}
+	}
+}
+
+// recoverableError is a send failure which is worth retrying.
+type recoverableError struct {
+	error
+}
+
+// sendWithRetries sends payload, retrying recoverable failures with
+// exponential backoff until it succeeds or the request seq is dropped from
+// the queue to make room.
+func (w *remoteWriter) sendWithRetries(seq uint64, payload []byte) {
+	backoff := time.Duration(w.cfg.Queue.MinBackoff)
+	for {
+		err := w.send(payload)
+		if err == nil {
+			w.requestsSent.Inc()
+			return
+		}
+		w.requestsFailed.Inc()
+		if _, ok := err.(recoverableError); !ok {
+			log.With("url", w.cfg.URL).Errorln("Dropping write request:", err)
+			w.requestsDropped.Inc()
+			return
+		}
+
+		log.With("url", w.cfg.URL).Warnln("Error sending write request, retrying in", backoff, err)
+		time.Sleep(backoff)
+		if !w.queue.isFront(seq) {
+			return
+		}
+		backoff *= 2
+		if backoff > time.Duration(w.cfg.Queue.MaxBackoff) {
+			backoff = time.Duration(w.cfg.Queue.MaxBackoff)
+		}
+	}
+}
+
+func (w *remoteWriter) send(payload []byte) error {
+	req, err := http.NewRequest("POST", w.cfg.URL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("User-Agent", "tail_exporter")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	if err := w.authenticate(req); err != nil {
+		return err
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return recoverableError{err}
+	}
+	defer resp.Body.Close() // nolint: errcheck
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 256))
+
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+	err = fmt.Errorf("server returned HTTP status %s: %s", resp.Status, bytes.TrimSpace(body))
+	if resp.StatusCode/100 == 5 || resp.StatusCode == http.StatusTooManyRequests {
+		return recoverableError{err}
+	}
+	return err
+}
+
+func (w *remoteWriter) authenticate(req *http.Request) error {
+	if auth := w.cfg.BasicAuth; auth != nil {
+		password := auth.Password
+		if auth.PasswordFile != "" {
+			b, err := ioutil.ReadFile(auth.PasswordFile)
+			if err != nil {
+				return fmt.Errorf("unable to read basic auth password file: %v", err)
+			}
+			password = strings.TrimSpace(string(b))
+		}
+		req.SetBasicAuth(auth.Username, password)
+	}
+
+	token := w.cfg.BearerToken
+	if w.cfg.BearerTokenFile != "" {
+		b, err := ioutil.ReadFile(w.cfg.BearerTokenFile)
+		if err != nil {
+			return fmt.Errorf("unable to read bearer token file: %v", err)
+		}
+		token = strings.TrimSpace(string(b))
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return nil
+}
+
+// Field tags of the remote write protobuf messages.
+const (
+	writeRequestTimeseries = 1<<3 | proto.WireBytes
+
+	timeSeriesLabels  = 1<<3 | proto.WireBytes
+	timeSeriesSamples = 2<<3 | proto.WireBytes
+
+	labelName  = 1<<3 | proto.WireBytes
+	labelValue = 2<<3 | proto.WireBytes
+
+	sampleValue     = 1<<3 | proto.WireFixed64
+	sampleTimestamp = 2<<3 | proto.WireVarint
+)
+
+// encodeWriteRequest encodes every stored series as a remote write
+// WriteRequest protobuf, with a single sample at time now. externalLabels
+// are added to series which don't already have them. Stale series are expired
+// once encoded, as they are when scraped. It returns the encoded request and
+// the number of samples in it.
+func (c *TailCollector) encodeWriteRequest(externalLabels []*dto.LabelPair, now time.Time) ([]byte, int) {
+	timestamp := now.UnixNano() / int64(time.Millisecond)
+
+	req := proto.NewBuffer(nil)
+	series := proto.NewBuffer(nil)
+	msg := proto.NewBuffer(nil)
+	var labels []*dto.LabelPair
+	samples := 0
+
+	// The vendored proto.Buffer never fails to encode.
+	appendMessage := func(dst *proto.Buffer, tag uint64) {
+		_ = dst.EncodeVarint(tag)
+		_ = dst.EncodeRawBytes(msg.Bytes())
+		msg.Reset()
+	}
+
+	// appendSample appends a series of the metric name, with the labels of
+	// metric and extra if it is set, and a single sample of value.
+	appendSample := func(name string, metric *metricValue, extra *dto.LabelPair, value float64) {
+		labels = append(labels[:0], &dto.LabelPair{
+			Name:  proto.String(model.MetricNameLabel),
+			Value: proto.String(name),
+		})
+		labels = append(labels, metric.labelPairs...)
+		if extra != nil {
+			labels = append(labels, extra)
+		}
+		for _, lp := range externalLabels {
+			if !hasLabel(metric.labelPairs, lp.GetName()) {
+				labels = append(labels, lp)
+			}
+		}
+		sort.Sort(labelPairSorter(labels))
+
+		series.Reset()
+		for _, lp := range labels {
+			_ = msg.EncodeVarint(labelName)
+			_ = msg.EncodeStringBytes(lp.GetName())
+			_ = msg.EncodeVarint(labelValue)
+			_ = msg.EncodeStringBytes(lp.GetValue())
+			appendMessage(series, timeSeriesLabels)
+		}
+		_ = msg.EncodeVarint(sampleValue)
+		_ = msg.EncodeFixed64(math.Float64bits(value))
+		_ = msg.EncodeVarint(sampleTimestamp)
+		_ = msg.EncodeVarint(uint64(timestamp))
+		appendMessage(series, timeSeriesSamples)
+
+		_ = req.EncodeVarint(writeRequestTimeseries)
+		_ = req.EncodeRawBytes(series.Bytes())
+		samples++
+	}
+
+	for _, family := range c.getFamilies() {
+		name := family.cfg.Name
+		family.eachSeries(func(metric *metricValue) {
+			if metric.histogram == nil {
+				appendSample(name, metric, nil, metric.Get())
+			} else {
+				h := metric.histogram.write()
+				for _, b := range h.Bucket {
+					le := &dto.LabelPair{
+						Name:  proto.String(model.BucketLabel),
+						Value: proto.String(formatOpenMetricsFloat(b.GetUpperBound())),
+					}
+					appendSample(name+"_bucket", metric, le, float64(b.GetCumulativeCount()))
+				}
+				inf := &dto.LabelPair{
+					Name:  proto.String(model.BucketLabel),
+					Value: proto.String("+Inf"),
+				}
+				appendSample(name+"_bucket", metric, inf, float64(h.GetSampleCount()))
+				appendSample(name+"_sum", metric, nil, h.GetSampleSum())
+				appendSample(name+"_count", metric, nil, float64(h.GetSampleCount()))
+			}
+			if family.expireSeries(metric) {
+				c.timedoutMetrics.Inc()
+			}
+		})
+	}
+	return req.Bytes(), samples
+}
+
+func hasLabel(labels []*dto.LabelPair, name string) bool {
+	for _, lp := range labels {
+		if lp.GetName() == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/wrouesnel/tail_exporter/config"
+)
+
+const remoteWriteConfig = `
+metric_configs:
+- name: example_counter
+  help: example_counter only ever goes up
+  regex: '^COUNTER: (\S+) (\d+)'
+  labels:
+  - name: a
+    value: $1
+  value: +$2
+  timeout: 50ms
+remote_write:
+- url: http://localhost
+  interval: 50ms
+  bearer_token: secret
+  external_labels:
+    zone: z1
+    a: clash
+  queue:
+    min_backoff: 10ms
+    max_backoff: 20ms
+`
+
+// decodeWriteRequest decodes the series of a WriteRequest to their values,
+// keyed by their labels formatted as name=value pairs sorted by name.
+func decodeWriteRequest(t *testing.T, b []byte) map[string]float64 {
+	fields := func(b []byte, fn func(tag uint64, buf *proto.Buffer)) {
+		buf := proto.NewBuffer(b)
+		for {
+			tag, err := buf.DecodeVarint()
+			if err != nil {
+				return
+			}
+			fn(tag, buf)
+		}
+	}
+	bytesField := func(buf *proto.Buffer) []byte {
+		b, err := buf.DecodeRawBytes(false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+
+	series := make(map[string]float64)
+	fields(b, func(tag uint64, buf *proto.Buffer) {
+		if tag != writeRequestTimeseries {
+			t.Fatalf("unexpected WriteRequest field %d", tag)
+		}
+		var labels []string
+		var value float64
+		fields(bytesField(buf), func(tag uint64, buf *proto.Buffer) {
+			switch tag {
+			case timeSeriesLabels:
+				var name, val string
+				fields(bytesField(buf), func(tag uint64, buf *proto.Buffer) {
+					switch tag {
+					case labelName:
+						name = string(bytesField(buf))
+					case labelValue:
+						val = string(bytesField(buf))
+					}
+				})
+				labels = append(labels, name+"="+val)
+			case timeSeriesSamples:
+				fields(bytesField(buf), func(tag uint64, buf *proto.Buffer) {
+					switch tag {
+					case sampleValue:
+						bits, _ := buf.DecodeFixed64()
+						value = math.Float64frombits(bits)
+					case sampleTimestamp:
+						_, _ = buf.DecodeVarint()
+					}
+				})
+			default:
+				t.Fatalf("unexpected TimeSeries field %d", tag)
+			}
+		})
+		sort.Strings(labels)
+		series[strings.Join(labels, ",")] = value
+	})
+	return series
+}
+
+func newRemoteWriteCollector(t *testing.T) (*TailCollector, *config.Config) {
+	cfg, err := config.Load(remoteWriteConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	c, err := newTailCollector(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.IngestLine("COUNTER: 1 5", nil)
+	c.IngestLine("COUNTER: 2 7", nil)
+	c.IngestLine("COUNTER: 2 1", nil)
+	c.Close()
+	return c, cfg
+}
+
+func TestRemoteWrite(t *testing.T) {
+	type request struct {
+		header http.Header
+		body   []byte
+	}
+	requests := make(chan request, 10)
+	failures := 2
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		requests <- request{r.Header, body}
+	}))
+	defer srv.Close()
+
+	c, cfg := newRemoteWriteCollector(t)
+	cfg.RemoteWrite[0].URL = srv.URL
+	w, err := c.newRemoteWriter(cfg.RemoteWrite[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	go w.Run()
+
+	var req request
+	select {
+	case req = <-requests:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no write request was received")
+	}
+
+	for name, expected := range map[string]string{
+		"Authorization":    "Bearer secret",
+		"Content-Encoding": "snappy",
+		"Content-Type":     "application/x-protobuf",
+	} {
+		if value := req.header.Get(name); value != expected {
+			t.Errorf("expected %s header %q, got %q", name, expected, value)
+		}
+	}
+
+	payload, err := snappy.Decode(nil, req.body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Series keep their own labels over external labels.
+	expected := map[string]float64{
+		"__name__=example_counter,a=1,zone=z1": 5,
+		"__name__=example_counter,a=2,zone=z1": 8,
+	}
+	series := decodeWriteRequest(t, payload)
+	if len(series) != len(expected) {
+		t.Errorf("expected %d series, got %v", len(expected), series)
+	}
+	for labels, value := range expected {
+		if got, found := series[labels]; !found || got != value {
+			t.Errorf("expected series %s = %v, got %v", labels, value, series)
+		}
+	}
+}
+
+func TestRemoteWriteExpiresStale(t *testing.T) {
+	requests := make(chan map[string]float64, 100)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		payload, err := snappy.Decode(nil, body)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		requests <- decodeWriteRequest(t, payload)
+	}))
+	defer srv.Close()
+
+	c, cfg := newRemoteWriteCollector(t)
+	cfg.RemoteWrite[0].URL = srv.URL
+	w, err := c.newRemoteWriter(cfg.RemoteWrite[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	go w.Run()
+
+	// Series are written, including once after they are stale, until they
+	// are expired.
+	received := 0
+	deadline := time.After(5 * time.Second)
+	for received == 0 || c.families[0].seriesLen() > 0 {
+		select {
+		case series := <-requests:
+			if len(series) != 2 {
+				t.Errorf("expected 2 series in every request, got %v", series)
+			}
+			received++
+		case <-deadline:
+			t.Fatal("stale series were not expired")
+		}
+	}
+	if value := readValue(t, c.timedoutMetrics); value != 2 {
+		t.Errorf("expected 2 timed out series, got %v", value)
+	}
+	if _, samples := c.encodeWriteRequest(nil, time.Now()); samples != 0 {
+		t.Errorf("expected no samples once series are expired, got %d", samples)
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/log"
+	"github.com/wrouesnel/tail_exporter/config"
+)
+
+// seriesCollector collects only the series a TailCollector extracts from
+// lines, without its own instrumentation.
+type seriesCollector struct {
+	c *TailCollector
+}
+
+func (s seriesCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, family := range s.c.getFamilies() {
+		family.Describe(ch)
+	}
+}
+
+func (s seriesCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, family := range s.c.getFamilies() {
+		family.Collect(ch)
+	}
+}
+
+// replayMetadata implements seriesMetadataFunc for a replay, timestamping
+// series with the log timestamp of their last update. Created timestamps and
+// exemplars are wall clock times so aren't meaningful in a replay.
+func (c *TailCollector) replayMetadata(name string, labels []*dto.LabelPair) (seriesMetadata, bool) {
+	family := c.getFamily(name)
+	if family == nil {
+		return seriesMetadata{}, false
+	}
+	metric := family.getSeries(labels)
+	if metric == nil {
+		return seriesMetadata{}, false
+	}
+	return seriesMetadata{timestamp: metric.LoggedAt()}, true
+}
+
+// replayCommand processes the named files from the beginning to EOF and
+// writes the resulting metrics. It returns the process exit code.
+func replayCommand(cfg *config.Config, filenames []string) int {
+	if len(filenames) == 0 {
+		fmt.Fprintln(os.Stderr, "replay: no input files specified")
+		return 2
+	}
+	if *replayFormat != "text" && *replayFormat != "openmetrics" {
+		fmt.Fprintf(os.Stderr, "replay: unknown output format %q\n", *replayFormat)
+		return 2
+	}
+
+	c, err := newTailCollector(cfg)
+	if err != nil {
+		log.Errorln("Configuration could not be loaded.", err)
+		return 1
+	}
+
+	exitCode := 0
+	for _, filename := range filenames {
+		if err := processFile(c, filename, *inputFormat); err != nil {
+			log.Errorln("Error reading input:", err)
+			exitCode = 1
+		}
+	}
+	c.Close()
+
+	registry := prometheus.NewRegistry()
+	if err := registry.Register(seriesCollector{c}); err != nil {
+		log.Errorln("Error registering metrics:", err)
+		return 1
+	}
+	mfs, err := registry.Gather()
+	if err != nil {
+		log.Errorln("Error gathering metrics:", err)
+		return 1
+	}
+
+	if err := writeReplay(*replayOutput, mfs, c.replayMetadata); err != nil {
+		log.Errorln("Error writing metrics:", err)
+		return 1
+	}
+	return exitCode
+}
+
+// writeReplay writes mfs to the named file, or stdout for "-".
+func writeReplay(filename string, mfs []*dto.MetricFamily, metadata seriesMetadataFunc) (err error) {
+	var out io.Writer = os.Stdout
+	if filename != "-" {
+		var f *os.File
+		if f, err = os.Create(filename); err != nil {
+			return err
+		}
+		// Write errors may only be reported when the file is closed.
+		defer func() {
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+		}()
+		out = f
+	}
+
+	if *replayFormat == "openmetrics" {
+		return writeOpenMetrics(out, mfs, metadata)
+	}
+
+	w := bufio.NewWriter(out)
+	for _, mf := range mfs {
+		if _, err := expfmt.MetricFamilyToText(w, mf); err != nil {
+			return err
+		}
+	}
+	return w.Flush()
+}
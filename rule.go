@@ -0,0 +1,121 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/glenn-brown/golang-pkg-pcre/src/pkg/pcre"
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/log"
+	"github.com/wrouesnel/tail_exporter/config"
+)
+
+// rejectReason enumerates why a matched line can be dropped. It is used as a
+// label value, so must never be built from error strings.
+type rejectReason int
+
+const (
+	rejectUnparseableLabels rejectReason = iota
+	rejectUnparseableValue
+	rejectInconsistentLabels
+	rejectUnparseableTimestamp
+	rejectNegativeDuration
+	numRejectReasons
+)
+
+var rejectReasonNames = [numRejectReasons]string{
+	rejectUnparseableLabels:  "unparseable_labels",
+	rejectUnparseableValue:   "unparseable_value",
+	rejectInconsistentLabels: "inconsistent_labels",
+
+	rejectUnparseableTimestamp: "unparseable_timestamp",
+	rejectNegativeDuration:     "negative_duration",
+}
+
+func (r rejectReason) String() string {
+	return rejectReasonNames[r]
+}
+
+// rule is a MetricParser bound to the metric family it populates, with its
+// instrumentation resolved up front so processing a line doesn't need to
+// look up label values.
+type rule struct {
+	cfg    *config.MetricParser
+	family *metricFamily
+
+	evaluatedLines prometheus.Counter
+	matchedLines   prometheus.Counter
+	rejectedLines  [numRejectReasons]prometheus.Counter
+	regexDuration  prometheus.Observer
+
+	// correlation holds the started events of a correlation rule.
+	correlation *correlation
+}
+
+func (c *TailCollector) newRule(idx int, cfg *config.MetricParser, family *metricFamily) *rule {
+	labels := prometheus.Labels{"metric": cfg.Name, "rule": strconv.Itoa(idx)}
+	r := &rule{
+		cfg:            cfg,
+		family:         family,
+		evaluatedLines: c.evaluatedLines.With(labels),
+		matchedLines:   c.matchedLines.With(labels),
+		regexDuration:  c.regexDuration.With(labels),
+	}
+	for reason := rejectReason(0); reason < numRejectReasons; reason++ {
+		r.rejectedLines[reason] = c.rejectedLines.WithLabelValues(cfg.Name, labels["rule"], reason.String())
+	}
+	if cfg.Correlation != nil {
+		r.correlation = c.newCorrelation(cfg.Correlation, labels)
+	}
+	return r
+}
+
+// reject accounts for a dropped line.
+func (r *rule) reject(reason rejectReason) {
+	r.rejectedLines[reason].Inc()
+}
+
+// annotate records the exemplar and log timestamp of an update of metric by
+// value from the line matched by m.
+func (r *rule) annotate(metric *metricValue, m *pcre.Matcher, meta lineMetadata, value float64, loggedAt time.Time) {
+	if ex := r.exemplar(m, meta, value); ex != nil {
+		metric.SetExemplar(ex)
+	}
+	if !loggedAt.IsZero() {
+		metric.SetLoggedAt(loggedAt)
+	}
+}
+
+// exemplar builds the exemplar of an update of value by the line matched by
+// m, or returns nil if the rule doesn't extract one. An exemplar which can't
+// be parsed is skipped rather than dropping the line.
+func (r *rule) exemplar(m *pcre.Matcher, meta lineMetadata, value float64) *exemplar {
+	if len(r.cfg.Exemplar) == 0 {
+		return nil
+	}
+
+	labels, err := ParseLabelPairsFromMatch(r.cfg.Exemplar, m, meta)
+	if err != nil {
+		log.Debugln("Skipping unparseable exemplar:", err)
+		return nil
+	}
+
+	ex := &exemplar{
+		labels:    make([]*dto.LabelPair, 0, len(labels)),
+		value:     value,
+		timestamp: time.Now(),
+	}
+	for name, value := range labels {
+		ex.labels = append(ex.labels, &dto.LabelPair{
+			Name:  proto.String(name),
+			Value: proto.String(value),
+		})
+	}
+	sort.Slice(ex.labels, func(i, j int) bool {
+		return ex.labels[i].GetName() < ex.labels[j].GetName()
+	})
+	return ex
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/wrouesnel/tail_exporter/config"
+)
+
+func TestRuleAndInputInstrumentation(t *testing.T) {
+	c := newTestCollector(t, `
+metric_configs:
+- name: gets
+  help: GET requests
+  regex: '^GET (\S+)'
+  value: +$1
+- name: posts
+  help: POST requests
+  regex: '^POST'
+  value: +1
+`)
+	app := c.Input("app")
+	for _, line := range []string{"GET 1", "GET x", "POST", "other"} {
+		app.IngestLine(line)
+	}
+	docker := c.FileInput("app.log", config.FormatDocker, nil)
+	docker.IngestLine(`{"log":"POST\n","stream":"stdout","time":"2020-01-01T00:00:00Z"}`)
+	docker.IngestLine("not json")
+	c.Close()
+
+	for _, tc := range []struct {
+		name     string
+		metric   prometheus.Metric
+		expected float64
+	}{
+		{"app lines", c.inputLines.WithLabelValues("app"), 4},
+		{"app bytes", c.inputBytes.WithLabelValues("app"), 19},
+		{"app decode errors", c.inputDecodeErrors.WithLabelValues("app"), 0},
+		{"docker lines", c.inputLines.WithLabelValues("app.log"), 2},
+		{"docker decode errors", c.inputDecodeErrors.WithLabelValues("app.log"), 1},
+		{"gets evaluated", c.evaluatedLines.WithLabelValues("gets", "0"), 5},
+		{"gets matched", c.matchedLines.WithLabelValues("gets", "0"), 2},
+		{"gets rejected", c.rejectedLines.WithLabelValues("gets", "0", "unparseable_value"), 1},
+		{"posts evaluated", c.evaluatedLines.WithLabelValues("posts", "1"), 5},
+		{"posts matched", c.matchedLines.WithLabelValues("posts", "1"), 2},
+		{"posts rejected", c.rejectedLines.WithLabelValues("posts", "1", "unparseable_value"), 0},
+	} {
+		if value := readValue(t, tc.metric); value != tc.expected {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.expected, value)
+		}
+	}
+
+	for _, labels := range [][]string{{"gets", "0"}, {"posts", "1"}} {
+		out := &dto.Metric{}
+		if err := c.regexDuration.WithLabelValues(labels...).(prometheus.Metric).Write(out); err != nil {
+			t.Fatal(err)
+		}
+		if count := out.GetHistogram().GetSampleCount(); count != 5 {
+			t.Errorf("%s: expected 5 regex durations, got %d", labels[0], count)
+		}
+	}
+}
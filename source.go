@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sourceLookupTimeout bounds how long a reverse DNS lookup of a source can
+// hold up ingesting its lines.
+const sourceLookupTimeout = 2 * time.Second
+
+// hostResolver resolves source addresses to host names by reverse DNS,
+// caching the results. Addresses in its hosts file are resolved from it
+// rather than DNS.
+type hostResolver struct {
+	ttl   time.Duration
+	hosts map[string]string
+
+	mtx   sync.Mutex
+	cache map[string]cachedHost
+}
+
+type cachedHost struct {
+	name    string
+	expires time.Time
+}
+
+// newHostResolver returns a resolver which caches names for ttl, and
+// resolves the addresses in hostsFile, if set, from it.
+func newHostResolver(hostsFile string, ttl time.Duration) (*hostResolver, error) {
+	r := &hostResolver{
+		ttl:   ttl,
+		hosts: make(map[string]string),
+		cache: make(map[string]cachedHost),
+	}
+	if hostsFile == "" {
+		return r, nil
+	}
+
+	f, err := os.Open(hostsFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close() // nolint: errcheck
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if idx := strings.IndexByte(line, '#'); idx >= 0 {
+			line = line[:idx]
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		// The first name listed for an address is its canonical name.
+		if ip := net.ParseIP(fields[0]); ip != nil {
+			if _, found := r.hosts[ip.String()]; !found {
+				r.hosts[ip.String()] = fields[1]
+			}
+		}
+	}
+	return r, scanner.Err()
+}
+
+// lookup returns the host name of ip, or ip itself if it has none.
+func (r *hostResolver) lookup(ip string) string {
+	if name, found := r.hosts[ip]; found {
+		return name
+	}
+
+	now := time.Now()
+	r.mtx.Lock()
+	cached, found := r.cache[ip]
+	r.mtx.Unlock()
+	if found && now.Before(cached.expires) {
+		return cached.name
+	}
+
+	name := ip
+	ctx, cancel := context.WithTimeout(context.Background(), sourceLookupTimeout)
+	defer cancel()
+	if names, err := net.DefaultResolver.LookupAddr(ctx, ip); err == nil && len(names) > 0 {
+		name = strings.TrimSuffix(names[0], ".")
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	// Expired entries are only replaced, so drop them all now and then to
+	// bound the cache to recent sources.
+	if len(r.cache) > 4096 {
+		for cachedIP, cached := range r.cache {
+			if now.After(cached.expires) {
+				delete(r.cache, cachedIP)
+			}
+		}
+	}
+	r.cache[ip] = cachedHost{name: name, expires: now.Add(r.ttl)}
+	return name
+}
+
+// sourceMetadata returns metadata identifying the source of lines received
+// from addr: its source_ip and source_port, and its source_host if the
+// resolver is set.
+func sourceMetadata(addr net.Addr, resolver *hostResolver) lineMetadata {
+	var ip net.IP
+	var port int
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		ip, port = addr.IP, addr.Port
+	case *net.UDPAddr:
+		ip, port = addr.IP, addr.Port
+	default:
+		return nil
+	}
+
+	meta := lineMetadata{
+		"source_ip":   ip.String(),
+		"source_port": strconv.Itoa(port),
+	}
+	if resolver != nil {
+		meta["source_host"] = resolver.lookup(ip.String())
+	}
+	return meta
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/wrouesnel/tail_exporter/config"
+)
+
+const sourceConfig = `
+metric_configs:
+- name: requests
+  help: requests by source
+  type: counter
+  regex: '^request'
+  labels:
+  - name: ip
+    value: $__source_ip
+  - name: host
+    value: $__source_host
+  value: +1
+`
+
+func writeHostsFile(t *testing.T) string {
+	f, err := ioutil.TempFile("", "hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.WriteString(`# comment
+10.0.0.1    web1.example web1
+10.0.0.1    duplicate.example
+2001:db8::0001  v6.example # trailing comment
+not-an-ip   ignored.example
+10.0.0.2
+`)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
+func TestHostResolver(t *testing.T) {
+	hostsFile := writeHostsFile(t)
+	defer os.Remove(hostsFile) // nolint: errcheck
+
+	r, err := newHostResolver(hostsFile, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ip, expected := range map[string]string{
+		"10.0.0.1":    "web1.example",
+		"2001:db8::1": "v6.example",
+	} {
+		if name := r.lookup(ip); name != expected {
+			t.Errorf("expected %s to resolve to %s, got %s", ip, expected, name)
+		}
+	}
+	if len(r.hosts) != 2 {
+		t.Errorf("expected 2 hosts, got %v", r.hosts)
+	}
+
+	// Cached names are used until they expire.
+	now := time.Now()
+	r.cache["127.0.0.1"] = cachedHost{name: "cached.example", expires: now.Add(time.Minute)}
+	if name := r.lookup("127.0.0.1"); name != "cached.example" {
+		t.Errorf("expected the cached name, got %s", name)
+	}
+	r.cache["127.0.0.1"] = cachedHost{name: "cached.example", expires: now.Add(-time.Second)}
+	if name := r.lookup("127.0.0.1"); name == "cached.example" {
+		t.Error("expected an expired name to be resolved again")
+	}
+	if cached := r.cache["127.0.0.1"]; cached.expires.Before(now.Add(59 * time.Minute)) {
+		t.Errorf("expected the name to be cached for the TTL, expires at %v", cached.expires)
+	}
+
+	if _, err := newHostResolver(hostsFile+".missing", time.Hour); err == nil {
+		t.Error("expected an error for a missing hosts file")
+	}
+}
+
+func TestSourceHostLabels(t *testing.T) {
+	hostsFile := writeHostsFile(t)
+	defer os.Remove(hostsFile) // nolint: errcheck
+
+	cfg, err := config.Load(sourceConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := newTailCollector(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.resolver, err = newHostResolver(hostsFile, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	meta := sourceMetadata(&net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 5140}, c.resolver)
+	if meta["source_port"] != "5140" {
+		t.Errorf("expected source_port 5140, got %v", meta)
+	}
+	c.IngestLine("request", meta)
+	c.IngestLine("request", meta)
+	c.Close()
+
+	metric := c.families[0].getSeries([]*dto.LabelPair{
+		{Name: proto.String("ip"), Value: proto.String("10.0.0.1")},
+		{Name: proto.String("host"), Value: proto.String("web1.example")},
+	})
+	if metric == nil {
+		t.Fatal("expected a series labelled with the source's host name")
+	}
+	if value := metric.Get(); value != 2 {
+		t.Errorf("expected 2 requests, got %v", value)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+	"github.com/wrouesnel/tail_exporter/config"
+)
+
+// listenStatsd binds the TCP and UDP sockets of a statsd input, and starts
+// storing the samples sent to them. Samples are newline delimited on both.
+func (c *TailCollector) listenStatsd(cfg *config.InputConfig) error {
+	l, err := net.Listen("tcp", cfg.Address)
+	if err != nil {
+		return err
+	}
+	conn, err := net.ListenPacket("udp", cfg.Address)
+	if err != nil {
+		logErr(l.Close())
+		return err
+	}
+	m := &mapper{c: c, cfg: cfg}
+
+	go c.acceptStream(l, cfg.Name, func(conn net.Conn, r io.Reader) error {
+		input := c.networkInput(cfg, conn.RemoteAddr())
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			m.ingestStatsd(input, scanner.Text())
+		}
+		return scanner.Err()
+	})
+	go readPackets(conn, *collectorUDPWorkers, func(addr net.Addr, packet []byte) {
+		input := c.networkInput(cfg, addr)
+		for _, line := range strings.Split(string(packet), "\n") {
+			m.ingestStatsd(input, line)
+		}
+	})
+	return nil
+}
+
+// ingestStatsd stores the sample of a statsd line received by input.
+func (m *mapper) ingestStatsd(input *LineInput, line string) {
+	line = strings.TrimSpace(line)
+	if line == "" || !input.admit(line) {
+		return
+	}
+	s, err := parseStatsd(line)
+	if err != nil {
+		input.decodeErrors.Inc()
+		log.Debugln("Invalid statsd line from", input.name, err)
+		return
+	}
+	m.store(input, s)
+}
+
+// parseStatsd parses a statsd line of the form name:value|type, optionally
+// followed by a sample rate |@rate and DogStatsD tags |#name:value,... Timers
+// (ms) are converted to seconds and, like histograms (h) and distributions
+// (d), observed in a histogram. Gauge values with a sign are relative.
+func parseStatsd(line string) (*mappedSample, error) {
+	colon := strings.IndexByte(line, ':')
+	if colon <= 0 {
+		return nil, fmt.Errorf("line has no metric name: %q", line)
+	}
+	fields := strings.Split(line[colon+1:], "|")
+	if len(fields) < 2 {
+		return nil, fmt.Errorf("line has no metric type: %q", line)
+	}
+
+	s := &mappedSample{name: line[:colon], count: 1}
+	valueStr := fields[0]
+	value, err := strconv.ParseFloat(valueStr, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid value %q", valueStr)
+	}
+
+	rate := 1.0
+	for _, field := range fields[2:] {
+		switch {
+		case strings.HasPrefix(field, "@"):
+			rate, err = strconv.ParseFloat(field[1:], 64)
+			if err != nil || rate <= 0 || rate > 1 {
+				return nil, fmt.Errorf("invalid sample rate %q", field[1:])
+			}
+		case strings.HasPrefix(field, "#"):
+			s.tags = parseStatsdTags(field[1:])
+		}
+	}
+
+	switch fields[1] {
+	case "c":
+		// Counters only go up.
+		if value < 0 || math.IsNaN(value) || math.IsInf(value, 0) {
+			return nil, fmt.Errorf("invalid counter value %q", valueStr)
+		}
+		s.typ, s.op, s.value = config.MetricCounter, sampleAdd, value/rate
+	case "g":
+		s.typ, s.op, s.value = config.MetricGauge, sampleSet, value
+		if valueStr[0] == '+' || valueStr[0] == '-' {
+			s.op = sampleAdd
+		}
+	case "ms", "h", "d":
+		s.typ, s.op, s.value = config.MetricHistogram, sampleObserve, value
+		if fields[1] == "ms" {
+			s.value = value / 1000
+		}
+		s.count = uint64(math.Max(1, math.Floor(1/rate+0.5)))
+	default:
+		return nil, fmt.Errorf("unsupported metric type %q", fields[1])
+	}
+	return s, nil
+}
+
+// parseStatsdTags parses comma separated DogStatsD tags of the form
+// name:value. Tags without a value are skipped.
+func parseStatsdTags(s string) prometheus.Labels {
+	tags := make(prometheus.Labels)
+	for _, tag := range strings.Split(s, ",") {
+		if idx := strings.IndexByte(tag, ':'); idx > 0 {
+			tags[escapeName(tag[:idx])] = tag[idx+1:]
+		}
+	}
+	return tags
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/wrouesnel/tail_exporter/config"
+)
+
+func TestParseStatsd(t *testing.T) {
+	for _, tc := range []struct {
+		line     string
+		expected *mappedSample // or nil if the line is invalid
+	}{
+		{"hits:1|c", &mappedSample{name: "hits", typ: config.MetricCounter, op: sampleAdd, value: 1, count: 1}},
+		{"hits:2|c|@0.5", &mappedSample{name: "hits", typ: config.MetricCounter, op: sampleAdd, value: 4, count: 1}},
+		{"hits:0|c", &mappedSample{name: "hits", typ: config.MetricCounter, op: sampleAdd, value: 0, count: 1}},
+		{"hits:-1|c", nil},
+		{"hits:NaN|c", nil},
+		{"hits:+Inf|c", nil},
+		{"hits:-Inf|c", nil},
+		{"hits:1|c|@0", nil},
+		{"hits:1|c|@1.5", nil},
+		{"temp:-3|g", &mappedSample{name: "temp", typ: config.MetricGauge, op: sampleAdd, value: -3, count: 1}},
+		{"temp:3|g", &mappedSample{name: "temp", typ: config.MetricGauge, op: sampleSet, value: 3, count: 1}},
+		{"took:250|ms|@0.25", &mappedSample{name: "took", typ: config.MetricHistogram, op: sampleObserve, value: 0.25, count: 4}},
+		{"size:3|h", &mappedSample{name: "size", typ: config.MetricHistogram, op: sampleObserve, value: 3, count: 1}},
+		{"hits:1", nil},
+		{":1|c", nil},
+		{"hits:one|c", nil},
+		{"hits:1|s", nil},
+	} {
+		s, err := parseStatsd(tc.line)
+		if tc.expected == nil {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %+v", tc.line, s)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.line, err)
+		} else if !reflect.DeepEqual(s, tc.expected) {
+			t.Errorf("%s: expected %+v, got %+v", tc.line, tc.expected, s)
+		}
+	}
+}
+
+func TestStatsdTags(t *testing.T) {
+	cfg, err := config.Load(fileInputConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := newTailCollector(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inputCfg := &config.InputConfig{Kind: config.InputKindStatsd, Name: "statsd"}
+	m := &mapper{c: c, cfg: inputCfg}
+	input := c.networkInput(inputCfg, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 8125})
+
+	m.ingestStatsd(input, "requests:1|c|#method:get,code:200")
+	// A missing tag is an empty label.
+	m.ingestStatsd(input, "requests:2|c|#method:get")
+	m.ingestStatsd(input, "requests:4|c")
+	// A tag the first sample didn't have is rejected.
+	m.ingestStatsd(input, "requests:8|c|#method:get,code:200,path:/")
+	// Counters can't go down, or become NaN.
+	m.ingestStatsd(input, "requests:-1|c|#method:get,code:200")
+	m.ingestStatsd(input, "requests:NaN|c|#method:get,code:200")
+
+	family := c.getFamily("requests")
+	if family == nil {
+		t.Fatal("expected the requests family to be created")
+	}
+	for _, tc := range []struct {
+		method, code string
+		value        float64
+	}{
+		{"get", "200", 1},
+		{"get", "", 2},
+		{"", "", 4},
+	} {
+		metric := family.getSeries([]*dto.LabelPair{
+			{Name: proto.String("code"), Value: proto.String(tc.code)},
+			{Name: proto.String("method"), Value: proto.String(tc.method)},
+		})
+		if metric == nil {
+			t.Errorf("expected a series with method=%q code=%q", tc.method, tc.code)
+		} else if value := metric.Get(); value != tc.value {
+			t.Errorf("expected method=%q code=%q to be %v, got %v", tc.method, tc.code, tc.value, value)
+		}
+	}
+	if n := family.seriesLen(); n != 3 {
+		t.Errorf("expected 3 series, got %d", n)
+	}
+
+	rejected := &dto.Metric{}
+	if err := c.rejectedSamples.WithLabelValues("statsd", "inconsistent_labels").Write(rejected); err != nil {
+		t.Fatal(err)
+	}
+	if value := rejected.GetCounter().GetValue(); value != 1 {
+		t.Errorf("expected 1 inconsistent sample, got %v", value)
+	}
+	if value := readValue(t, c.inputDecodeErrors.WithLabelValues("statsd")); value != 2 {
+		t.Errorf("expected 2 invalid counter samples, got %v", value)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// collectorTLSConfig returns the TLS configuration of the TCP collector or a
+// network input, or nil if TLS isn't enabled. With a client CA, clients must present a
+// certificate it signed.
+func collectorTLSConfig(certFile string, keyFile string, clientCAFile string) (*tls.Config, error) {
+	if certFile == "" && keyFile == "" {
+		if clientCAFile != "" {
+			return nil, errors.New("a client CA requires a certificate and key")
+		}
+		return nil, nil
+	}
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("both a certificate and key are required")
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if clientCAFile != "" {
+		pem, err := ioutil.ReadFile(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", clientCAFile)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
+
+// tlsClientMetadata completes the handshake of conn, and returns metadata
+// identifying the client by its verified certificate: its common name as
+// tls_client_cn, and its DNS, IP and email subject alternative names as
+// tls_client_sans. It returns nil if the client wasn't verified.
+func tlsClientMetadata(conn *tls.Conn) (lineMetadata, error) {
+	if err := conn.Handshake(); err != nil {
+		return nil, err
+	}
+	state := conn.ConnectionState()
+	if len(state.VerifiedChains) == 0 {
+		return nil, nil
+	}
+
+	cert := state.VerifiedChains[0][0]
+	sans := append([]string(nil), cert.DNSNames...)
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	sans = append(sans, cert.EmailAddresses...)
+	return lineMetadata{
+		"tls_client_cn":   cert.Subject.CommonName,
+		"tls_client_sans": strings.Join(sans, ","),
+	}, nil
+}